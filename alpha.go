@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// alphaExts are the extensions of outputs without alpha.
+var alphaExts = []string{".jpg", ".jpeg"}
+
+// parseAlpha parses -alpha, "keep", "error" or "flatten:#rrggbb",
+// returning the background of flatten.
+func parseAlpha(s string) ([3]int, error) {
+	var bg [3]int
+	switch {
+	case s == "" || s == "keep" || s == "error":
+		return bg, nil
+	case strings.HasPrefix(s, "flatten:#") && len(s) == len("flatten:#")+6:
+		for i := range bg {
+			n, err := strconv.ParseUint(s[len("flatten:#")+2*i:][:2], 16, 8)
+			if err != nil {
+				return bg, fmt.Errorf("bad colour of alpha: %q", s)
+			}
+			bg[i] = int(n)
+		}
+		return bg, nil
+	}
+	return bg, fmt.Errorf(
+		"alpha must be \"keep\", \"flatten:#rrggbb\", \"error\" or \"\": %q", s)
+}
+
+// hasAlpha reports whether an image of props has an alpha band. cmyk has
+// four bands without one.
+func hasAlpha(props map[string]string) bool {
+	bands, _ := strconv.Atoi(props["bands"])
+	switch interp := props["interpretation"]; {
+	case interp == "cmyk":
+		return bands > 4
+	case interp == "b-w" || strings.HasPrefix(interp, "grey"):
+		return bands > 1
+	}
+	return bands > 3
+}
+
+// fitAlpha applies cfg.Alpha to a source with alpha: "flatten:#rrggbb"
+// flattens it on the colour, "error" fails it, and "keep" fails it for an
+// output without alpha.
+func fitAlpha(cfg *config, w *worker, src, load, dest string) (string,
+	string, error) {
+	if cfg.Alpha == "" {
+		return "", "", nil
+	}
+	props, err := probe(cfg, src)
+	if err != nil || !hasAlpha(props) {
+		return "", "", err
+	}
+	switch {
+	case cfg.Alpha == "error":
+		return "", "", errors.New("has alpha")
+	case cfg.Alpha == "keep":
+		if hasExt(dest, alphaExts) {
+			return "", "", fmt.Errorf("has alpha, which %s can not keep",
+				filepath.Ext(dest))
+		}
+		return "", "", nil
+	}
+
+	bg, _ := parseAlpha(cfg.Alpha)
+	// in the range of the samples, a level for greys.
+	max := 255
+	switch props["format"] {
+	case "ushort":
+		max = 65535
+	case "float", "double":
+		max = 1
+	}
+	var vs []string
+	for _, v := range bg {
+		vs = append(vs, strconv.FormatFloat(float64(v*max)/255, 'g', -1, 64))
+	}
+	if interp := props["interpretation"]; interp == "b-w" ||
+		strings.HasPrefix(interp, "grey") {
+		l := float64(299*bg[0]+587*bg[1]+114*bg[2]) / 1000
+		vs = []string{strconv.FormatFloat(l*float64(max)/255, 'g', -1, 64)}
+	}
+	return fitCmd(cfg, w, src, load, dest, ".flat.tif",
+		"vips flatten %s %s --background %s",
+		shellQuote(strings.Join(vs, " ")))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+)
+
+// animatedExts are the extensions of sources which can be animated.
+var animatedExts = []string{".gif", ".webp"}
+
+// isAnimated reports whether src has more than a frame.
+func isAnimated(cfg *config, src string) (bool, error) {
+	if !hasExt(src, animatedExts) {
+		return false, nil
+	}
+	props, err := probe(cfg, src)
+	if err != nil {
+		return false, err
+	}
+	n, _ := strconv.Atoi(props["n-pages"])
+	return n > 1, nil
+}
+
+// framesSuffix returns the load options of the converter engine, put after
+// the source, taking its frames by the policy of -animated, "first" or
+// "pages". libvips, and vipsthumbnail and steps of vips likely, take
+// [n=1] or [n=-1], and the magicks [0] or all frames as they do anyway.
+func framesSuffix(engine, policy string) string {
+	switch {
+	case policy == "":
+		return ""
+	case engine == "imagemagick" || engine == "graphicsmagick":
+		if policy == "first" {
+			return "[0]"
+		}
+		return ""
+	case engine == "gpu":
+		return ""
+	case policy == "first":
+		return "[n=1]"
+	}
+	return "[n=-1]"
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// apiKey is a client of the queue server, e.g. a department, with its
+// quotas. zero quotas are no limits.
+type apiKey struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Admin    bool   `json:"admin"`     // sees and cancels the runs of all
+	MaxRuns  int    `json:"max_runs"`  // running at a time
+	MaxProc  int    `json:"max_proc"`  // workers running at a time
+	MaxFiles int    `json:"max_files"` // of a run, as -max-files
+	MaxBytes string `json:"max_bytes"` // of a run, as -max-bytes
+	// Root is the dir -s, -d and -b of runs are kept in, for keys but
+	// admin ones. without it, runs of the key take those of the server.
+	Root string `json:"root"`
+}
+
+// keyFlags are the options runs of keys but admin ones can give: of the
+// conversion, neither command formats run by sh, e.g. -f or -post, nor
+// files the server writes, e.g. config.json by -save or -log, nor runs
+// that never end by -watch.
+var keyFlags = map[string]bool{"t": true, "v": true, "p": true,
+	"type": true, "e": true, "dest-ext": true, "engine": true,
+	"profile": true, "fallback": true, "renditions": true, "animated": true,
+	"bit-depth": true, "depth-method": true, "alpha": true,
+	"quality-gate": true, "verify-lossless": true, "limit": true,
+	"max-files": true, "max-bytes": true, "collisions": true, "tag": true,
+	"run-id": true, "dest-run-subdir": true, "id-regex": true,
+	"filelist-encoding": true, "filelist-start-line": true,
+	"filelist-end-line": true, "flatten": true, "normalize": true,
+	"transliterate": true, "renumber": true, "renumber-width": true,
+	"skip-existing": true, "largest-first": true, "vips-concurrency": true,
+	"hash-proc": true, "check-proc": true, "stop-after-errors": true,
+	"timeout": true, "retries": true}
+
+// rootFlags are the options of paths kept in the root of a key.
+var rootFlags = map[string]bool{"s": true, "d": true, "b": true}
+
+// checkKeyArgs checks the options fs of a run of k, of keyFlags and of
+// paths in its root, which -s and -d must be given in. admin keys take
+// any, and servers without keys, k nil, keyFlags and paths anywhere.
+func checkKeyArgs(k *apiKey, fs *flag.FlagSet) error {
+	var err error
+	if k == nil {
+		fs.Visit(func(f *flag.Flag) {
+			if err == nil && !keyFlags[f.Name] && !rootFlags[f.Name] {
+				err = fmt.Errorf("-%s is not allowed without -keys", f.Name)
+			}
+		})
+		return err
+	}
+	if k.Admin {
+		return nil
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		switch {
+		case err != nil:
+		case rootFlags[f.Name] && k.Root == "":
+			err = fmt.Errorf("-%s is not allowed for %s without a root",
+				f.Name, k.Name)
+		case rootFlags[f.Name]:
+			if !inRoot(k.Root, f.Value.String()) {
+				err = fmt.Errorf("-%s %s is out of the root of %s", f.Name,
+					f.Value, k.Name)
+			}
+		case !keyFlags[f.Name]:
+			err = fmt.Errorf("-%s is not allowed for %s", f.Name, k.Name)
+		}
+	})
+	if err == nil && k.Root != "" {
+		// not to take those of the server, out of the root.
+		need := []string{"s", "d"}
+		if strings.HasPrefix(fs.Lookup("type").Value.String(), "filelist") {
+			need = append(need, "b")
+		}
+		for _, n := range need {
+			if !given[n] {
+				return fmt.Errorf("-%s in the root of %s is required", n,
+					k.Name)
+			}
+		}
+	}
+	return err
+}
+
+// inRoot reports whether p is in the dir root, links followed as far as
+// they exist.
+func inRoot(root, p string) bool {
+	root, p = realPath(root), realPath(p)
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// realPath returns the absolute path of p with the links of its longest
+// existing part followed.
+func realPath(p string) string {
+	p, _ = filepath.Abs(p)
+	rest := ""
+	for {
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(r, rest)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Join(p, rest)
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// loadKeys reads the api keys at path, a json array of apiKey.
+func loadKeys(path string) ([]*apiKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*apiKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	names := map[string]bool{}
+	for i, k := range keys {
+		switch {
+		case len(k.Key) < 16:
+			return nil, fmt.Errorf("%s: key %d is shorter than 16 bytes",
+				path, i+1)
+		case k.Name == "" || names[k.Name]:
+			return nil, fmt.Errorf("%s: key %d has no name or a taken one",
+				path, i+1)
+		case k.MaxRuns < 0 || k.MaxProc < 0 || k.MaxFiles < 0:
+			return nil, fmt.Errorf("%s: %s: negative quota", path, k.Name)
+		}
+		if _, err := parseSize(k.MaxBytes); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", path, k.Name, err)
+		}
+		names[k.Name] = true
+	}
+	return keys, nil
+}
+
+// authKey returns the key r is sent with, as "Authorization: Bearer KEY" or
+// "X-API-Key: KEY", or nil.
+func (s *queueServer) authKey(r *http.Request) *apiKey {
+	got := r.Header.Get("X-API-Key")
+	if a := r.Header.Get("Authorization"); got == "" &&
+		strings.HasPrefix(a, "Bearer ") {
+		got = strings.TrimPrefix(a, "Bearer ")
+	}
+	var found *apiKey
+	for _, k := range s.keys {
+		// not to tell keys by timing.
+		if subtle.ConstantTimeCompare([]byte(got), []byte(k.Key)) == 1 {
+			found = k
+		}
+	}
+	return found
+}
+
+// auth returns the key of r, replying 401 and false if it has none to be
+// served. the key is nil if the server takes no keys.
+func (s *queueServer) auth(w http.ResponseWriter, r *http.Request) (*apiKey,
+	bool) {
+	if s.keys == nil {
+		return nil, true
+	}
+	k := s.authKey(r)
+	if k == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imconvvips"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return k, true
+}
+
+// visible reports whether qr is shown to k.
+func visible(k *apiKey, qr *queuedRun) bool {
+	return k == nil || k.Admin || qr.Owner == k.Name
+}
+
+// keyActor describes the client of r with key k for the audit log.
+func keyActor(k *apiKey, r *http.Request) string {
+	if k == nil {
+		return httpActor(r)
+	}
+	return httpActor(r) + " key=" + k.Name
+}
+
+// owner returns the key named name, or nil.
+func (s *queueServer) owner(name string) *apiKey {
+	for _, k := range s.keys {
+		if k.Name == name {
+			return k
+		}
+	}
+	return nil
+}
+
+// quotaArgs returns options enforcing the quotas of k on a run of args, to
+// be given after them: the lower of those of the run and of k.
+func quotaArgs(k *apiKey, args []string) []string {
+	if k == nil {
+		return nil
+	}
+	var files int
+	var size string
+	if fs, err := checkArgs(args); err == nil {
+		files, _ = strconv.Atoi(fs.Lookup("max-files").Value.String())
+		size = fs.Lookup("max-bytes").Value.String()
+	}
+	if k.MaxFiles > 0 && (files <= 0 || k.MaxFiles < files) {
+		files = k.MaxFiles
+	}
+	n, _ := parseSize(size)
+	if max, _ := parseSize(k.MaxBytes); max > 0 && (n <= 0 || max < n) {
+		size = k.MaxBytes
+	}
+	var q []string
+	if files > 0 {
+		q = append(q, "-max-files", fmt.Sprint(files))
+	}
+	if size != "" {
+		q = append(q, "-max-bytes", size)
+	}
+	return q
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is a control action in the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Run    string    `json:"run,omitempty"`
+	Error  string    `json:"error,omitempty"` // if refused or failed
+}
+
+// auditLog appends who did what to the run or the queue server to a json
+// lines file, apart from the logs of conversion.
+type auditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	run string
+	cfg *config
+}
+
+func openAudit(cfg *config) (*auditLog, error) {
+	// never truncated nor rewritten.
+	f, err := os.OpenFile(cfg.Audit, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f, run: cfg.RunID, cfg: cfg}, nil
+}
+
+// record appends an action of actor on target, failed if err is not nil.
+// a may be nil.
+func (a *auditLog) record(actor, action, target string, err error) {
+	if a == nil {
+		return
+	}
+	e := &auditEntry{Time: time.Now(), Actor: actor, Action: action,
+		Target: target, Run: a.run}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b, _ := json.Marshal(e)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, werr := a.f.Write(append(b, '\n'))
+	if werr == nil {
+		werr = a.f.Sync()
+	}
+	if werr != nil {
+		a.cfg.Log.Write([]byte(fmt.Sprintf("error: audit: %s\n", werr)))
+	}
+}
+
+func (a *auditLog) Close() error {
+	return a.f.Close()
+}
+
+// httpActor describes the client of r for the audit log.
+func httpActor(r *http.Request) string {
+	a := "http " + r.RemoteAddr
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		a += " cn=" + r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return a
+}
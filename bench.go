@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseInts parses a comma separated list of integers.
+func parseInts(s string) ([]int, error) {
+	var ns []int
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// benchMain converts a sample set with each combination of engines, worker
+// counts and vips concurrency settings and reports the throughput.
+func benchMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	setFlags(fs, cfg)
+	procs := fs.String("procs", "1,2,4,8", "worker counts to try")
+	concs := fs.String("concurrency", "0",
+		"VIPS_CONCURRENCY values to try (0 to inherit)")
+	engines := fs.String("engines", "",
+		"engines to try, e.g. \"vips,gpu\" (default -engine)")
+	n := fs.Int("n", 20, "number of sample files (0 for all)")
+	fs.Parse(args)
+
+	cfg.Save = false
+	closeLogs, err := setup(cfg)
+	defer closeLogs()
+	if err != nil {
+		return err
+	}
+
+	ps, err := parseInts(*procs)
+	if err != nil {
+		return err
+	}
+	cs, err := parseInts(*concs)
+	if err != nil {
+		return err
+	}
+	es := []string{cfg.Engine}
+	if *engines != "" {
+		es = strings.Split(*engines, ",")
+	}
+	for _, e := range es {
+		if _, err := newConverter(cfg, e); err != nil {
+			return err
+		}
+	}
+
+	// collect samples once so that every trial converts the same set.
+	samples, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+	if *n > 0 && len(samples) > *n {
+		samples = samples[:*n]
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("bench: %d sample files\n", len(samples))))
+
+	for _, e := range es {
+		for _, p := range ps {
+			for _, c := range cs {
+				dest, err := os.MkdirTemp("", "imconvvips-bench")
+				if err != nil {
+					return err
+				}
+				trial := *cfg
+				trial.Engine = e
+				trial.Proc = p
+				trial.VipsConcurrency = c
+				trial.DestDir = dest
+				// measure the engine itself, not its fallbacks.
+				trial.Fallback = "none"
+				// weighted slots of the workers of the trial.
+				if trial.slots, err = newSlots(&trial); err != nil {
+					return err
+				}
+
+				start := time.Now()
+				st := newState()
+				run(&trial, st, func(q chan string) error {
+					for _, src := range samples {
+						q <- src
+					}
+					return nil
+				})
+				elapsed := time.Since(start)
+				os.RemoveAll(dest)
+
+				fmt.Fprintf(os.Stdout,
+					"engine=%s proc=%d concurrency=%d converted=%d failed=%d "+
+						"elapsed=%s files/s=%.2f\n",
+					e, p, c, st.converted, st.failed,
+					elapsed.Round(time.Millisecond),
+					float64(st.converted)/elapsed.Seconds())
+			}
+		}
+	}
+	return nil
+}
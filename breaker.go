@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// breaker trips when more than pct percent of the last files have failed.
+type breaker struct {
+	pct float64
+
+	mu     sync.Mutex
+	window []bool // failed or not, as a ring
+	i, n   int
+	failed int
+}
+
+// parseBreaker parses "PCT%/FILES" of -breaker, e.g. "50%/20".
+func parseBreaker(s string) (*breaker, error) {
+	kv := strings.SplitN(s, "/", 2)
+	if len(kv) != 2 || !strings.HasSuffix(kv[0], "%") {
+		return nil, fmt.Errorf("breaker must be PCT%%/FILES: %s", s)
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(kv[0], "%"), 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return nil, fmt.Errorf("invalid breaker percentage: %s", s)
+	}
+	n, err := strconv.Atoi(kv[1])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid breaker files: %s", s)
+	}
+	return &breaker{pct: pct, window: make([]bool, n)}, nil
+}
+
+// add records the outcome of a file and reports whether the breaker trips,
+// in which case it starts over.
+func (b *breaker) add(failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.n == len(b.window) {
+		if b.window[b.i] {
+			b.failed--
+		}
+	} else {
+		b.n++
+	}
+	b.window[b.i] = failed
+	if failed {
+		b.failed++
+	}
+	b.i = (b.i + 1) % len(b.window)
+
+	if b.n < len(b.window) ||
+		float64(b.failed)*100 <= b.pct*float64(len(b.window)) {
+		return false
+	}
+	b.i, b.n, b.failed = 0, 0, 0
+	for i := range b.window {
+		b.window[i] = false
+	}
+	return true
+}
+
+// checkBreaker pauses the run if r makes the breaker trip.
+func checkBreaker(cfg *config, st *state, r *result) {
+	if !cfg.breaker.add(!r.ok()) {
+		return
+	}
+	text := fmt.Sprintf("more than %g%% of the last %d files failed, paused",
+		cfg.breaker.pct, len(cfg.breaker.window))
+	cfg.Log.Write([]byte(fmt.Sprintf("alert: %s\n  the last one: %s\n",
+		text, r.Error)))
+	st.setPaused(true)
+	cfg.audit.record("breaker", "pause", "", nil)
+	if cfg.notify != nil {
+		cfg.notify.send(cfg, st, "breaker", text+", the last one:\n"+r.Error)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cmdError is the failure of a command along with what it ran with, kept
+// for classifying it and for -debug-bundle.
+type cmdError struct {
+	err    error
+	cmd    string
+	env    []string
+	stderr string
+}
+
+func (e *cmdError) Error() string {
+	return e.err.Error()
+}
+
+func (e *cmdError) Unwrap() error {
+	return e.err
+}
+
+// maxStderr is how much of the end of stderr a failure keeps.
+const maxStderr = 1 << 20
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	b   []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = t.b[len(t.b)-t.max:]
+	}
+	return len(p), nil
+}
+
+// parts of names of environment variables whose values are not bundled.
+var secretEnv = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY",
+	"SAS", "CREDENTIAL", "AUTH"}
+
+func redactEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		name := strings.ToUpper(strings.SplitN(kv, "=", 2)[0])
+		for _, s := range secretEnv {
+			if strings.Contains(name, s) {
+				kv = strings.SplitN(kv, "=", 2)[0] + "=(redacted)"
+				break
+			}
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// writeBundle writes a tarball of what is needed to report the failure of
+// src to vips into cfg.DebugBundle: the error, the command, its environment
+// and stderr if it was a command that failed, the vips version, the header
+// of src and the config.
+func writeBundle(cfg *config, src string, err error) (string, error) {
+	files := map[string][]byte{"error.txt": []byte(err.Error() + "\n")}
+	var ce *cmdError
+	if errors.As(err, &ce) {
+		files["command.txt"] = []byte(ce.cmd + "\n")
+		files["env.txt"] = []byte(strings.Join(redactEnv(ce.env), "\n") + "\n")
+		files["stderr.txt"] = []byte(ce.stderr)
+	}
+	out, _ := cmdOutput(cfg, "vips --version")
+	files["vips-version.txt"] = out
+	out, _ = cmdOutput(cfg, formatCmd("vipsheader -a %s", src))
+	files["header.txt"] = out
+	c := *cfg
+	c.UploadHeaders = nil // may have credentials
+	if b, err := json.MarshalIndent(&c, "", "  "); err == nil {
+		files["config.json"] = b
+	}
+
+	if err := os.MkdirAll(cfg.DebugBundle, 0755); err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+	path := filepath.Join(cfg.DebugBundle, fmt.Sprintf("%s-%s.tar.gz", name,
+		time.Now().Format("20060102-150405.000")))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	dir := name + "-debug"
+	for _, n := range []string{"error.txt", "command.txt", "env.txt",
+		"stderr.txt", "vips-version.txt", "header.txt", "config.json"} {
+		b, ok := files[n]
+		if !ok {
+			continue
+		}
+		err := tw.WriteHeader(&tar.Header{Name: dir + "/" + n, Mode: 0644,
+			Size: int64(len(b)), ModTime: time.Now()})
+		if err != nil {
+			return "", err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hashFile returns the hex sha256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// profileKey identifies the output settings: outputs of the same source
+// with the same key are the same, post processing included.
+func profileKey(cfg *config) string {
+	h := sha256.New()
+	io.WriteString(h, strings.Join([]string{cfg.Engine, cfg.VipsFmt,
+		cfg.IMFmt, cfg.GMFmt, cfg.NativeOpts}, "\x00"))
+	if cfg.GPUFmt != "" {
+		io.WriteString(h, "\x00"+cfg.GPUFmt)
+	}
+	for _, s := range cfg.Steps {
+		io.WriteString(h, "\x00"+s.Cmd+"\x00"+s.Ext)
+	}
+	// named not to take one for another.
+	opt := func(name, v string) {
+		if v != "" {
+			io.WriteString(h, "\x00"+name+"="+v)
+		}
+	}
+	opt("dest_ext", cfg.DestExt)
+	opt("vips_stream", cfg.VipsStream)
+	opt("thumb_fmt", cfg.ThumbFmt)
+	opt("animated", cfg.Animated)
+	if cfg.BitDepth != "" {
+		opt("bit_depth", cfg.BitDepth)
+		opt("depth_method", cfg.DepthMethod)
+	}
+	opt("alpha", cfg.Alpha)
+	for _, p := range cfg.Post {
+		opt("post", p)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// cacheKey returns the cache path relative to the cache dir of a source
+// with the hash h.
+func cacheKey(cfg *config, h string) string {
+	return filepath.Join(profileKey(cfg), h[:2], h)
+}
+
+// linkOrCopy hard links src to dest, copying if links are not possible
+// e.g. across file systems.
+func linkOrCopy(src, dest string) error {
+	os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+// reflinkOrCopy copies src to dest sharing blocks where the file system can,
+// e.g. btrfs or xfs, or as a plain copy where it cannot.
+func reflinkOrCopy(src, dest string) error {
+	os.Remove(dest)
+	if err := reflink(src, dest); err == nil {
+		return nil
+	}
+	return copyFile(src, dest)
+}
+
+// fromCache puts the cached output of key at dest if any. entries are
+// copied in and out, not linked, so that an output edited or converted
+// again in place never changes the entry.
+func fromCache(cfg *config, key, dest string) (bool, error) {
+	cached := filepath.Join(cfg.CacheDir, key)
+	if _, err := os.Stat(cached); err != nil {
+		return false, nil
+	}
+	return true, reflinkOrCopy(cached, dest)
+}
+
+// toCache stores the output dest as key.
+func toCache(cfg *config, key, dest string) error {
+	cached := filepath.Join(cfg.CacheDir, key)
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return err
+	}
+	// never leave a partial file as a cache entry.
+	tmp := cached + ".tmp"
+	if err := reflinkOrCopy(dest, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, cached)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// casEntry maps an output to where -layout cas stored it.
+type casEntry struct {
+	Src    string `json:"src"`
+	Dest   string `json:"dest"`   // path without -layout cas
+	Object string `json:"object"` // content addressed path
+	SHA256 string `json:"sha256"`
+	Dup    bool   `json:"dup,omitempty"` // the object was there already
+}
+
+// casPath returns the content addressed path of an output with sha256 sum,
+// e.g. ab/cd/abcd....tif.
+func casPath(cfg *config, sum, ext string) string {
+	return filepath.Join(cfg.DestDir, sum[:2], sum[2:4], sum+ext)
+}
+
+// storeCAS moves r.Dest to its content addressed path, or removes it if an
+// identical output is there, and records the mapping.
+func storeCAS(cfg *config, st *state, r *result) error {
+	sum, err := hashFile(longPath(r.Dest))
+	if err != nil {
+		return err
+	}
+	e := &casEntry{
+		Src:    r.Src,
+		Dest:   r.Dest,
+		Object: casPath(cfg, sum, filepath.Ext(r.Dest)),
+		SHA256: sum,
+	}
+	if err := os.MkdirAll(longPath(filepath.Dir(e.Object)), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(longPath(e.Object)); err == nil {
+		e.Dup = true
+		err = os.Remove(longPath(r.Dest))
+	} else {
+		err = os.Rename(longPath(r.Dest), longPath(e.Object))
+	}
+	if err != nil {
+		return err
+	}
+	r.Dest = e.Object
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.casMap != nil {
+		return st.casMap.Encode(e)
+	}
+	return nil
+}
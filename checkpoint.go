@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// checkpoint records where a stopped run was in the walk of the sources.
+type checkpoint struct {
+	SrcDir string    `json:"src_dir"`
+	Type   string    `json:"type"`
+	Offset int64     `json:"offset"` // files taken from the walk
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// loadCheckpoint makes the run resume from cfg.Checkpoint if it exists.
+func loadCheckpoint(cfg *config, st *state) error {
+	b, err := os.ReadFile(cfg.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return fmt.Errorf("%s: %s", cfg.Checkpoint, err)
+	}
+	if cp.SrcDir != cfg.SrcDir || cp.Type != cfg.Type {
+		return fmt.Errorf("%s is of another run (%s %s)",
+			cfg.Checkpoint, cp.Type, cp.SrcDir)
+	}
+	st.resumeAt = cp.Offset
+	cfg.Log.Write([]byte(fmt.Sprintf(
+		"info: resuming after %d files (stopped by %s at %s)\n",
+		cp.Offset, cp.Reason, cp.Time.Format(time.RFC3339))))
+	return nil
+}
+
+// saveCheckpoint records where the run stopped, or removes the checkpoint
+// if the run has completed.
+func saveCheckpoint(cfg *config, st *state) error {
+	if st.aborted == "" {
+		if err := os.Remove(cfg.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(&checkpoint{
+		SrcDir: cfg.SrcDir,
+		Type:   cfg.Type,
+		Offset: atomic.LoadInt64(&st.walked),
+		Reason: st.aborted,
+		Time:   time.Now(),
+	}, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cfg.Checkpoint, b, 0644); err != nil {
+		return err
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("info: checkpoint saved to %s\n",
+		cfg.Checkpoint)))
+	return nil
+}
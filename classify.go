@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// failure classes, checked in order against stderr and the error message.
+var failureClasses = []struct {
+	class    string
+	patterns []string
+}{
+	{"disk full", []string{"no space left on device", "disk full",
+		"not enough space on the disk", "disk quota exceeded"}},
+	{"timeout", []string{errTimedOut.Error()}},
+	{"unsupported format", []string{"is not a known file format",
+		"not a known file format", "unsupported", "no decode delegate",
+		"no loader", "unknown file format"}},
+	{"source unreadable", []string{"no such file", "permission denied",
+		"unable to open", "unable to read", "read error",
+		"premature end", "truncated", "corrupt", "input/output error"}},
+	{"vips crash", []string{"segmentation fault", "core dumped", "aborted",
+		"bus error", "killed"}},
+}
+
+// errTimedOut is of commands killed after -timeout.
+var errTimedOut = errors.New("timed out after")
+
+// classify tells the likely cause of a failure by err, the stderr and exit
+// status of a failed command, and patterns of their messages. of a
+// command, the command line is not matched, with the file names in it.
+func classify(err error) string {
+	if errors.Is(err, syscall.ENOSPC) {
+		return "disk full"
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+		return "source unreadable"
+	}
+	if errors.Is(err, errTimedOut) {
+		return "timeout"
+	}
+	msg := err.Error()
+	var ce *cmdError
+	var ee *exec.ExitError
+	if errors.As(err, &ce) {
+		msg = ce.stderr
+		if errors.As(err, &ee) {
+			// e.g. "exit status 1" or "signal: killed".
+			msg += "\n" + ee.String()
+		}
+	}
+	msg = strings.ToLower(msg)
+	for _, c := range failureClasses {
+		for _, p := range c.patterns {
+			if strings.Contains(msg, p) {
+				return c.class
+			}
+		}
+	}
+	// killed by a signal, or sh saying so by 128 + the signal.
+	if errors.As(err, &ee) && (ee.ExitCode() < 0 || ee.ExitCode() > 128) {
+		return "vips crash"
+	}
+	return "other"
+}
+
+// classCounts returns the counts of failure classes, most first.
+func (st *state) classCounts() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	classes := make([]string, 0, len(st.classes))
+	for c := range st.classes {
+		classes = append(classes, c)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		ci, cj := st.classes[classes[i]], st.classes[classes[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return classes[i] < classes[j]
+	})
+	var s []string
+	for _, c := range classes {
+		s = append(s, fmt.Sprintf("%s: %d", c, st.classes[c]))
+	}
+	return strings.Join(s, ", ")
+}
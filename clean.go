@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseAge parses a retention period like "90d" or a go duration.
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid age: %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// stale is a destination file clean removes.
+type stale struct {
+	Path   string    `json:"path"`
+	Reason string    `json:"reason"`
+	Size   int64     `json:"size"`
+	MTime  time.Time `json:"mtime"`
+}
+
+// findStale returns the files in cfg.DestDir older than age, but the
+// current outputs in results with their companions, and the outputs of
+// obsolete profiles in results.
+func findStale(cfg *config, results string, age time.Duration,
+	obsolete map[string]bool) ([]*stale, error) {
+	current := map[string]bool{}
+	found := map[string]*stale{}
+	add := func(p, reason string) {
+		fi, err := os.Stat(longPath(p))
+		if err != nil || found[p] != nil {
+			return
+		}
+		found[p] = &stale{p, reason, fi.Size(), fi.ModTime()}
+	}
+	inDest := func(p string) bool {
+		rel, err := filepath.Rel(cfg.DestDir, p)
+		return err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+
+	if results != "" {
+		bySrc, all, err := loadResults(results)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range all {
+			if r.Dest == "" || !obsolete[r.Profile] || !inDest(r.Dest) {
+				continue
+			}
+			for _, p := range partials(r.Dest) {
+				add(p, "profile "+r.Profile)
+			}
+		}
+		for _, r := range bySrc {
+			if r.Dest != "" && r.ok() && !obsolete[r.Profile] {
+				for _, p := range companions(cfg, r) {
+					current[p] = true
+				}
+			}
+		}
+	}
+
+	if age > 0 {
+		before := time.Now().Add(-age)
+		err := filepath.Walk(cfg.DestDir, func(p string, fi os.FileInfo,
+			err error) error {
+			if err != nil {
+				return err
+			}
+			if current[p] && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			// the transliterated names are kept to be reversed.
+			if fi.IsDir() || current[p] || !fi.ModTime().Before(before) ||
+				p == translitPath(cfg) {
+				return nil
+			}
+			add(p, "older than "+before.Format("2006-01-02 15:04"))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ss := make([]*stale, 0, len(found))
+	for _, s := range found {
+		// e.g. a sidecar of an obsolete output named as of a current one.
+		if !current[s.Path] {
+			ss = append(ss, s)
+		}
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].Path < ss[j].Path })
+	return ss, nil
+}
+
+// cleanMain removes stale derivatives from the destination dir.
+func cleanMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	setFlags(fs, cfg)
+	olderThan := fs.String("older-than", "",
+		"remove files older than this, e.g. \"90d\" or \"48h\", "+
+			"but the current outputs in -results")
+	profiles := fs.String("obsolete-profiles", "",
+		"remove outputs of these profiles in -results (comma separated)")
+	report := fs.String("report", "", "write json lines of removed files")
+	fs.Parse(args)
+
+	var age time.Duration
+	if *olderThan != "" {
+		var err error
+		if age, err = parseAge(*olderThan); err != nil {
+			return err
+		}
+	}
+	obsolete := map[string]bool{}
+	for _, p := range strings.Split(*profiles, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			obsolete[p] = true
+		}
+	}
+	if age <= 0 && len(obsolete) == 0 {
+		return errors.New("clean needs -older-than or -obsolete-profiles")
+	}
+	if cfg.Results == "" {
+		// without it, the current outputs are not known to be kept.
+		return errors.New("clean needs -results")
+	}
+
+	ss, err := findStale(cfg, cfg.Results, age, obsolete)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = io.Discard
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	var n, size int64
+	for _, s := range ss {
+		if cfg.DryRun {
+			fmt.Printf("would remove %s (%s)\n", s.Path, s.Reason)
+		} else {
+			if err := os.RemoveAll(longPath(s.Path)); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				continue
+			}
+			fmt.Printf("removed %s (%s)\n", s.Path, s.Reason)
+		}
+		enc.Encode(s)
+		n++
+		size += s.Size
+	}
+	verb := "removed"
+	if cfg.DryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s: %d files, %d bytes\n", verb, n, size)
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// decodeImage decodes the image at path, through a png by vips if go
+// cannot read it, e.g. tiff.
+func decodeImage(cfg *config, path, tmp string) (image.Image, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+	default:
+		png := filepath.Join(tmp, "compare.png")
+		defer os.Remove(png)
+		if _, err := cmdOutput(cfg, formatCmd("vips copy %s %s", path,
+			png)); err != nil {
+			return nil, err
+		}
+		path = png
+	}
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// psnr returns the peak signal to noise ratio of b against a in dB over
+// rgb, +Inf if they are the same.
+func psnr(a, b image.Image) float64 {
+	r := a.Bounds()
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ar, ag, ab, _ := a.At(x, y).RGBA()
+			br, bg, bb, _ := b.At(x-r.Min.X+b.Bounds().Min.X,
+				y-r.Min.Y+b.Bounds().Min.Y).RGBA()
+			for _, d := range []float64{
+				float64(ar>>8) - float64(br>>8),
+				float64(ag>>8) - float64(bg>>8),
+				float64(ab>>8) - float64(bb>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*r.Dx()*r.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+func luma(img image.Image, x, y int) float64 {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+}
+
+// ssim returns the mean structural similarity of the luma of b against a
+// over 8x8 windows.
+func ssim(a, b image.Image) float64 {
+	const w = 8
+	c1, c2 := math.Pow(0.01*255, 2), math.Pow(0.03*255, 2)
+	ra, rb := a.Bounds(), b.Bounds()
+	var total float64
+	n := 0
+	for y := 0; y+w <= ra.Dy(); y += w {
+		for x := 0; x+w <= ra.Dx(); x += w {
+			var sa, sb, saa, sbb, sab float64
+			for j := 0; j < w; j++ {
+				for i := 0; i < w; i++ {
+					va := luma(a, ra.Min.X+x+i, ra.Min.Y+y+j)
+					vb := luma(b, rb.Min.X+x+i, rb.Min.Y+y+j)
+					sa, sb = sa+va, sb+vb
+					saa, sbb, sab = saa+va*va, sbb+vb*vb, sab+va*vb
+				}
+			}
+			k := float64(w * w)
+			ma, mb := sa/k, sb/k
+			va, vb := saa/k-ma*ma, sbb/k-mb*mb
+			cov := sab/k - ma*mb
+			total += (2*ma*mb + c1) * (2*cov + c2) /
+				((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+	return total / float64(n)
+}
+
+// convertSample converts samples with cfg into a temporary dir and returns
+// the outputs by source along with the dir.
+func convertSample(cfg *config, samples []string) (map[string]string, string,
+	error) {
+	dest, err := os.MkdirTemp("", "imconvvips-compare")
+	if err != nil {
+		return nil, "", err
+	}
+	c := *cfg
+	c.DestDir = dest
+	var buf bytes.Buffer
+	st := newState()
+	st.results = json.NewEncoder(&buf)
+	run(&c, st, func(q chan string) error {
+		for _, src := range samples {
+			q <- src
+		}
+		return nil
+	})
+
+	outs := map[string]string{}
+	d := json.NewDecoder(&buf)
+	for d.More() {
+		r := &result{}
+		if err := d.Decode(r); err != nil {
+			return nil, dest, err
+		}
+		if r.ok() && r.Dest != "" {
+			outs[r.Src] = r.Dest
+		}
+	}
+	return outs, dest, nil
+}
+
+// compareMain converts a sample with two profiles and reports how their
+// outputs differ.
+func compareMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	setFlags(fs, cfg)
+	pa := fs.String("from", "", "profile of the current settings "+
+		"(\"\" for top level settings)")
+	pb := fs.String("to", "", "profile of the new settings")
+	n := fs.Int("n", 20, "number of sample files (0 for all)")
+	fs.Parse(args)
+	if *pa == *pb {
+		return errors.New("compare needs two different profiles -from and -to")
+	}
+
+	cfg.Save = false
+	closeLogs, err := setup(cfg)
+	defer closeLogs()
+	if err != nil {
+		return err
+	}
+	profile := func(name string) (*config, error) {
+		if name == "" {
+			return cfg, nil
+		}
+		return cfg.withProfile(name)
+	}
+	ca, err := profile(*pa)
+	if err != nil {
+		return err
+	}
+	cb, err := profile(*pb)
+	if err != nil {
+		return err
+	}
+
+	samples, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+	if *n > 0 && len(samples) > *n {
+		samples = samples[:*n]
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("compare: %d sample files\n",
+		len(samples))))
+
+	outsA, dirA, err := convertSample(ca, samples)
+	defer os.RemoveAll(dirA)
+	if err != nil {
+		return err
+	}
+	outsB, dirB, err := convertSample(cb, samples)
+	defer os.RemoveAll(dirB)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp("", "imconvvips-compare")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var totalA, totalB int64
+	for _, src := range samples {
+		a, b := outsA[src], outsB[src]
+		if a == "" || b == "" {
+			fmt.Printf("%s: not converted by both\n", src)
+			continue
+		}
+		fa, err := os.Stat(longPath(a))
+		if err != nil {
+			return err
+		}
+		fb, err := os.Stat(longPath(b))
+		if err != nil {
+			return err
+		}
+		totalA, totalB = totalA+fa.Size(), totalB+fb.Size()
+		line := fmt.Sprintf("%s: size %d -> %d (%+.1f%%)", src,
+			fa.Size(), fb.Size(), pct(fa.Size(), fb.Size()))
+
+		ia, err := decodeImage(cfg, a, tmp)
+		if err != nil {
+			fmt.Printf("%s, %s\n", line, err)
+			continue
+		}
+		ib, err := decodeImage(cfg, b, tmp)
+		if err != nil {
+			fmt.Printf("%s, %s\n", line, err)
+			continue
+		}
+		da, db := ia.Bounds().Size(), ib.Bounds().Size()
+		if da != db {
+			fmt.Printf("%s, dimensions %dx%d -> %dx%d\n", line,
+				da.X, da.Y, db.X, db.Y)
+			continue
+		}
+		fmt.Printf("%s, %dx%d, psnr %.2f dB, ssim %.4f\n", line, da.X, da.Y,
+			psnr(ia, ib), ssim(ia, ib))
+	}
+	fmt.Printf("total size: %d -> %d (%+.1f%%)\n", totalA, totalB,
+		pct(totalA, totalB))
+	return nil
+}
+
+func pct(a, b int64) float64 {
+	if a == 0 {
+		return 0
+	}
+	return float64(b-a) / float64(a) * 100
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var subcommands = []string{"bench", "ctl", "report", "version",
+	"self-update", "completion", "init", "plan", "list", "clean",
+	"promote", "compare", "serve", "snapshot", "ingest", "replay"}
+
+// flagValues returns the values completed for the option name.
+func flagValues(cfg *config, name string) []string {
+	switch name {
+	case "engine":
+		return []string{"vips", "libvips", "imagemagick", "graphicsmagick",
+			"gpu", "thumbnail", "steps"}
+	case "profile":
+		var ps []string
+		for p := range cfg.Profiles {
+			ps = append(ps, p)
+		}
+		sort.Strings(ps)
+		return ps
+	case "type":
+		return []string{"files", "filelist"}
+	case "normalize":
+		return []string{"nfc", "none"}
+	case "transliterate":
+		return []string{"latin", "de", "da", "ja"}
+	case "animated":
+		return []string{"first", "pages", "skip"}
+	case "bit-depth":
+		return []string{"keep", "8"}
+	case "depth-method":
+		return []string{"shift", "scale", "colourspace"}
+	case "alpha":
+		return []string{"keep", "flatten:#ffffff", "error"}
+	case "vips-check":
+		return []string{"warn", "fail", "off"}
+	case "collisions":
+		return []string{"warn", "fail", "off"}
+	case "vips-stream":
+		return []string{"in", "out", "both"}
+	case "zip":
+		return []string{"deflate", "store"}
+	case "layout":
+		return []string{"pairtree", "hash:2", "cas"}
+	case "log-sink":
+		return []string{"syslog", "journald"}
+	case "pass-through-by":
+		return []string{"link", "reflink", "copy"}
+	case "premis":
+		return []string{"xml", "json"}
+	case "sample-strategy":
+		return []string{"random", "stratified"}
+	}
+	return nil
+}
+
+// dirFlags are options taking a directory.
+var dirFlags = map[string]bool{"s": true, "d": true, "b": true,
+	"tmp-dir": true, "sample-dir": true, "cache-dir": true,
+	"debug-bundle": true}
+
+// completionFlags returns the options of the main command.
+func completionFlags(cfg *config) []*flag.Flag {
+	c := *cfg
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	setFlags(fs, &c)
+	var flags []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, f)
+	})
+	return flags
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// completionMain writes a completion script for the shell given.
+func completionMain(cfg *config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: completion bash|zsh|fish")
+	}
+	flags := completionFlags(cfg)
+	switch args[0] {
+	case "bash":
+		bashCompletion(os.Stdout, cfg, flags)
+	case "zsh":
+		zshCompletion(os.Stdout, cfg, flags)
+	case "fish":
+		fishCompletion(os.Stdout, cfg, flags)
+	default:
+		return fmt.Errorf("unknown shell: %s", args[0])
+	}
+	return nil
+}
+
+func bashCompletion(w io.Writer, cfg *config, flags []*flag.Flag) {
+	var names []string
+	for _, f := range flags {
+		names = append(names, "-"+f.Name)
+	}
+	fmt.Fprintf(w, `_imconvvips() {
+	local cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}
+	if [ "$COMP_CWORD" -eq 1 ] && [[ $cur != -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case ${COMP_WORDS[1]} in
+	ctl)
+		[[ $cur != -* ]] &&
+			COMPREPLY=($(compgen -W "pause resume drain status priority" -- "$cur")) &&
+			return ;;
+	report)
+		[ "$COMP_CWORD" -eq 2 ] && COMPREPLY=($(compgen -W "diff" -- "$cur")) &&
+			return ;;
+	completion) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")); return ;;
+	esac
+	case $prev in
+`, strings.Join(subcommands, " "))
+	for _, f := range flags {
+		if vs := flagValues(cfg, f.Name); vs != nil {
+			fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n",
+				f.Name, strings.Join(vs, " "))
+		} else if dirFlags[f.Name] {
+			fmt.Fprintf(w, "\t-%s) COMPREPLY=($(compgen -d -- \"$cur\")); return ;;\n",
+				f.Name)
+		}
+	}
+	fmt.Fprintf(w, `	esac
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -F _imconvvips imconvvips
+`, strings.Join(names, " "))
+}
+
+// zshQuote escapes s for the description of an _arguments spec.
+func zshQuote(s string) string {
+	s = strings.NewReplacer("[", "\\[", "]", "\\]", ":", "\\:").Replace(s)
+	return strings.ReplaceAll(s, "'", `'\''`)
+}
+
+func zshCompletion(w io.Writer, cfg *config, flags []*flag.Flag) {
+	fmt.Fprintf(w, "#compdef imconvvips\n\n_imconvvips() {\n")
+	fmt.Fprintf(w, "\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then\n"+
+		"\t\t_values command %s\n\t\treturn\n\tfi\n", strings.Join(subcommands, " "))
+	fmt.Fprintf(w, "\tcase $words[2] in\n"+
+		"\tctl) _values command pause resume drain status priority; return ;;\n"+
+		"\treport) _values command diff; return ;;\n"+
+		"\tcompletion) _values shell bash zsh fish; return ;;\n"+
+		"\tesac\n")
+	fmt.Fprintf(w, "\t_arguments \\\n")
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.Name,
+			zshQuote(strings.SplitN(f.Usage, "\n", 2)[0]))
+		vs := flagValues(cfg, f.Name)
+		switch {
+		case isBoolFlag(f):
+		case vs != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(vs, " "))
+		case dirFlags[f.Name]:
+			spec += fmt.Sprintf(":%s:_files -/", f.Name)
+		default:
+			spec += fmt.Sprintf(":%s:_files", f.Name)
+		}
+		fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintf(w, "\t\t'*:file:_files'\n}\n\n_imconvvips \"$@\"\n")
+}
+
+func fishCompletion(w io.Writer, cfg *config, flags []*flag.Flag) {
+	fmt.Fprintf(w, "complete -c imconvvips -n __fish_use_subcommand -f -a %q\n",
+		strings.Join(subcommands, " "))
+	for _, sub := range [][2]string{
+		{"ctl", "pause resume drain status priority"},
+		{"report", "diff"},
+		{"completion", "bash zsh fish"},
+	} {
+		fmt.Fprintf(w, "complete -c imconvvips "+
+			"-n '__fish_seen_subcommand_from %s' -f -a '%s'\n", sub[0], sub[1])
+	}
+	for _, f := range flags {
+		desc := strings.ReplaceAll(strings.SplitN(f.Usage, "\n", 2)[0], "'", `\'`)
+		line := fmt.Sprintf("complete -c imconvvips -o %s -d '%s'", f.Name, desc)
+		vs := flagValues(cfg, f.Name)
+		switch {
+		case isBoolFlag(f):
+		case vs != nil:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(vs, " "))
+		case dirFlags[f.Name]:
+			line += " -x -a '(__fish_complete_directories)'"
+		default:
+			line += " -r"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
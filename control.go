@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// control executes a control command of actor on the running job.
+func control(cfg *config, st *state, line, actor string) (reply string,
+	err error) {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return "", errors.New("no command")
+	}
+	cmd := args[0]
+	if cmd != "status" {
+		defer func() {
+			target := strings.TrimSpace(strings.TrimPrefix(
+				strings.TrimSpace(line), cmd))
+			cfg.audit.record(actor, cmd, target, err)
+		}()
+	}
+	// logged as done, cmd recorded as the action as it is.
+	msg := cmd
+	switch cmd {
+	case "pause":
+		st.setPaused(true)
+	case "resume":
+		st.setPaused(false)
+	case "drain":
+		// stop queuing but let workers finish their current files.
+		st.abort("drained")
+	case "priority":
+		// the rest of the line is a file relative to the source dir as in
+		// filelists.
+		f := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), cmd))
+		if f == "" {
+			return "", errors.New("priority needs a file")
+		}
+		st.prioritize(filepath.Join(cfg.SrcDir, f))
+		msg = "priority: " + f
+	case "status":
+		b, err := json.Marshal(st.status())
+		return string(b), err
+	case "reload":
+		// logged by reload.
+		if err := reload(cfg, st); err != nil {
+			return "", err
+		}
+		return "ok", nil
+	default:
+		return "", fmt.Errorf("unknown command: %q", cmd)
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("info: %s\n", msg)))
+	return "ok", nil
+}
+
+// serveControl accepts line based control commands on the unix socket
+// cfg.ControlSock.
+func serveControl(cfg *config, st *state) error {
+	os.Remove(cfg.ControlSock)
+	l, err := net.Listen("unix", cfg.ControlSock)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			actor := peerActor(conn)
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				reply, err := control(cfg, st, strings.TrimSpace(scanner.Text()),
+					actor)
+				if err != nil {
+					reply = "error: " + err.Error()
+				}
+				fmt.Fprintln(conn, reply)
+			}
+		}(conn)
+	}
+}
+
+// loadPriority queues files listed in the filelist path as priority files.
+func loadPriority(cfg *config, st *state, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			st.prioritize(filepath.Join(cfg.SrcDir, line))
+		}
+	}
+	return scanner.Err()
+}
+
+// ctlMain sends a control command to a running imconvvips.
+func ctlMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	fs.StringVar(&cfg.ControlSock, "control", cfg.ControlSock,
+		"control socket of the running process")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [options] "+
+			"pause|resume|drain|status|reload|priority FILE\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if cfg.ControlSock == "" {
+		return errors.New("no control socket given")
+	}
+
+	conn, err := net.Dial("unix", cfg.ControlSock)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, strings.Join(fs.Args(), " "))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fmt.Print(reply)
+	if strings.HasPrefix(reply, "error: ") {
+		os.Exit(1)
+	}
+	return nil
+}
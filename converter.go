@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// worker holds per worker settings for spawning converters.
+type worker struct {
+	id     int
+	cpuset string
+	gpu    string
+	// converters of profiles chosen by rules.
+	profiles map[string]*branch
+}
+
+// converter converts src into dest.
+type converter interface {
+	Name() string
+	// Command describes what Convert does for the record.
+	Command(src, dest string) string
+	Convert(w *worker, src, dest string) error
+}
+
+// newConverter returns the converter for engine.
+func newConverter(cfg *config, engine string) (converter, error) {
+	switch engine {
+	case "vips":
+		return &cmdConverter{cfg: cfg, name: engine, format: cfg.VipsFmt,
+			stream: cfg.VipsStream}, nil
+	case "imagemagick":
+		return &cmdConverter{cfg: cfg, name: engine, format: cfg.IMFmt}, nil
+	case "graphicsmagick":
+		return &cmdConverter{cfg: cfg, name: engine, format: cfg.GMFmt}, nil
+	case "gpu":
+		if cfg.GPUFmt == "" {
+			return nil, errors.New("gpu engine needs gpu_fmt")
+		}
+		return &cmdConverter{cfg: cfg, name: engine, format: cfg.GPUFmt}, nil
+	case "thumbnail":
+		// vipsthumbnail takes relative outputs as in the dir of the source.
+		return &cmdConverter{cfg: cfg, name: engine, format: cfg.ThumbFmt,
+			absDest: true}, nil
+	case "libvips":
+		return newNativeConverter(cfg)
+	case "steps":
+		if len(cfg.Steps) == 0 {
+			return nil, errors.New("steps engine needs steps")
+		}
+		return &stepsConverter{cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown engine: %s", engine)
+}
+
+// converters returns the primary converter followed by fallbacks.
+func converters(cfg *config) ([]converter, error) {
+	engines := []string{cfg.Engine}
+	for _, e := range strings.Split(cfg.Fallback, ",") {
+		if e = strings.TrimSpace(e); e != "" && e != "none" {
+			engines = append(engines, e)
+		}
+	}
+	// not every operation or image is supported by gpu tools.
+	if cfg.Engine == "gpu" && cfg.Fallback == "" {
+		engines = append(engines, "vips")
+	}
+	var convs []converter
+	for _, e := range engines {
+		c, err := newConverter(cfg, e)
+		if err != nil {
+			return nil, err
+		}
+		convs = append(convs, c)
+	}
+	return convs, nil
+}
+
+// convert tries convs in order until one succeeds and logs which engine
+// converted src if it was not the primary one. it returns the last
+// converter tried. the frames of src are taken by frames of -animated.
+func convert(cfg *config, convs []converter, w *worker, src, dest,
+	frames string) (converter, error) {
+	var err error
+	for i, c := range convs {
+		if i > 0 {
+			cfg.Log.Write([]byte(fmt.Sprintf(
+				"warning: %s\n  retrying with %s\n", err, c.Name())))
+		}
+		in := src + framesSuffix(c.Name(), frames)
+		if err = c.Convert(w, in, dest); err == nil {
+			if i > 0 {
+				cfg.Log.Write([]byte(fmt.Sprintf("ok (%s): %s\n", c.Name(), src)))
+			}
+			return c, nil
+		}
+	}
+	return convs[len(convs)-1], err
+}
+
+// cpuSets splits cfg.CPUSet into per-worker cpu lists.
+// e.g. "0-7/8-15" -> ["0-7", "8-15"]
+func cpuSets(cfg *config) []string {
+	var sets []string
+	for _, s := range strings.Split(cfg.CPUSet, "/") {
+		if s = strings.TrimSpace(s); s != "" {
+			sets = append(sets, s)
+		}
+	}
+	return sets
+}
+
+// gpuDevices splits cfg.GPUs into device ids assigned to workers.
+// e.g. "0,1" -> ["0", "1"]
+func gpuDevices(cfg *config) []string {
+	var ds []string
+	for _, d := range strings.Split(cfg.GPUs, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// cmdConverter runs a shell command built from a format for fmt.Sprintf
+// with two args (src filename, dest filename). the filenames are quoted for
+// sh, and %s quoted by the format, e.g. "%s", is taken as %s.
+type cmdConverter struct {
+	cfg     *config
+	name    string
+	format  string
+	stream  string // -vips-stream
+	absDest bool
+}
+
+// childVars returns the variables set for converter processes of w but the
+// temporary dirs.
+func childVars(cfg *config, w *worker) []string {
+	var env []string
+	if cfg.VipsConcurrency > 0 {
+		env = append(env, fmt.Sprintf("VIPS_CONCURRENCY=%d", cfg.VipsConcurrency))
+	}
+	if cfg.VipsDiscThreshold != "" {
+		env = append(env, "VIPS_DISC_THRESHOLD="+cfg.VipsDiscThreshold)
+	}
+	if w.gpu != "" {
+		env = append(env, "CUDA_VISIBLE_DEVICES="+w.gpu)
+	}
+	return env
+}
+
+// baseEnv returns the environment converter processes start from, the
+// whole environment or only the variables of cfg.EnvPass with
+// -isolate-env, and cfg.Env.
+func baseEnv(cfg *config) []string {
+	if !cfg.IsolateEnv {
+		return append(os.Environ(), cfg.Env...)
+	}
+	var env []string
+	for _, k := range strings.Split(cfg.EnvPass, ",") {
+		if k = strings.TrimSpace(k); k == "" {
+			continue
+		}
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return append(env, cfg.Env...)
+}
+
+// childEnv returns the environment for converter processes of w.
+func childEnv(cfg *config, w *worker) []string {
+	env := append(baseEnv(cfg), childVars(cfg, w)...)
+	if cfg.tmp != nil {
+		// vips and others write their temporary files there.
+		env = append(env, "TMPDIR="+cfg.tmp.dir, "TMP="+cfg.tmp.dir,
+			"TEMP="+cfg.tmp.dir)
+	}
+	return env
+}
+
+func (c *cmdConverter) Name() string {
+	return c.name
+}
+
+func (c *cmdConverter) Command(src, dest string) string {
+	src, dest = streamArgs(c.stream, src, dest)
+	if c.absDest {
+		if d, err := filepath.Abs(dest); err == nil {
+			dest = d
+		}
+	}
+	return formatCmd(c.format, src, dest)
+}
+
+func (c *cmdConverter) Convert(w *worker, src, dest string) error {
+	if c.stream != "" {
+		return runStream(c.cfg, w, c.Command(src, dest), src, dest)
+	}
+	return runCmd(c.cfg, w, c.Command(src, dest))
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const sampleInterval = 5 * time.Second
+
+// status is a snapshot of a run for the dashboard.
+type status struct {
+	Started   time.Time      `json:"started"`
+	Converted int64          `json:"converted"`
+	Failed    int64          `json:"failed"`
+	Skipped   int64          `json:"skipped"`
+	Paused    bool           `json:"paused"`
+	Aborted   string         `json:"aborted,omitempty"`
+	Tags      tags           `json:"tags,omitempty"`
+	Workers   []workerStatus `json:"workers"`
+	Failures  []failure      `json:"failures"`
+	History   []int64        `json:"history"`
+}
+
+type workerStatus struct {
+	ID int `json:"id"`
+	progress
+}
+
+func (st *state) status() *status {
+	s := &status{
+		Converted: atomic.LoadInt64(&st.converted),
+		Failed:    atomic.LoadInt64(&st.failed),
+		Skipped:   atomic.LoadInt64(&st.skipped),
+	}
+	if st.stopped() {
+		s.Aborted = st.aborted
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s.Started = st.started
+	s.Paused = st.paused
+	for id, p := range st.current {
+		s.Workers = append(s.Workers, workerStatus{id, *p})
+	}
+	sort.Slice(s.Workers, func(i, j int) bool {
+		return s.Workers[i].ID < s.Workers[j].ID
+	})
+	s.Failures = append(s.Failures, st.failures...)
+	s.History = append(s.History, st.history...)
+	s.Tags = st.tags
+	return s
+}
+
+// graph returns svg polyline points of files converted per interval.
+func (s *status) graph(w, h int) string {
+	if len(s.History) < 2 {
+		return ""
+	}
+	rates := make([]int64, len(s.History)-1)
+	max := int64(1)
+	for i := range rates {
+		rates[i] = s.History[i+1] - s.History[i]
+		if rates[i] > max {
+			max = rates[i]
+		}
+	}
+	var pts []string
+	for i, r := range rates {
+		x := w * i / maxHistory
+		y := h - int(int64(h)*r/max)
+		pts = append(pts, fmt.Sprintf("%d,%d", x, y))
+	}
+	return strings.Join(pts, " ")
+}
+
+var dashboardTmpl = template.Must(template.New("dashboard").Funcs(
+	template.FuncMap{
+		"since": func(t time.Time) string {
+			return time.Since(t).Round(time.Second).String()
+		},
+	}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>imconvvips</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+svg { border: 1px solid #ccc; }
+</style>
+</head>
+<body>
+<h1>imconvvips</h1>
+{{with .S.Tags}}<p>tags: {{.String}}</p>{{end}}
+<p>
+running {{since .S.Started}}
+{{if .S.Aborted}}(aborted: {{.S.Aborted}}){{else if .S.Paused}}(paused){{end}}
+&mdash; converted {{.S.Converted}}, failed {{.S.Failed}}, skipped {{.S.Skipped}}
+</p>
+<form method="post">
+{{if .S.Paused}}<button formaction="resume{{.Query}}">resume</button>
+{{else}}<button formaction="pause{{.Query}}">pause</button>{{end}}
+{{if not .S.Aborted}}<button formaction="drain{{.Query}}">drain</button>{{end}}
+<button formaction="reload{{.Query}}">reload</button>
+</form>
+
+<h2>throughput</h2>
+<p>files per {{.Interval}}</p>
+<svg width="600" height="100"><polyline fill="none" stroke="#36c" points="{{.Graph}}"/></svg>
+
+<h2>workers</h2>
+<table>
+<tr><th>#</th><th>file</th><th>elapsed</th></tr>
+{{range .S.Workers}}<tr><td>{{.ID}}</td><td>{{.Src}}</td><td>{{since .Since}}</td></tr>
+{{else}}<tr><td colspan="3">idle</td></tr>
+{{end}}</table>
+
+<h2>recent failures</h2>
+<table>
+<tr><th>time</th><th>file</th><th>class</th><th>error</th></tr>
+{{range .S.Failures}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Src}}</td><td>{{.Class}}</td><td><pre>{{.Err}}</pre></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveDashboard serves the run monitoring page on cfg.HTTPAddr.
+func serveDashboard(cfg *config, st *state) error {
+	go st.sample(sampleInterval)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		s := st.status()
+		// the token of the page for its buttons.
+		var q string
+		if t := r.URL.Query().Get("token"); t != "" {
+			q = "?token=" + url.QueryEscape(t)
+		}
+		err := dashboardTmpl.Execute(w, map[string]interface{}{
+			"S":        s,
+			"Graph":    s.graph(600, 100),
+			"Interval": sampleInterval,
+			"Query":    template.URL(q),
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st.status())
+	})
+	for _, cmd := range []string{"pause", "resume", "drain", "reload"} {
+		cmd := cmd
+		mux.HandleFunc("/"+cmd, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if _, err := control(cfg, st, cmd, httpActor(r)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// with the token of the page.
+			u := url.URL{Path: "/", RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, u.String(), http.StatusSeeOther)
+		})
+	}
+
+	// POST /priority with files relative to the source dir, one per line.
+	mux.HandleFunc("/priority", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := 0
+		for _, f := range strings.Split(string(b), "\n") {
+			if strings.TrimSpace(f) == "" {
+				continue
+			}
+			if _, err := control(cfg, st, "priority "+f,
+				httpActor(r)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			n++
+		}
+		fmt.Fprintf(w, "ok: %d files\n", n)
+	})
+
+	addr := dashboardAddr(cfg.HTTPAddr)
+	if cfg.HTTPToken == "" && !loopback(addr) {
+		cfg.Log.Write([]byte(fmt.Sprintf("warning: dashboard on %s "+
+			"without -http-token, anyone reaching it controls the run\n",
+			addr)))
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("info: dashboard on %s\n", addr)))
+	return listenAndServe(cfg, addr, dashboardAuth(cfg, addr, mux))
+}
+
+// dashboardAddr returns the address to serve the dashboard on, localhost
+// unless a host is given, e.g. "0.0.0.0:8080" for all.
+func dashboardAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
+}
+
+// loopback reports whether the host of addr is of the machine only.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dashboardAuth guards the dashboard served on addr. requests need
+// cfg.HTTPToken if set, as "Authorization: Bearer TOKEN" or "?token=TOKEN",
+// and posts need to come from the dashboard itself, not from other pages
+// open in a browser. on localhost without a token, requests need to be for
+// localhost, not for names of other sites resolving to it.
+func dashboardAuth(cfg *config, addr string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := cfg.HTTPToken; t != "" {
+			got := r.URL.Query().Get("token")
+			if a := r.Header.Get("Authorization"); strings.HasPrefix(a,
+				"Bearer ") {
+				got = strings.TrimPrefix(a, "Bearer ")
+			}
+			if subtle.ConstantTimeCompare([]byte(got), []byte(t)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="imconvvips"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		} else if loopback(addr) && !loopback(hostPort(r.Host)) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPost && !sameOrigin(r) {
+			cfg.audit.record(httpActor(r), strings.TrimPrefix(r.URL.Path, "/"),
+				"", errors.New("cross-origin request"))
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hostPort returns the host of a Host header with a port for loopback.
+func hostPort(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "80")
+}
+
+// sameOrigin reports whether r comes from a page of the server itself, by
+// its Origin or the Sec-Fetch-Site of browsers. clients not browsers send
+// neither.
+func sameOrigin(r *http.Request) bool {
+	if o := r.Header.Get("Origin"); o != "" {
+		u, err := url.Parse(o)
+		return err == nil && u.Host == r.Host
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// depthMethods are the vips commands of -depth-method scaling a source to
+// 8 bits a sample: "shift" drops the low bits of the full range, "scale"
+// stretches the range used, e.g. 12 bits of a 16 bit scan, to 0-255, and
+// "colourspace" goes by the interpretation, e.g. rgb16 to srgb.
+var depthMethods = map[string]string{
+	"shift":       "vips cast %s %s uchar --shift",
+	"scale":       "vips scale %s %s",
+	"colourspace": "vips colourspace %s %s %s",
+}
+
+// eightBitExts are the extensions of outputs of 8 bits a sample at most.
+var eightBitExts = []string{".jpg", ".jpeg", ".webp", ".gif"}
+
+// highDepth reports whether src has more than 8 bits a sample, returning
+// its interpretation as well.
+func highDepth(cfg *config, src string) (bool, string, error) {
+	props, err := probe(cfg, src)
+	if err != nil {
+		return false, "", err
+	}
+	switch props["format"] {
+	case "", "uchar", "char":
+		return false, props["interpretation"], nil
+	}
+	return true, props["interpretation"], nil
+}
+
+// fitter makes src, with the load options of -animated, fit an option for
+// dest before converting. it returns the file it made in the scratch dir
+// and the command making it, for the caller to convert and remove, or ""
+// to convert src as it is. errors are of the source, not named.
+type fitter func(cfg *config, w *worker, src, load, dest string) (string,
+	string, error)
+
+// fitters are applied in order, bits before alpha to flatten on 8 bits.
+var fitters = []fitter{fitDepth, fitAlpha}
+
+// fitSource makes src, with its frames taken by the policy frames, fit for
+// dest by fitters. it returns the file to convert, the commands making it
+// and the function removing what they made.
+func fitSource(cfg *config, w *worker, src, frames, dest string) (string,
+	[]string, func(), error) {
+	in, pre, made := src, []string(nil), []string(nil)
+	clean := func() {
+		for _, d := range made {
+			os.Remove(longPath(d))
+		}
+	}
+	for _, fit := range fitters {
+		d, cmd, err := fit(cfg, w, in, framesSuffix("vips", frames), dest)
+		if err != nil {
+			// named after the source, not what is made of it.
+			return "", pre, clean, fmt.Errorf("%s: %s", src, err)
+		}
+		if cmd != "" {
+			// a tiff of the pages taken, read by the same options.
+			in = d
+			made = append(made, d)
+			pre = append(pre, cmd)
+		}
+	}
+	return in, pre, clean, nil
+}
+
+// fitCmd runs the vips command format f of src with load options into a
+// tiff every engine reads in the scratch dir, named after dest with ext.
+// args follow the input and the output.
+func fitCmd(cfg *config, w *worker, src, load, dest, ext, f string,
+	args ...interface{}) (string, string, error) {
+	tmp := trimExt(dest) + ext
+	if cfg.tmp != nil {
+		tmp = cfg.tmp.path(tmp)
+	}
+	s := fmt.Sprintf(f, append([]interface{}{shellQuote(src + load),
+		shellQuote(tmp)}, args...)...)
+	if err := runCmd(cfg, w, s); err != nil {
+		os.Remove(longPath(tmp))
+		return "", "", err
+	}
+	return tmp, s, nil
+}
+
+// fitDepth applies cfg.BitDepth. with "8", a source of more bits a sample
+// is scaled by cfg.DepthMethod. with "keep", it fails for an output of 8
+// bits.
+func fitDepth(cfg *config, w *worker, src, load, dest string) (string,
+	string, error) {
+	if cfg.BitDepth == "" {
+		return "", "", nil
+	}
+	high, interp, err := highDepth(cfg, src)
+	if err != nil || !high {
+		return "", "", err
+	}
+	if cfg.BitDepth == "keep" {
+		if hasExt(dest, eightBitExts) {
+			return "", "", fmt.Errorf("has more than 8 bits a sample, which %s "+
+				"can not keep", filepath.Ext(dest))
+		}
+		return "", "", nil
+	}
+	if cfg.DepthMethod == "colourspace" {
+		space := "srgb"
+		if strings.HasPrefix(interp, "grey") || interp == "b-w" {
+			space = "b-w"
+		}
+		return fitCmd(cfg, w, src, load, dest, ".depth8.tif",
+			depthMethods[cfg.DepthMethod], space)
+	}
+	return fitCmd(cfg, w, src, load, dest, ".depth8.tif",
+		depthMethods[cfg.DepthMethod])
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// rewrite is a sed style substitution, e.g. s|raw/(\d+)/|items/$1/images/|
+type rewrite struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+func parseRewrite(s string) (*rewrite, error) {
+	if len(s) < 4 || s[0] != 's' {
+		return nil, fmt.Errorf("rewrite must be s/regexp/replacement/: %q", s)
+	}
+	parts := strings.Split(s[2:], s[1:2])
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, fmt.Errorf("rewrite must be s/regexp/replacement/: %q", s)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &rewrite{re, parts[1]}, nil
+}
+
+// rewritesFlag is a flag.Value collecting repeated -rewrite options.
+type rewritesFlag []string
+
+func (r *rewritesFlag) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *rewritesFlag) Set(s string) error {
+	if _, err := parseRewrite(s); err != nil {
+		return err
+	}
+	*r = append(*r, s)
+	return nil
+}
+
+// parseIDRegex compiles s, which needs named groups, e.g.
+// ^(?P<shelfmark>[^/]+)/(?P<page>\d+)\.
+func parseIDRegex(s string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range re.SubexpNames() {
+		if n != "" {
+			return re, nil
+		}
+	}
+	return nil, fmt.Errorf("id regex has no named groups: %q", s)
+}
+
+// identify returns the named groups of cfg.idRe matched against the slash
+// separated path of src relative to the source dir, or nil.
+func identify(cfg *config, src string) map[string]string {
+	if cfg.idRe == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(cfg.SrcDir, src)
+	if err != nil {
+		return nil
+	}
+	m := cfg.idRe.FindStringSubmatch(filepath.ToSlash(rel))
+	if m == nil {
+		return nil
+	}
+	ids := map[string]string{}
+	for i, n := range cfg.idRe.SubexpNames() {
+		if n != "" {
+			ids[n] = m[i]
+		}
+	}
+	return ids
+}
+
+// destPath returns the destination of src.
+func destPath(cfg *config, st *state, src string) (string, error) {
+	rel, err := filepath.Rel(cfg.SrcDir, src)
+	if err != nil {
+		return "", err
+	}
+
+	// rewrites apply to slash separated, normalized relative paths.
+	rel = normalizeName(cfg, filepath.ToSlash(rel))
+	srcRel := rel
+	if cfg.destTmpl != nil {
+		if rel, err = templateName(cfg, st, src, rel); err != nil {
+			return "", err
+		}
+	}
+	for _, rw := range cfg.rewrites {
+		rel = rw.re.ReplaceAllString(rel, rw.repl)
+	}
+	if cfg.Renumber && cfg.destTmpl == nil {
+		rel = seqName(cfg, st, src, rel)
+	}
+	if cfg.Flatten {
+		rel = st.flatName(strings.Replace(rel, "/", "_", -1))
+	}
+	if dir, err := layoutDir(cfg, src, srcRel); err != nil {
+		return "", err
+	} else if dir != "" {
+		rel = dir + "/" + rel
+	}
+
+	dest := filepath.Join(cfg.DestDir, filepath.FromSlash(rel))
+	// an extension given by the template is kept.
+	if cfg.DestExt != "" && (cfg.destTmpl == nil || path.Ext(rel) == "") {
+		dest = withExt(dest, cfg.DestExt)
+	}
+	if cfg.Transliterate != "" {
+		rel, err := filepath.Rel(cfg.DestDir, dest)
+		if err != nil {
+			return "", err
+		}
+		if rel, err = transliterateDest(cfg, st,
+			filepath.ToSlash(rel)); err != nil {
+			return "", err
+		}
+		dest = filepath.Join(cfg.DestDir, filepath.FromSlash(rel))
+	}
+	return dest, nil
+}
+
+// flatName returns name, or name with a sequence number if it has already
+// been used in the run.
+func (st *state) flatName(name string) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.flatNames == nil {
+		st.flatNames = map[string]int{}
+	}
+	n := st.flatNames[name]
+	st.flatNames[name] = n + 1
+	if n == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n+1, ext)
+}
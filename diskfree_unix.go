@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// diskFree returns bytes available to unprivileged users on the file system
+// of path.
+func diskFree(path string) (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, err
+	}
+	return int64(uint64(fs.Bavail) * uint64(fs.Bsize)), nil
+}
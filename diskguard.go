@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const diskCheckInterval = 10 * time.Second
+
+// existingDir returns dir or its nearest existing parent.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// guardDisk pauses the run while free space of the destination file system
+// is below cfg.MinFree and resumes it when space is available again.
+func guardDisk(cfg *config, st *state, min int64) {
+	paused := false
+	t := time.NewTicker(diskCheckInterval)
+	defer t.Stop()
+	for {
+		free, err := diskFree(existingDir(cfg.DestDir))
+		if err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: disk free: %s\n", err)))
+			return
+		}
+		switch {
+		case free < min && !paused:
+			cfg.Log.Write([]byte(fmt.Sprintf(
+				"alert: %d MiB free on %s, below %d MiB: pausing\n",
+				free>>20, cfg.DestDir, min>>20)))
+			st.setPaused(true)
+			cfg.audit.record("min-free", "pause", "", nil)
+			paused = true
+		case free >= min && paused:
+			cfg.Log.Write([]byte(fmt.Sprintf(
+				"info: %d MiB free on %s: resuming\n", free>>20, cfg.DestDir)))
+			st.setPaused(false)
+			cfg.audit.record("min-free", "resume", "", nil)
+			paused = false
+		}
+
+		select {
+		case <-t.C:
+		case <-st.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// detectEncoding guesses the encoding of filelist content b: UTF-16 by BOM
+// or NULs as Excel exports it, UTF-8, or else Shift_JIS as Japanese Windows
+// writes it.
+func detectEncoding(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	}
+	// ascii in UTF-16 has a NUL in every other byte.
+	if len(b) >= 2 {
+		even, odd := 0, 0
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 {
+				even++
+			}
+			if b[i+1] == 0 {
+				odd++
+			}
+		}
+		if n := len(b) / 2; odd > n/4 && even == 0 {
+			return "utf-16le"
+		} else if even > n/4 && odd == 0 {
+			return "utf-16be"
+		}
+	}
+	if utf8.Valid(b) {
+		return "utf-8"
+	}
+	return "shift_jis"
+}
+
+func decodeUTF16(b []byte, order binary.ByteOrder) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[2*i:])
+	}
+	s := string(utf16.Decode(u))
+	return strings.TrimPrefix(s, "\ufeff")
+}
+
+// decodeShiftJIS decodes b as CP932, Shift_JIS with the vendor extensions
+// Windows uses, by cp932Table, as the standard library has no Shift_JIS.
+func decodeShiftJIS(b []byte) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < 0x80:
+			sb.WriteByte(c)
+			continue
+		case 0xa1 <= c && c <= 0xdf:
+			// half-width katakana.
+			sb.WriteRune(0xff61 + rune(c-0xa1))
+			continue
+		}
+		var r rune
+		if lead := cp932Lead(c); lead >= 0 && i+1 < len(b) &&
+			0x40 <= b[i+1] && b[i+1] <= 0xfc {
+			r = rune(cp932Table[lead*189+int(b[i+1]-0x40)])
+		}
+		if r == 0 {
+			return "", fmt.Errorf("invalid Shift_JIS at byte %d", i)
+		}
+		sb.WriteRune(r)
+		i++
+	}
+	return sb.String(), nil
+}
+
+// cp932Lead returns the index of the lead byte c in cp932Table, or -1.
+func cp932Lead(c byte) int {
+	switch {
+	case 0x81 <= c && c <= 0x9f:
+		return int(c - 0x81)
+	case 0xe0 <= c && c <= 0xfc:
+		return int(c-0xe0) + 0x9f - 0x81 + 1
+	}
+	return -1
+}
+
+// readList returns the lines of the filelist path decoded from
+// cfg.FilelistEncoding. any of CRLF, LF and CR ends a line.
+func readList(cfg *config, path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	enc := cfg.FilelistEncoding
+	if enc == "auto" {
+		enc = detectEncoding(b)
+		if enc != "utf-8" {
+			cfg.Log.Write([]byte(fmt.Sprintf("info: %s: read as %s\n", path, enc)))
+		}
+	}
+
+	var s string
+	switch enc {
+	case "utf-8":
+		s = strings.TrimPrefix(string(b), "\ufeff")
+	case "utf-16le":
+		s = decodeUTF16(b, binary.LittleEndian)
+	case "utf-16be":
+		s = decodeUTF16(b, binary.BigEndian)
+	case "shift_jis":
+		if s, err = decodeShiftJIS(b); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown filelist encoding: %s", enc)
+	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = strings.Replace(s, "\r", "\n", -1)
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n"), nil
+}
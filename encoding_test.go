@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestDecodeShiftJIS(t *testing.T) {
+	for _, c := range []struct{ hex, want string }{
+		{"616263", "abc"},
+		// JIS X 0208, the yen sign of Windows as a backslash, a wave dash
+		// and NEC and IBM extensions as CP932 has them, and half-width kana.
+		{"93fa967b8cea5c8e9197bf81608740eee0ed95b6c0b6c520de",
+			"日本語\\資料～①髙﨑ｶﾀｶﾅ ﾞ"},
+	} {
+		b, _ := hex.DecodeString(c.hex)
+		got, err := decodeShiftJIS(b)
+		if err != nil || got != c.want {
+			t.Errorf("decodeShiftJIS(%s) = %q, %v, want %q", c.hex, got, err,
+				c.want)
+		}
+	}
+	for _, bad := range []string{"93", "8120", "85fc", "a0", "ff"} {
+		b, _ := hex.DecodeString(bad)
+		if got, err := decodeShiftJIS(b); err == nil {
+			t.Errorf("decodeShiftJIS(%s) = %q, want an error", bad, got)
+		}
+	}
+}
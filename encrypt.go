@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// parseEncrypt parses -encrypt, e.g. "age:age1...,age1..." or
+// "gpg:archive@example.org".
+func parseEncrypt(s string) (string, []string, error) {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 || (kv[0] != "age" && kv[0] != "gpg") {
+		return "", nil, fmt.Errorf(
+			"encrypt must be \"age:RECIPIENT,...\" or \"gpg:RECIPIENT,...\": %q", s)
+	}
+	var rs []string
+	for _, r := range strings.Split(kv[1], ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			rs = append(rs, r)
+		}
+	}
+	if len(rs) == 0 {
+		return "", nil, fmt.Errorf("no recipients to encrypt for: %q", s)
+	}
+	return kv[0], rs, nil
+}
+
+// encryptOutput replaces r.Dest with its encryption for the recipients of
+// cfg.Encrypt, named with .age or .gpg added.
+func encryptOutput(cfg *config, w *worker, r *result) error {
+	if _, err := os.Stat(longPath(trimExt(r.Dest) + "_files")); err == nil {
+		return errors.New("encrypt: deep zoom outputs are not supported")
+	}
+	tool, rs, err := parseEncrypt(cfg.Encrypt)
+	if err != nil {
+		return err
+	}
+	out := r.Dest + "." + tool
+
+	args := []string{"age", "-e"}
+	if tool == "gpg" {
+		args = []string{"gpg", "--batch", "--yes", "--trust-model", "always",
+			"-e"}
+	}
+	for _, r := range rs {
+		args = append(args, "-r", shellQuote(r))
+	}
+	args = append(args, "-o", shellQuote(out), shellQuote(r.Dest))
+	if err := runCmd(cfg, w, strings.Join(args, " ")); err != nil {
+		os.Remove(longPath(out))
+		return fmt.Errorf("encrypt: %s", err)
+	}
+	if err := os.Remove(longPath(r.Dest)); err != nil {
+		return err
+	}
+	r.Dest = out
+	return nil
+}
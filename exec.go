@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// stringsFlag is a flag.Value collecting repeated options.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// cmdCtx is cancelled to kill all running commands, e.g. on signals.
+var cmdCtx, killCmds = context.WithCancel(context.Background())
+
+// runCmd runs the shell command s for worker w, killing it after
+// cfg.Timeout and retrying up to cfg.Retries times.
+func runCmd(cfg *config, w *worker, s string) error {
+	return retry(cfg, func() error {
+		return runCmdOnce(cfg, w, s, nil, cfg.Stdout)
+	})
+}
+
+// retry calls f up to 1 + cfg.Retries times until it succeeds.
+func retry(cfg *config, f func() error) error {
+	var err error
+	for i := 0; i <= cfg.Retries; i++ {
+		if i > 0 {
+			cfg.Log.Write([]byte(fmt.Sprintf(
+				"warning: %s\n  retry %d/%d\n", err, i, cfg.Retries)))
+		}
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// runCmdOnce runs s once with stdin and stdout.
+func runCmdOnce(cfg *config, w *worker, s string, stdin io.Reader,
+	stdout io.Writer) error {
+	ctx := cmdCtx
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", s)
+	if w.cpuset != "" {
+		cmd = exec.CommandContext(ctx, "taskset", "-c", w.cpuset, "sh", "-c", s)
+	}
+	// kill the whole process tree, not only sh.
+	setProcGroup(cmd)
+	cmd.WaitDelay = 10 * time.Second
+	cmd.Env = childEnv(cfg, w)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	// the end of stderr tells why it failed.
+	stderr := &tailBuffer{max: maxStderr}
+	cmd.Stderr = io.MultiWriter(cfg.Stderr, stderr)
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%s:\n  %w %s", s, errTimedOut, cfg.Timeout)
+	} else if err != nil {
+		err = fmt.Errorf("%s:\n  %w", s, err)
+	}
+	if err != nil {
+		return &cmdError{err, s, cmd.Env, string(stderr.b)}
+	}
+	return err
+}
+
+// cmdOutput runs s once as converters run, with their environment and
+// timeout, and returns its stdout, e.g. for reading image headers.
+func cmdOutput(cfg *config, s string) ([]byte, error) {
+	var out bytes.Buffer
+	err := runCmdOnce(cfg, &worker{}, s, nil, &out)
+	return out.Bytes(), err
+}
+
+// postProcess runs cfg.Post commands on the output dest in order.
+func postProcess(cfg *config, w *worker, dest string) error {
+	for _, f := range cfg.Post {
+		if err := runCmd(cfg, w, formatCmd(f, dest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// origin is where a source came from in filelist mode.
+type origin struct {
+	list string
+	line int
+}
+
+// listRun tracks the files of a filelist as a unit of the run.
+type listRun struct {
+	List      string    `json:"list"`
+	Complete  bool      `json:"complete"`
+	Queued    int       `json:"queued"`
+	Converted int       `json:"converted"`
+	Failed    int       `json:"failed"`
+	Skipped   int       `json:"skipped"`
+	Missing   int       `json:"missing"`
+	Failures  []*result `json:"failures"` // and missing ones
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+
+	walked bool
+	done   int
+}
+
+// directives are settings a filelist overrides for its files, given at its
+// head like
+//
+//	#dest: /mnt/out/kn2023
+//	#profile: masters
+type directives struct {
+	dest    string
+	profile string
+}
+
+// parse reads a directive or comment line into d.
+func (d *directives) parse(cfg *config, line string) error {
+	kv := strings.SplitN(strings.TrimPrefix(line, "#"), ":", 2)
+	if len(kv) != 2 {
+		// a comment.
+		return nil
+	}
+	v := strings.TrimSpace(kv[1])
+	switch strings.TrimSpace(kv[0]) {
+	case "dest":
+		d.dest = filepath.FromSlash(v)
+	case "profile":
+		if _, err := cfg.withProfile(v); err != nil {
+			return err
+		}
+		d.profile = v
+	}
+	return nil
+}
+
+// listSet tracks filelists of a run sharing the workers.
+type listSet struct {
+	mu      sync.Mutex
+	origins map[string]origin
+	runs    map[string]*listRun
+	dirs    map[string]directives
+}
+
+func newListSet() *listSet {
+	return &listSet{origins: map[string]origin{}, runs: map[string]*listRun{},
+		dirs: map[string]directives{}}
+}
+
+// setDirectives records the directives of list.
+func (ls *listSet) setDirectives(list string, d directives) {
+	ls.mu.Lock()
+	ls.dirs[list] = d
+	ls.mu.Unlock()
+}
+
+// directives returns the directives of list. ls may be nil.
+func (ls *listSet) directives(list string) directives {
+	if ls == nil {
+		return directives{}
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.dirs[list]
+}
+
+// listDest returns the destination of src from its filelist if any.
+func listDest(cfg *config, st *state, src, list string) (string, error) {
+	if d := cfg.lists.directives(list); d.dest != "" {
+		c := *cfg
+		c.DestDir = d.dest
+		return destPath(&c, st, src)
+	}
+	return destPath(cfg, st, src)
+}
+
+func (ls *listSet) run(list string) *listRun {
+	lr := ls.runs[list]
+	if lr == nil {
+		lr = &listRun{List: list, Start: time.Now()}
+		ls.runs[list] = lr
+	}
+	return lr
+}
+
+// add records that src is on line of list.
+func (ls *listSet) add(src, list string, line int) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.origins[src] = origin{list, line}
+	ls.run(list).Queued++
+}
+
+// origin returns where src came from.
+func (ls *listSet) origin(src string) (origin, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	o, ok := ls.origins[src]
+	return o, ok
+}
+
+// walked records that all lines of list have been read.
+func (ls *listSet) walked(cfg *config, list string) {
+	ls.mu.Lock()
+	lr := ls.run(list)
+	lr.walked = true
+	finished := lr.done == lr.Queued
+	ls.mu.Unlock()
+	if finished {
+		ls.finish(cfg, lr)
+	}
+}
+
+// done counts r in its filelist, which is summarized if it is the last.
+// target is false if the file was skipped.
+func (ls *listSet) done(cfg *config, r *result, target bool) {
+	ls.mu.Lock()
+	o, ok := ls.origins[r.Src]
+	if !ok {
+		ls.mu.Unlock()
+		return
+	}
+	delete(ls.origins, r.Src)
+	lr := ls.run(o.list)
+	switch {
+	case !target:
+		lr.Skipped++
+	case r.Status == "missing":
+		lr.Missing++
+		lr.Failures = append(lr.Failures, r)
+	case r.ok():
+		lr.Converted++
+	default:
+		lr.Failed++
+		lr.Failures = append(lr.Failures, r)
+	}
+	lr.done++
+	finished := lr.walked && lr.done == lr.Queued
+	ls.mu.Unlock()
+	if finished {
+		ls.finish(cfg, lr)
+	}
+}
+
+// flush summarizes filelists left unfinished, e.g. by a stopped run.
+func (ls *listSet) flush(cfg *config) {
+	ls.mu.Lock()
+	var lrs []*listRun
+	for _, lr := range ls.runs {
+		lrs = append(lrs, lr)
+	}
+	ls.mu.Unlock()
+	sort.Slice(lrs, func(i, j int) bool { return lrs[i].List < lrs[j].List })
+	for _, lr := range lrs {
+		ls.finish(cfg, lr)
+	}
+}
+
+// finish logs the summary of lr and sends it where configured.
+func (ls *listSet) finish(cfg *config, lr *listRun) {
+	ls.mu.Lock()
+	if _, ok := ls.runs[lr.List]; !ok {
+		// already summarized.
+		ls.mu.Unlock()
+		return
+	}
+	delete(ls.runs, lr.List)
+	lr.Complete = lr.walked && lr.done == lr.Queued
+	lr.End = time.Now()
+	ls.mu.Unlock()
+
+	state := "done"
+	if !lr.Complete {
+		state = fmt.Sprintf("incomplete (%d of %d)", lr.done, lr.Queued)
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf(
+		"list %s: %s, converted: %d, failed: %d, skipped: %d, missing: %d\n",
+		lr.List, state, lr.Converted, lr.Failed, lr.Skipped, lr.Missing)))
+
+	b, err := json.MarshalIndent(lr, "", " ")
+	if err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: list %s: %s\n", lr.List, err)))
+		return
+	}
+	if cfg.ListReports != "" {
+		name := strings.TrimSuffix(filepath.Base(lr.List), cfg.FilelistExt)
+		path := filepath.Join(cfg.ListReports, name+".summary.json")
+		if err := os.MkdirAll(cfg.ListReports, 0755); err == nil {
+			err = os.WriteFile(path, append(b, '\n'), 0644)
+		}
+		if err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: list %s: %s\n", lr.List, err)))
+		}
+	}
+	if cfg.ListWebhook != "" {
+		if err := postJSON(cfg.ListWebhook, b); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: list %s: %s\n", lr.List, err)))
+		}
+	}
+}
+
+// postJSON posts b to url.
+func postJSON(url string, b []byte) error {
+	c := &http.Client{Timeout: 30 * time.Second}
+	resp, err := c.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// missing records r as a filelist entry without its source.
+func (st *state) missing(cfg *config, r *result) {
+	r.Status = "missing"
+	r.Error = fmt.Sprintf("%s:%d: no such file", r.List, r.Line)
+	cfg.Log.Write([]byte(fmt.Sprintf("missing: %s (%s:%d)\n",
+		r.Src, r.List, r.Line)))
+	atomic.AddInt64(&st.missingN, 1)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.missingOut != nil {
+		fmt.Fprintf(st.missingOut, "%s:%d: %s\n", r.List, r.Line, r.Src)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var genRe = regexp.MustCompile(`\.v(\d+)(\.[^./\\]*)?$`)
+
+// genPath returns the path of generation n of dest, e.g. name.v2.tif, or
+// dest itself for the first one.
+func genPath(dest string, n int) string {
+	if n <= 1 {
+		return dest
+	}
+	ext := filepath.Ext(dest)
+	return fmt.Sprintf("%s.v%d%s", trimExt(dest), n, ext)
+}
+
+// genBase returns the first generation of dest.
+func genBase(dest string) string {
+	m := genRe.FindStringSubmatchIndex(dest)
+	if m == nil {
+		return dest
+	}
+	return dest[:m[0]] + dest[m[4]:]
+}
+
+// generation decides where r is written with -generations: its last
+// generation if the profile is the same as recorded, or else a new one
+// unless the first one has not been written yet.
+func generation(st *state, r *result) {
+	prev := st.prev[r.Src]
+	if prev == nil || prev.Dest == "" || genBase(prev.Dest) != r.Dest {
+		return
+	}
+	gen := prev.Gen
+	if gen == 0 {
+		gen = 1
+	}
+	if prev.ProfileKey != "" && prev.ProfileKey != r.ProfileKey {
+		if _, err := os.Stat(longPath(prev.Dest)); err == nil {
+			gen++
+		}
+	}
+	if gen > 1 {
+		r.Dest, r.Gen = genPath(r.Dest, gen), gen
+	}
+}
+
+// promoteMain moves the latest generations recorded in -results into the
+// places of the first ones.
+func promoteMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	setFlags(fs, cfg)
+	fs.Parse(args)
+	if cfg.Results == "" {
+		return errors.New("promote needs -results")
+	}
+
+	bySrc, _, err := loadResults(cfg.Results)
+	if err != nil {
+		return err
+	}
+	srcs := make([]string, 0, len(bySrc))
+	for src, r := range bySrc {
+		if r.Gen > 1 && r.ok() {
+			srcs = append(srcs, src)
+		}
+	}
+	sort.Strings(srcs)
+
+	var out *json.Encoder
+	if !cfg.DryRun {
+		f, err := os.OpenFile(cfg.Results,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = json.NewEncoder(f)
+	}
+	n := 0
+	for _, src := range srcs {
+		r := bySrc[src]
+		base := genBase(r.Dest)
+		if cfg.DryRun {
+			fmt.Printf("would promote %s -> %s\n", r.Dest, base)
+			n++
+			continue
+		}
+		if err := promote(r.Dest, base); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			continue
+		}
+		fmt.Printf("promoted %s -> %s\n", r.Dest, base)
+		// the first generation is the current one again.
+		r.Dest, r.Gen, r.Status = base, 0, "promoted"
+		r.Start, r.Duration = time.Now(), 0
+		out.Encode(r)
+		n++
+	}
+	fmt.Printf("promoted: %d\n", n)
+	return nil
+}
+
+// promote renames the outputs of gen to those of base. renaming replaces
+// a file atomically, while the tile dir of deep zoom outputs is removed
+// before.
+func promote(gen, base string) error {
+	from, to := partials(gen), partials(base)
+	for i := range from {
+		fi, err := os.Stat(longPath(from[i]))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err := os.RemoveAll(longPath(to[i])); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(longPath(from[i]), longPath(to[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
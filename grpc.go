@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the grpc job api of imconvvips.proto, served by the standard library over
+// http/2 with messages encoded by hand, as grpc-go cannot be taken without
+// a go.mod.
+
+const grpcService = "/imconvvips.v1.Jobs/"
+
+// grpc status codes.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnauthenticated    = 16
+)
+
+// maxGRPCMessage is the largest request message taken.
+const maxGRPCMessage = 4 << 20
+
+// grpcError is an error replied with its grpc status code.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+func grpcErrorf(code int, f string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(f, args...)}
+}
+
+// pbField is a field of a protobuf message: a varint, or the bytes of a
+// string, bytes or message.
+type pbField struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+// parsePB parses the fields of the protobuf message b, skipping fixed size
+// ones, unused by imconvvips.proto.
+func parsePB(b []byte) ([]pbField, error) {
+	var fs []pbField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("bad protobuf tag")
+		}
+		b = b[n:]
+		f := pbField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return nil, errors.New("bad protobuf varint")
+			}
+			b = b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return nil, errors.New("bad protobuf length")
+			}
+			f.b, b = b[n:n+int(l)], b[n+int(l):]
+		case 1, 5:
+			size := 8
+			if tag&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return nil, errors.New("bad protobuf fixed field")
+			}
+			b = b[size:]
+			continue
+		default:
+			return nil, fmt.Errorf("bad protobuf wire type %d", tag&7)
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+// pbVarint appends the field num of the varint v, left out if 0 as proto3
+// does. negative ints are of 10 bytes.
+func pbVarint(b []byte, num int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+// pbBytes appends the field num of the bytes of a string or message.
+func pbBytes(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// pbString appends the field num of the string s, valid utf-8 as proto3
+// requires, e.g. of file names of another encoding.
+func pbString(b []byte, num int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return pbBytes(b, num, []byte(strings.ToValidUTF8(s, "\ufffd")))
+}
+
+func unixMS(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// encodeJob encodes qr as a Job. s.mu is held.
+func encodeJob(qr *queuedRun) []byte {
+	var b []byte
+	b = pbString(b, 1, qr.Name)
+	for _, a := range qr.Args {
+		b = pbBytes(b, 2, []byte(strings.ToValidUTF8(a, "\ufffd")))
+	}
+	b = pbVarint(b, 3, int64(qr.Priority))
+	b = pbVarint(b, 4, int64(qr.Proc))
+	b = pbString(b, 5, qr.Status)
+	b = pbVarint(b, 6, int64(qr.Exit))
+	b = pbString(b, 7, qr.Err)
+	b = pbVarint(b, 8, unixMS(qr.Submitted))
+	b = pbVarint(b, 9, unixMS(qr.Started))
+	b = pbVarint(b, 10, unixMS(qr.Ended))
+	return pbString(b, 11, qr.Owner)
+}
+
+// readGRPC reads the request message of a unary or server streaming call.
+func readGRPC(r io.Reader) ([]pbField, error) {
+	var h [5]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "no request message")
+	}
+	if h[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages")
+	}
+	n := binary.BigEndian.Uint32(h[1:])
+	if n > maxGRPCMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "message of %d bytes",
+			n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "short message")
+	}
+	fs, err := parsePB(b)
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return fs, nil
+}
+
+// writeGRPC writes the response message b, flushed for streams.
+func writeGRPC(w http.ResponseWriter, b []byte) error {
+	h := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(h[1:], uint32(len(b)))
+	if _, err := w.Write(append(h, b...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// grpcEscape percent-encodes s for grpc-message.
+func grpcEscape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// grpcHandler serves the Jobs service of imconvvips.proto to the runs of
+// the key of a call, as the http api does.
+func (s *queueServer) grpcHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasPrefix(
+			r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "grpc only", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		code, msg := grpcOK, ""
+		if err := s.grpcCall(w, r); err != nil {
+			code, msg = grpcInternal, err.Error()
+			var ge *grpcError
+			if errors.As(err, &ge) {
+				code = ge.code
+			}
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(code))
+		if msg != "" {
+			w.Header().Set("Grpc-Message", grpcEscape(msg))
+		}
+	})
+}
+
+// grpcCall carries out the call of r.
+func (s *queueServer) grpcCall(w http.ResponseWriter, r *http.Request) error {
+	method, ok := strings.CutPrefix(r.URL.Path, grpcService)
+	if !ok {
+		return grpcErrorf(grpcUnimplemented, "unknown service: %s", r.URL.Path)
+	}
+	var k *apiKey
+	if s.keys != nil {
+		if k = s.authKey(r); k == nil {
+			return grpcErrorf(grpcUnauthenticated, "unauthorized")
+		}
+	}
+	fs, err := readGRPC(r.Body)
+	if err != nil {
+		return err
+	}
+	var name string
+	for _, f := range fs {
+		if f.num == 1 {
+			name = string(f.b)
+		}
+	}
+
+	switch method {
+	case "SubmitJob":
+		qr := &queuedRun{Name: name}
+		for _, f := range fs {
+			switch f.num {
+			case 2:
+				qr.Args = append(qr.Args, string(f.b))
+			case 3:
+				qr.Priority = int(int32(f.v))
+			case 4:
+				qr.Proc = int(int32(f.v))
+			}
+		}
+		err := s.submit(k, qr)
+		s.cfg.audit.record(keyActor(k, r), "submit", qr.Name, err)
+		if err == errRunExists {
+			return grpcErrorf(grpcAlreadyExists, "%s", err)
+		} else if err != nil {
+			return grpcErrorf(grpcInvalidArgument, "%s", err)
+		}
+		s.mu.Lock()
+		b := encodeJob(qr)
+		s.mu.Unlock()
+		return writeGRPC(w, b)
+
+	case "CancelJob":
+		s.mu.Lock()
+		qr := s.runs[name]
+		s.mu.Unlock()
+		if qr == nil || !visible(k, qr) {
+			return grpcErrorf(grpcNotFound, "no run %q", name)
+		}
+		err := s.cancel(name)
+		s.cfg.audit.record(keyActor(k, r), "cancel", name, err)
+		if err != nil {
+			return grpcErrorf(grpcFailedPrecondition, "%s", err)
+		}
+		s.mu.Lock()
+		b := encodeJob(qr)
+		s.mu.Unlock()
+		return writeGRPC(w, b)
+
+	case "StreamProgress":
+		return s.streamProgress(w, r, k, name)
+	}
+	return grpcErrorf(grpcUnimplemented, "unknown method: %s", method)
+}
+
+// streamProgress sends the run name as Progress when it changes or writes
+// its output, polling every second, until it ends or the client leaves.
+func (s *queueServer) streamProgress(w http.ResponseWriter, r *http.Request,
+	k *apiKey, name string) error {
+	log := filepath.Join(s.logDir, name+".log")
+	var off int64
+	var last []byte
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		s.mu.Lock()
+		qr := s.runs[name]
+		if qr == nil || !visible(k, qr) {
+			s.mu.Unlock()
+			return grpcErrorf(grpcNotFound, "no run %q", name)
+		}
+		job, active := encodeJob(qr), qr.active()
+		s.mu.Unlock()
+
+		out, n := readLines(log, off)
+		off = n
+		if string(job) != string(last) || out != "" {
+			msg := pbString(pbBytes(nil, 1, job), 2, out)
+			if err := writeGRPC(w, msg); err != nil {
+				return err
+			}
+			last = job
+		}
+		if !active {
+			return nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// readLines returns the whole lines of the file path from off, and the
+// offset after them. a file written again from the start is read again.
+func readLines(path string, off int64) (string, int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", off
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() < off {
+		off = 0
+	}
+	b := make([]byte, 64<<10)
+	n, _ := f.ReadAt(b, off)
+	i := strings.LastIndexByte(string(b[:n]), '\n')
+	if i < 0 && n == len(b) {
+		// a line longer than the buffer, in pieces.
+		i = n - 1
+	} else if i < 0 {
+		return "", off
+	}
+	return string(b[:i+1]), off + int64(i+1)
+}
+
+// listenAndServeGRPC serves h on addr over http/2, over tls if set up, or
+// in the clear (h2c) as grpc clients with plaintext speak it.
+func listenAndServeGRPC(cfg *config, addr string, h http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: h, TLSConfig: cfg.tls}
+	srv.Protocols = new(http.Protocols)
+	if cfg.tls == nil {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+		return srv.ListenAndServe()
+	}
+	srv.Protocols.SetHTTP2(true)
+	return srv.ListenAndServeTLS("", "")
+}
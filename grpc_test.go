@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPB(t *testing.T) {
+	var b []byte
+	b = pbString(b, 1, "kn2023")
+	b = pbBytes(b, 2, []byte("-s"))
+	b = pbBytes(b, 2, []byte(""))
+	b = pbVarint(b, 3, -5)
+	b = pbVarint(b, 4, 300)
+	fs, err := parsePB(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 5 || string(fs[0].b) != "kn2023" || string(fs[1].b) != "-s" ||
+		fs[2].num != 2 || len(fs[2].b) != 0 || int32(fs[3].v) != -5 ||
+		fs[4].v != 300 {
+		t.Errorf("parsePB = %+v", fs)
+	}
+	// fixed size fields of other versions are skipped.
+	b = append(b, 5<<3|5, 1, 2, 3, 4, 6<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	if fs, err := parsePB(b); err != nil || len(fs) != 5 {
+		t.Errorf("parsePB with fixed fields = %+v, %v", fs, err)
+	}
+	for _, bad := range [][]byte{{1<<3 | 2, 5, 'a'}, {0x80}, {1<<3 | 3}} {
+		if _, err := parsePB(bad); err == nil {
+			t.Errorf("parsePB(%x) took it", bad)
+		}
+	}
+}
+
+// grpcClient calls the grpc handler of a test server over h2c.
+type grpcClient struct {
+	t   *testing.T
+	url string
+	c   *http.Client
+}
+
+// call returns the response messages and the grpc-status of the method
+// called with the request message req.
+func (c *grpcClient) call(method string, req []byte) ([][]byte, string) {
+	c.t.Helper()
+	body := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+	r, _ := http.NewRequest("POST", c.url+grpcService+method,
+		bytes.NewReader(append(body, req...)))
+	r.Header.Set("Content-Type", "application/grpc")
+	resp, err := c.c.Do(r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var msgs [][]byte
+	for len(b) >= 5 {
+		n := binary.BigEndian.Uint32(b[1:])
+		msgs, b = append(msgs, b[5:5+n]), b[5+n:]
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status")
+}
+
+// jobField returns the field num of the Job msg.
+func jobField(t *testing.T, msg []byte, num int) pbField {
+	fs, err := parsePB(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fs {
+		if f.num == num {
+			return f
+		}
+	}
+	return pbField{}
+}
+
+func TestGRPCJobs(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "child")
+	os.WriteFile(exe, []byte("#!/bin/sh\necho converted: 1\n"), 0755)
+	s := &queueServer{cfg: &config{Log: io.Discard, Proc: 2}, exe: exe,
+		store: filepath.Join(dir, "runs.json"), logDir: dir, maxRuns: 1,
+		runs: map[string]*queuedRun{}}
+
+	ts := httptest.NewUnstartedServer(s.grpcHandler())
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	c := &grpcClient{t, ts.URL, &http.Client{Transport: tr}}
+
+	req := pbBytes(pbString(nil, 1, "r1"), 2, []byte("-t"))
+	msgs, status := c.call("SubmitJob", req)
+	if status != "0" || len(msgs) != 1 ||
+		string(jobField(t, msgs[0], 1).b) != "r1" ||
+		jobField(t, msgs[0], 4).v != 2 {
+		t.Fatalf("SubmitJob = %q, %s", msgs, status)
+	}
+	if _, status := c.call("SubmitJob", pbString(nil, 1, "../r2")); status != "3" {
+		t.Errorf("SubmitJob with a bad name: status %s", status)
+	}
+	if _, status := c.call("SubmitJob",
+		pbBytes(pbString(nil, 1, "r2"), 2, []byte("-nope"))); status != "3" {
+		t.Errorf("SubmitJob with a bad arg: status %s", status)
+	}
+
+	msgs, status = c.call("StreamProgress", pbString(nil, 1, "r1"))
+	if status != "0" || len(msgs) == 0 {
+		t.Fatalf("StreamProgress = %q, %s", msgs, status)
+	}
+	last := jobField(t, msgs[len(msgs)-1], 1).b
+	var log string
+	for _, m := range msgs {
+		log += string(jobField(t, m, 2).b)
+	}
+	if st := string(jobField(t, last, 5).b); st != "done" ||
+		log != "converted: 1\n" {
+		t.Errorf("StreamProgress ends with %s, log %q", st, log)
+	}
+
+	if _, status := c.call("CancelJob", pbString(nil, 1, "r1")); status != "9" {
+		t.Errorf("CancelJob of an ended run: status %s", status)
+	}
+	if _, status := c.call("CancelJob", pbString(nil, 1, "none")); status != "5" {
+		t.Errorf("CancelJob of no run: status %s", status)
+	}
+	if _, status := c.call("Nope", nil); status != "12" {
+		t.Errorf("unknown method: status %s", status)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+)
+
+// hasher computes source hashes in a pool of its own ahead of and along
+// with conversion, so that -cache-dir and -provenance do not slow it down.
+type hasher struct {
+	q chan *hashJob
+
+	mu   sync.Mutex
+	jobs map[string]*hashJob
+}
+
+type hashJob struct {
+	src  string
+	done chan struct{}
+	sum  string
+	err  error
+}
+
+func newHasher(n int) *hasher {
+	h := &hasher{q: make(chan *hashJob, n), jobs: map[string]*hashJob{}}
+	for i := 0; i < n; i++ {
+		go func() {
+			for j := range h.q {
+				j.sum, j.err = hashFile(longPath(j.src))
+				close(j.done)
+			}
+		}()
+	}
+	return h
+}
+
+// submit queues src unless it is queued already.
+func (h *hasher) submit(src string) *hashJob {
+	h.mu.Lock()
+	if j := h.jobs[src]; j != nil {
+		h.mu.Unlock()
+		return j
+	}
+	j := &hashJob{src: src, done: make(chan struct{})}
+	h.jobs[src] = j
+	h.mu.Unlock()
+	h.q <- j
+	return j
+}
+
+// hash returns a function waiting for the hash of src, queuing it if not
+// yet.
+func (h *hasher) hash(src string) func() (string, error) {
+	j := h.submit(src)
+	return func() (string, error) {
+		<-j.done
+		return j.sum, j.err
+	}
+}
+
+// drop forgets src once it is done.
+func (h *hasher) drop(src string) {
+	h.mu.Lock()
+	delete(h.jobs, src)
+	h.mu.Unlock()
+}
+
+func (h *hasher) close() {
+	close(h.q)
+}
+
+// srcHash returns a function waiting for the hash of src, computed by the
+// hasher of st if any, or else by the caller.
+func srcHash(st *state, src string) func() (string, error) {
+	if st.hashes != nil {
+		return st.hashes.hash(src)
+	}
+	return func() (string, error) {
+		return hashFile(longPath(src))
+	}
+}
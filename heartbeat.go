@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat logs the counts and the file of each worker with its elapsed
+// time every cfg.Heartbeat, and warns once of a file converted longer than
+// cfg.StallAfter.
+func heartbeat(cfg *config, st *state) {
+	d := cfg.Heartbeat
+	if d <= 0 {
+		d = time.Minute
+	}
+	if cfg.StallAfter > 0 && cfg.StallAfter < d {
+		d = cfg.StallAfter
+	}
+	t := time.NewTicker(d)
+	defer t.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-t.C:
+		case <-st.stop:
+			return
+		}
+		if cfg.StallAfter > 0 {
+			st.warnStalls(cfg)
+		}
+		if cfg.Heartbeat > 0 && time.Since(last) >= cfg.Heartbeat {
+			last = time.Now()
+			st.beat(cfg)
+		}
+	}
+}
+
+func (st *state) beat(cfg *config) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "heartbeat: converted %d, failed %d, skipped %d\n",
+		atomic.LoadInt64(&st.converted), atomic.LoadInt64(&st.failed),
+		atomic.LoadInt64(&st.skipped))
+	st.mu.Lock()
+	ids := make([]int, 0, len(st.current))
+	for id := range st.current {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		p := st.current[id]
+		fmt.Fprintf(&b, "  worker %d: %s (%s)\n", id, p.Src,
+			time.Since(p.Since).Round(time.Second))
+	}
+	st.mu.Unlock()
+	cfg.Log.Write([]byte(b.String()))
+}
+
+// warnStalls warns of files converted longer than cfg.StallAfter.
+func (st *state) warnStalls(cfg *config) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for id, p := range st.current {
+		if p.Stalled || time.Since(p.Since) < cfg.StallAfter {
+			continue
+		}
+		p.Stalled = true
+		cfg.Log.Write([]byte(fmt.Sprintf(
+			"warning: worker %d on %s for %s\n", id, p.Src,
+			time.Since(p.Since).Round(time.Second))))
+	}
+}
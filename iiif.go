@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// iiifChecks are requests made of each output relative to its identifier:
+// the info, a thumbnail, a tile at the origin and a region in the middle
+// scaled, in the syntax common to the image api 2 and 3.
+var iiifChecks = []string{
+	"info.json",
+	"full/,150/0/default.jpg",
+	"0,0,256,256/256,/0/default.jpg",
+	"pct:25,25,50,50/512,/0/default.jpg",
+}
+
+// iiifID returns the identifier of dest on the image server, its path
+// relative to the destination dir with "/" escaped.
+func iiifID(cfg *config, dest string) (string, error) {
+	rel, err := filepath.Rel(cfg.DestDir, dest)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not in %s", dest, cfg.DestDir)
+	}
+	return url.PathEscape(filepath.ToSlash(rel)), nil
+}
+
+// checkIIIF requests iiifChecks of the image at base/id, returning the
+// first failure.
+func checkIIIF(client *http.Client, base, id string) error {
+	for _, c := range iiifChecks {
+		u := base + "/" + id + "/" + c
+		res, err := client.Get(u)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+		res.Body.Close()
+		switch {
+		case err != nil:
+			return fmt.Errorf("%s: %s", u, err)
+		case res.StatusCode != http.StatusOK:
+			return fmt.Errorf("%s: %s", u, res.Status)
+		case c == "info.json":
+			var info struct {
+				Width  int `json:"width"`
+				Height int `json:"height"`
+			}
+			if err := json.Unmarshal(b, &info); err != nil ||
+				info.Width == 0 || info.Height == 0 {
+				return fmt.Errorf("%s: no width and height", u)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOutputsIIIF checks the outputs of the run on the image server of
+// cfg.IIIF in cfg.Proc goroutines, returning how many failed.
+func checkOutputsIIIF(cfg *config, st *state) int64 {
+	base := strings.TrimSuffix(cfg.IIIF, "/")
+	client := &http.Client{Timeout: time.Minute}
+	var failed int64
+	q := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Proc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dest := range q {
+				id, err := iiifID(cfg, dest)
+				if err == nil {
+					err = checkIIIF(client, base, id)
+				}
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					cfg.Log.Write([]byte(fmt.Sprintf("error: iiif: %s\n", err)))
+				}
+			}
+		}()
+	}
+	for _, r := range st.outputs {
+		q <- r.Dest
+	}
+	close(q)
+	wg.Wait()
+	cfg.Log.Write([]byte(fmt.Sprintf("iiif: %d of %d images ok\n",
+		int64(len(st.outputs))-failed, len(st.outputs))))
+	return failed
+}
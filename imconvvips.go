@@ -1,68 +1,348 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
+	"time"
 )
 
 type config struct {
-	DryRun      bool      `json:"-"`
-	Verbose     bool      `json:"-"`
-	Save        bool      `json:"-"`
-	Proc        int       `json:"proc"`
-	Type        string    `json:"type"`
-	FilelistExt string    `json:"-"`
-	SrcDir      string    `json:"src_dir"`
-	DestDir     string    `json:"dest_dir"`
-	ListDir     string    `json:"base_dir"`
-	Ext         string    `json:"ext"`
-	VipsFmt     string    `json:"vips_fmt"`
-	LogName     string    `json:"log"`
-	StdoutLog   string    `json:"stdout"`
-	StderrLog   string    `json:"stderr"`
-	Log         io.Writer `json:"-"`
-	Stdout      io.Writer `json:"-"`
-	Stderr      io.Writer `json:"-"`
+	DryRun            bool                `json:"-"`
+	Verbose           bool                `json:"-"`
+	Save              bool                `json:"-"`
+	Proc              int                 `json:"proc"`
+	Type              string              `json:"type"`
+	FilelistExt       string              `json:"-"`
+	SrcDir            string              `json:"src_dir"`
+	DestDir           string              `json:"dest_dir"`
+	ListDir           string              `json:"base_dir"`
+	Ext               string              `json:"ext"`
+	DestExt           string              `json:"dest_ext"`
+	DestTemplate      string              `json:"dest_template"`
+	IDRegex           string              `json:"id_regex"`
+	Layout            string              `json:"layout"`
+	CASMap            string              `json:"cas_map"`
+	Encrypt           string              `json:"encrypt"`
+	Generations       bool                `json:"generations"`
+	QualityGate       string              `json:"quality_gate"`
+	VerifyLossless    bool                `json:"verify_lossless"`
+	IIIF              string              `json:"iiif"`
+	Mapping           string              `json:"mapping"`
+	MappingURL        string              `json:"mapping_url"`
+	Index             string              `json:"index"`
+	IndexTemplate     string              `json:"index_template"`
+	Zip               string              `json:"zip"`
+	Upload            string              `json:"upload"`
+	UploadMethod      string              `json:"upload_method"`
+	UploadHeaders     stringsFlag         `json:"upload_headers"`
+	UploadProc        int                 `json:"upload_proc"`
+	Engine            string              `json:"engine"`
+	VipsFmt           string              `json:"vips_fmt"`
+	VipsStream        string              `json:"vips_stream"`
+	IMFmt             string              `json:"im_fmt"`
+	GMFmt             string              `json:"gm_fmt"`
+	NativeOpts        string              `json:"native_opts"`
+	ThumbFmt          string              `json:"thumb_fmt"`
+	Renditions        string              `json:"renditions"`
+	Animated          string              `json:"animated"`
+	BitDepth          string              `json:"bit_depth"`
+	DepthMethod       string              `json:"depth_method"`
+	Alpha             string              `json:"alpha"`
+	GPUFmt            string              `json:"gpu_fmt"`
+	GPUs              string              `json:"gpus"`
+	Fallback          string              `json:"fallback"`
+	Steps             []step              `json:"steps"`
+	Profile           string              `json:"profile"`
+	Profiles          map[string]*profile `json:"profiles"`
+	Rules             []rule              `json:"rules"`
+	HTTPAddr          string              `json:"http"`
+	HTTPToken         string              `json:"http_token"`
+	TLSCert           string              `json:"tls_cert"`
+	TLSKey            string              `json:"tls_key"`
+	TLSClientCA       string              `json:"tls_client_ca"`
+	TUI               bool                `json:"-"`
+	ControlSock       string              `json:"control"`
+	Audit             string              `json:"audit"`
+	PriorityList      string              `json:"-"`
+	Tags              tags                `json:"tags"`
+	Manifest          string              `json:"manifest"`
+	Premis            string              `json:"premis"`
+	Sidecars          string              `json:"sidecars"`
+	SidecarFmt        string              `json:"sidecar_fmt"`
+	Flatten           bool                `json:"flatten"`
+	Rewrites          rewritesFlag        `json:"rewrites"`
+	Normalize         string              `json:"normalize"`
+	Transliterate     string              `json:"transliterate"`
+	TransliterateMap  string              `json:"transliterate_map"`
+	Renumber          bool                `json:"renumber"`
+	RenumberWidth     int                 `json:"renumber_width"`
+	TmpDir            string              `json:"tmp_dir"`
+	TmpMax            string              `json:"tmp_max"`
+	MinFree           string              `json:"min_free"`
+	Watch             bool                `json:"-"`
+	WatchInterval     time.Duration       `json:"watch_interval"`
+	WatchStable       time.Duration       `json:"watch_stable"`
+	WatchQuiet        time.Duration       `json:"watch_quiet"`
+	WatchMarker       string              `json:"watch_marker"`
+	CacheDir          string              `json:"cache_dir"`
+	PassThrough       string              `json:"pass_through"`
+	PassThroughBy     string              `json:"pass_through_by"`
+	Results           string              `json:"results"`
+	EmitScript        string              `json:"emit_script"`
+	Provenance        bool                `json:"provenance"`
+	HashProc          int                 `json:"hash_proc"`
+	Post              stringsFlag         `json:"post"`
+	Timeout           time.Duration       `json:"timeout"`
+	Retries           int                 `json:"retries"`
+	VipsCheck         string              `json:"vips_check"`
+	VipsTranslate     bool                `json:"vips_translate"`
+	VipsVersion       string              `json:"-"`
+	CPUSet            string              `json:"cpuset"`
+	VipsConcurrency   int                 `json:"vips_concurrency"`
+	VipsDiscThreshold string              `json:"vips_disc_threshold"`
+	IsolateEnv        bool                `json:"isolate_env"`
+	EnvPass           string              `json:"env_pass"`
+	Env               stringsFlag         `json:"env"`
+	MemBudget         string              `json:"mem_budget"`
+	Sample            int                 `json:"-"`
+	SamplePercent     float64             `json:"-"`
+	SampleStrategy    string              `json:"-"`
+	SampleSeed        int64               `json:"-"`
+	SampleDir         string              `json:"sample_dir"`
+	Limit             int                 `json:"-"`
+	StopAfterErrors   int                 `json:"stop_after_errors"`
+	Breaker           string              `json:"breaker"`
+	DestRunSubdir     bool                `json:"dest_run_subdir"`
+	RunID             string              `json:"-"`
+	MaxFiles          int                 `json:"max_files"`
+	MaxBytes          string              `json:"max_bytes"`
+	Shard             string              `json:"-"`
+	ShardFromEnv      bool                `json:"-"`
+	Checkpoint        string              `json:"checkpoint"`
+	Journal           string              `json:"journal"`
+	Plan              string              `json:"-"`
+	PlanKey           string              `json:"plan_key"`
+	PlanSHA256        string              `json:"-"`
+	SinceSnapshot     string              `json:"-"`
+	Failed            string              `json:"-"`
+	ListReports       string              `json:"list_reports"`
+	ListWebhook       string              `json:"list_webhook"`
+	Notify            stringsFlag         `json:"notify"`
+	NotifyFailures    int                 `json:"notify_failures"`
+	FilelistEncoding  string              `json:"filelist_encoding"`
+	Missing           string              `json:"missing"`
+	FilelistStartLine int                 `json:"-"`
+	FilelistEndLine   int                 `json:"-"`
+	Collisions        string              `json:"collisions"`
+	SkipExisting      bool                `json:"skip_existing"`
+	CheckProc         int                 `json:"check_proc"`
+	LargestFirst      bool                `json:"largest_first"`
+	StealLists        bool                `json:"steal_lists"`
+	Heartbeat         time.Duration       `json:"heartbeat"`
+	StallAfter        time.Duration       `json:"stall_after"`
+	DebugBundle       string              `json:"debug_bundle"`
+	LogName           string              `json:"log"`
+	Oneshot           bool                `json:"-"`
+	Systemd           bool                `json:"systemd"`
+	LogSink           string              `json:"log_sink"`
+	OTLP              string              `json:"otlp"`
+	TraceSample       float64             `json:"trace_sample"`
+	StdoutLog         string              `json:"stdout"`
+	StderrLog         string              `json:"stderr"`
+	Log               io.Writer           `json:"-"`
+	Stdout            io.Writer           `json:"-"`
+	Stderr            io.Writer           `json:"-"`
+
+	// set up from the above.
+	rewrites []*rewrite
+	destTmpl *template.Template
+	idRe     *regexp.Regexp
+	conds    [][]cond
+	lists    *listSet
+	tar      *tarStream
+	up       *uploader
+	notify   *notifiers
+	breaker  *breaker
+	shard    *shard
+	tls      *tls.Config
+	index    *indexer
+	audit    *auditLog
+	slots    *slots
+	maxBytes int64
+	tmp      *scratch
+	vipsFmt  string // VipsFmt as given, if translated
 }
 
 var (
 	confFile = "config.json"
-	wg       sync.WaitGroup
 )
 
 func loadConfig() (*config, error) {
 	// default settings:
 	cfg := &config{
-		Save:        false,
-		DryRun:      false,
-		Verbose:     false,
-		Proc:        4,
-		Type:        "files",
-		FilelistExt: ".txt",
-		SrcDir:      "src",
-		DestDir:     "dest",
-		ListDir:     "list",
-		Ext:         ".jpg",
-		VipsFmt:     "vips im_vips2tiff %s %s:jpeg:60,tile:256x256,pyramid",
-		LogName:     "",
-		StdoutLog:   "",
-		StderrLog:   "",
-		Log:         os.Stdout,
-		Stdout:      os.Stdout,
-		Stderr:      os.Stderr,
+		Save:              false,
+		DryRun:            false,
+		Verbose:           false,
+		Proc:              4,
+		Type:              "files",
+		FilelistExt:       ".txt",
+		SrcDir:            "src",
+		DestDir:           "dest",
+		ListDir:           "list",
+		Ext:               ".jpg",
+		DestExt:           ".jpg",
+		DestTemplate:      "",
+		IDRegex:           "",
+		Layout:            "",
+		CASMap:            "",
+		Encrypt:           "",
+		Generations:       false,
+		QualityGate:       "",
+		VerifyLossless:    false,
+		IIIF:              "",
+		Mapping:           "",
+		MappingURL:        "",
+		Index:             "",
+		IndexTemplate:     "",
+		Zip:               "",
+		Upload:            "",
+		UploadMethod:      "PUT",
+		UploadHeaders:     nil,
+		UploadProc:        0,
+		Engine:            "vips",
+		VipsFmt:           "vips im_vips2tiff %s %s:jpeg:60,tile:256x256,pyramid",
+		VipsStream:        "",
+		IMFmt:             "convert %s %s",
+		GMFmt:             "gm convert %s %s",
+		NativeOpts:        "[compression=jpeg,Q=60,tile,pyramid]",
+		ThumbFmt:          "vipsthumbnail %s --size 256x256 -o %s",
+		Renditions:        "",
+		Animated:          "",
+		BitDepth:          "",
+		DepthMethod:       "shift",
+		Alpha:             "",
+		GPUFmt:            "",
+		GPUs:              "",
+		Fallback:          "",
+		Steps:             nil,
+		Profile:           "",
+		Profiles:          map[string]*profile{},
+		Rules:             nil,
+		HTTPAddr:          "",
+		HTTPToken:         "",
+		TLSCert:           "",
+		TLSKey:            "",
+		TLSClientCA:       "",
+		TUI:               false,
+		ControlSock:       "",
+		Audit:             "",
+		PriorityList:      "",
+		Tags:              tags{},
+		Manifest:          "",
+		Premis:            "",
+		Sidecars:          "",
+		SidecarFmt:        "%s%s",
+		Flatten:           false,
+		Rewrites:          nil,
+		Normalize:         "nfc",
+		Transliterate:     "",
+		TransliterateMap:  "",
+		Renumber:          false,
+		TmpDir:            "",
+		TmpMax:            "",
+		MinFree:           "",
+		Watch:             false,
+		WatchInterval:     30 * time.Second,
+		WatchStable:       10 * time.Second,
+		WatchQuiet:        0,
+		WatchMarker:       "",
+		CacheDir:          "",
+		PassThrough:       "",
+		PassThroughBy:     "reflink",
+		Results:           "",
+		EmitScript:        "",
+		Provenance:        false,
+		HashProc:          2,
+		Post:              nil,
+		Timeout:           0,
+		Retries:           0,
+		RenumberWidth:     4,
+		VipsCheck:         "warn",
+		VipsTranslate:     true,
+		VipsVersion:       "",
+		CPUSet:            "",
+		VipsConcurrency:   0,
+		VipsDiscThreshold: "",
+		IsolateEnv:        false,
+		EnvPass:           "PATH,HOME,LANG,LC_ALL,LC_CTYPE,TZ,SYSTEMROOT",
+		Env:               nil,
+		MemBudget:         "",
+		Sample:            0,
+		SamplePercent:     0,
+		SampleStrategy:    "random",
+		SampleSeed:        0,
+		SampleDir:         "sample",
+		Limit:             0,
+		StopAfterErrors:   0,
+		Breaker:           "",
+		DestRunSubdir:     false,
+		RunID:             "",
+		MaxFiles:          0,
+		MaxBytes:          "",
+		Shard:             "",
+		ShardFromEnv:      false,
+		Checkpoint:        "",
+		Journal:           "",
+		Plan:              "",
+		PlanKey:           "",
+		PlanSHA256:        "",
+		SinceSnapshot:     "",
+		Failed:            "",
+		ListReports:       "",
+		ListWebhook:       "",
+		Notify:            nil,
+		NotifyFailures:    10,
+		FilelistEncoding:  "auto",
+		Missing:           "",
+		FilelistStartLine: 0,
+		FilelistEndLine:   0,
+		Collisions:        "off",
+		SkipExisting:      false,
+		CheckProc:         8,
+		LargestFirst:      false,
+		StealLists:        false,
+		Heartbeat:         0,
+		StallAfter:        0,
+		DebugBundle:       "",
+		LogName:           "",
+		Oneshot:           false,
+		Systemd:           false,
+		LogSink:           "",
+		OTLP:              "",
+		TraceSample:       0.01,
+		StdoutLog:         "",
+		StderrLog:         "",
+		Log:               os.Stdout,
+		Stdout:            os.Stdout,
+		Stderr:            os.Stderr,
 	}
 
 	// load confFile if exists.
+	if confFile == "" {
+		return cfg, nil
+	}
 	f, err := os.Open(confFile)
 	if err != nil {
 		pathErr, ok := err.(*os.PathError)
@@ -112,15 +392,21 @@ func filesWalk(cfg *config, q chan string) error {
 				// if err := mkDestDir(cfg, path); err != nil {
 				// 	return err
 				// }
+				if cfg.LargestFirst {
+					return queueDir(path, q)
+				}
 				return nil
 			}
-			q <- path
+			if !cfg.LargestFirst {
+				q <- path
+			}
 			return nil
 		})
 }
 
 func filelistWalk(cfg *config, q chan string) error {
-	return filepath.Walk(cfg.ListDir,
+	var chunks []*chunk
+	err := filepath.Walk(cfg.ListDir,
 		func(path string, info os.FileInfo, err error) error {
 			if filepath.Ext(path) != cfg.FilelistExt {
 				// skip
@@ -130,153 +416,954 @@ func filelistWalk(cfg *config, q chan string) error {
 				}
 				return nil
 			}
-			f, err := os.Open(path)
-			if err != nil {
+			c, err := readFilelist(cfg, path)
+			if err != nil || c == nil {
 				return err
 			}
-			defer f.Close()
-
-			if cfg.Verbose {
-				cfg.Log.Write([]byte(fmt.Sprintf("filelist: %s\n", path)))
+			if cfg.StealLists {
+				// queued together when all are read.
+				chunks = append(chunks, c)
+				return nil
 			}
-
-			scanner := bufio.NewScanner(f)
-			for scanner.Scan() {
-				q <- filepath.Join(cfg.SrcDir, strings.TrimSpace(scanner.Text()))
+			for c.len() > 0 {
+				c.queue(cfg, q)
 			}
-			if err = scanner.Err(); err != nil {
-				return err
+			if cfg.lists != nil {
+				cfg.lists.walked(cfg, path)
 			}
 			return nil
 		})
+	if err != nil {
+		return err
+	}
+	if cfg.StealLists {
+		stealQueue(cfg, chunks, q)
+	}
+	return nil
 }
 
-func doVips(cfg *config, wg *sync.WaitGroup, q chan string) {
+// readFilelist reads the files of the filelist at path in the order to
+// queue them. it returns nil if the list is skipped.
+func readFilelist(cfg *config, path string) (*chunk, error) {
+	lines, err := readList(cfg, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Verbose {
+		cfg.Log.Write([]byte(fmt.Sprintf("filelist: %s\n", path)))
+	}
+
+	head := true
+	var d directives
+	var srcs []string
+	var ns []int
+	for i, line := range lines {
+		n := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		// "#" lines before the first file are directives or comments.
+		if head && strings.HasPrefix(line, "#") {
+			if err := d.parse(cfg, line); err != nil {
+				cfg.Log.Write([]byte(fmt.Sprintf(
+					"error: %s:%d: %s, skipping the list\n", path, n, err)))
+				return nil, nil
+			}
+			continue
+		}
+		if head && cfg.lists != nil {
+			cfg.lists.setDirectives(path, d)
+		}
+		head = false
+		if n < cfg.FilelistStartLine ||
+			(cfg.FilelistEndLine > 0 && n > cfg.FilelistEndLine) {
+			continue
+		}
+		srcs = append(srcs, filepath.Join(cfg.SrcDir, line))
+		ns = append(ns, n)
+	}
+	c := &chunk{list: path}
+	if cfg.LargestFirst {
+		for _, i := range largestFirst(srcs) {
+			c.srcs = append(c.srcs, srcs[i])
+			c.lines = append(c.lines, ns[i])
+		}
+	} else {
+		c.srcs, c.lines = srcs, ns
+	}
+	return c, nil
+}
+
+func doVips(cfg *config, st *state, wg *sync.WaitGroup, q chan string, id int) {
 	defer wg.Done()
+
+	w := &worker{id: id}
+	// pin child processes of this worker if necessary.
+	if sets := cpuSets(cfg); len(sets) > 0 {
+		w.cpuset = sets[id%len(sets)]
+	}
+	if ds := gpuDevices(cfg); len(ds) > 0 {
+		w.gpu = ds[id%len(ds)]
+	}
+
+	convs, err := converters(cfg)
+	if err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
+		st.abort(err.Error())
+		return
+	}
+
+	base := cfg
 	for {
-		src, ok := <-q
+		src, ok := st.next(q)
 		if !ok {
 			return
 		}
+		// settings reloaded apply from the next file.
+		if c := st.config(base); c != cfg {
+			cs, err := converters(c)
+			if err != nil {
+				cfg.Log.Write([]byte(fmt.Sprintf("error: reload: %s\n", err)))
+			} else {
+				cfg, convs, w.profiles = c, cs, nil
+			}
+		}
 
-		if filepath.Ext(src) != cfg.Ext {
-			if cfg.Verbose {
-				cfg.Log.Write([]byte(fmt.Sprintf("skip (ext): %s\n", src)))
+		r := &result{Src: src, Start: time.Now(), Tags: cfg.Tags}
+		if st.tracer != nil {
+			r.trace = st.tracer.file(src)
+		}
+		r.IDs = identify(cfg, src)
+		if cfg.lists != nil {
+			o, _ := cfg.lists.origin(src)
+			r.List, r.Line = o.list, o.line
+			r.Profile = cfg.lists.directives(o.list).profile
+		}
+		target := doFile(cfg, st, convs, w, r)
+		if st.hashes != nil {
+			st.hashes.drop(src)
+		}
+		if st.journal != nil && target && r.Dest != "" {
+			st.journal.finish(cfg, r)
+		}
+		if cfg.breaker != nil && target {
+			checkBreaker(cfg, st, r)
+		}
+		if st.tracer != nil && target {
+			st.tracer.finish(r)
+		}
+		if target {
+			r.Duration = time.Since(r.Start).Seconds()
+			st.record(r)
+			if cfg.Zip != "" && !cfg.DryRun && r.ok() && r.Dest != "" {
+				st.pack(src, r.Dest)
+			}
+			if (cfg.IIIF != "" || cfg.Mapping != "" || cfg.index != nil) &&
+				!cfg.DryRun && r.ok() && r.Dest != "" {
+				st.output(r)
+			}
+			if cfg.tar != nil && r.ok() && r.Dest != "" {
+				if err := cfg.tar.add(companions(cfg, r)); err != nil {
+					cfg.Log.Write([]byte(fmt.Sprintf("error: tar: %s\n", err)))
+					st.abort(err.Error())
+				}
 			}
-			continue
 		}
-		rel, err := filepath.Rel(cfg.SrcDir, src)
-		if err != nil {
-			cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
-			continue
+		if cfg.lists != nil {
+			cfg.lists.done(cfg, r, target)
 		}
-		dest := filepath.Join(cfg.DestDir, rel)
-		if cfg.Ext != ".jpg" {
-			dest = dest[0:len(dest)-4] + ".jpg"
+	}
+}
+
+// doFile converts r.Src and fills in r. it returns false if the file is not
+// a target.
+func doFile(cfg *config, st *state, convs []converter, w *worker,
+	r *result) bool {
+	src := r.Src
+	fail := func(err error) bool {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
+		if cfg.DebugBundle != "" && !cfg.DryRun {
+			if path, err := writeBundle(cfg, src, err); err != nil {
+				cfg.Log.Write([]byte(fmt.Sprintf("error: debug bundle: %s\n", err)))
+			} else {
+				cfg.Log.Write([]byte(fmt.Sprintf("info: debug bundle: %s\n", path)))
+			}
 		}
+		r.Class = st.fail(cfg, src, err)
+		r.Status = "failed"
+		r.Error = err.Error()
+		return true
+	}
 
+	if !matchExt(cfg, src) {
 		if cfg.Verbose {
-			cfg.Log.Write([]byte(fmt.Sprintf("%s -> %s\n", src, dest)))
+			cfg.Log.Write([]byte(fmt.Sprintf("skip (ext): %s\n", src)))
+		}
+		atomic.AddInt64(&st.skipped, 1)
+		return false
+	}
+	if r.List != "" {
+		if _, err := os.Stat(longPath(src)); os.IsNotExist(err) {
+			st.missing(cfg, r)
+			return true
+		}
+	}
+
+	if cfg.Animated != "" {
+		animated, err := isAnimated(cfg, src)
+		if err != nil {
+			return fail(err)
+		}
+		if animated && cfg.Animated == "skip" {
+			cfg.Log.Write([]byte(fmt.Sprintf("warning: skip (animated): %s\n",
+				src)))
+			atomic.AddInt64(&st.skipped, 1)
+			return false
+		} else if animated {
+			r.frames = cfg.Animated
+		}
+	}
+
+	var dest string
+	var err error
+	if e := st.planned[src]; e != nil {
+		dest = e.Dest
+	} else if d, ok := st.takeDest(src); ok {
+		dest = d
+	} else {
+		dest, err = listDest(cfg, st, src, r.List)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	r.Dest = dest
+
+	if cfg.Verbose {
+		cfg.Log.Write([]byte(fmt.Sprintf("%s -> %s\n", src, dest)))
+	}
+	r.Status = "converted"
+	if !cfg.DryRun {
+		if err := checkDest(cfg, dest); err != nil {
+			return fail(err)
 		}
-		if !cfg.DryRun {
-			os.MkdirAll(filepath.Dir(dest), 0755)
+		os.MkdirAll(longPath(filepath.Dir(dest)), 0755)
+		cfg.tmp.wait()
 
-			s := fmt.Sprintf(cfg.VipsFmt, src, dest)
-			cmd := exec.Command("sh", "-c", s)
-			cmd.Stdout = cfg.Stdout
-			cmd.Stderr = cfg.Stderr
-			if err := cmd.Run(); err != nil {
-				cfg.Log.Write([]byte(fmt.Sprintf("error: %s:\n  %s\n", s, err)))
+		ps := newPartials(dest)
+		st.begin(w.id, src, dest, ps)
+		if st.journal != nil {
+			st.journal.start(cfg, src, dest, ps)
+		}
+		// written anew, not through a hard link of it, e.g. to a master
+		// passed through.
+		os.Remove(longPath(dest))
+		start := time.Now()
+		err := convertFile(cfg, st, convs, w, r)
+		if err == nil && cfg.Layout == "cas" {
+			err = storeCAS(cfg, st, r)
+		}
+		if err == nil && cfg.Encrypt != "" {
+			err = encryptOutput(cfg, w, r)
+		}
+		if err == nil && cfg.up != nil {
+			up := time.Now()
+			err = cfg.up.upload(cfg, r)
+			r.trace.span("upload", up, err)
+		}
+		st.end(w.id)
+		if err != nil {
+			if r.Dest != dest {
+				// moved into the store or encrypted.
+				ps = append(ps, r.Dest)
 			}
+			removePartial(cfg, ps, start)
+			return fail(err)
 		}
 	}
+	atomic.AddInt64(&st.converted, 1)
+	return true
 }
 
-func exitOnError(err error) {
-	fmt.Println(err)
-	os.Exit(1)
+// convertFile converts r.Src into r.Dest along with the steps around it.
+func convertFile(cfg *config, st *state, convs []converter, w *worker,
+	r *result) error {
+	src, dest := r.Src, r.Dest
+	if e := st.planned[src]; e != nil {
+		r.Profile = e.Profile
+	} else if r.Profile == "" && len(cfg.Rules) > 0 {
+		var err error
+		if r.Profile, err = cfg.branch(src); err != nil {
+			return err
+		}
+	}
+	if r.Profile != "" && r.Profile != cfg.Profile {
+		var err error
+		if cfg, convs, err = w.converters(cfg, r.Profile); err != nil {
+			return err
+		}
+	}
+	if cfg.Generations {
+		r.ProfileKey = profileKey(cfg)
+		generation(st, r)
+		dest = r.Dest
+	}
+	// a source already as the profile would make it is taken as it is.
+	if cfg.PassThrough != "" {
+		ok, err := passThrough(cfg, src, dest)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if cfg.Verbose {
+				cfg.Log.Write([]byte(fmt.Sprintf("passed through: %s\n", src)))
+			}
+			atomic.AddInt64(&st.passed, 1)
+			r.Status = "passed-through"
+			return renditionsOnly(cfg, w, convs[0], r)
+		}
+	}
+	// hashing for provenance goes along with converting.
+	var hashed func() (string, error)
+	if cfg.CacheDir != "" || cfg.Provenance {
+		hashed = srcHash(st, src)
+	}
+	if cfg.CacheDir != "" {
+		h, err := hashed()
+		if err != nil {
+			return err
+		}
+		r.SrcHash = h
+	}
+
+	// reuse the output of the same source and profile.
+	var key string
+	if cfg.CacheDir != "" {
+		key = cacheKey(cfg, r.SrcHash)
+		ok, err := fromCache(cfg, key, dest)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if cfg.Verbose {
+				cfg.Log.Write([]byte(fmt.Sprintf("cached: %s\n", src)))
+			}
+			atomic.AddInt64(&st.cached, 1)
+			r.Status = "cached"
+			return renditionsOnly(cfg, w, convs[0], r)
+		}
+	}
+
+	done := cfg.slots.take(cfg, r.Profile)
+	start := time.Now()
+	conv := convs[0]
+	// the source fit for dest by -bit-depth and -alpha.
+	in, pre, clean, err := fitSource(cfg, w, src, r.frames, dest)
+	defer clean()
+	frames := r.frames
+	switch {
+	case err != nil:
+	case cfg.Renditions != "":
+		// and the other outputs from the same decode, cmd included.
+		err = convertRenditions(cfg, w, conv, r, in, frames,
+			renditionNames(cfg), true)
+	default:
+		conv, err = convert(cfg, convs, w, in, dest, frames)
+	}
+	done()
+	r.trace.span("convert", start, err)
+	r.Engine = conv.Name()
+	// as it can be run by hand, or the description of libvips.
+	if r.Cmd == "" {
+		in := in + framesSuffix(conv.Name(), frames)
+		if r.Cmd = shellCommand(cfg, w, conv, in, dest); r.Cmd == "" {
+			r.Cmd = conv.Command(in, dest)
+		}
+	}
+	r.Cmd = strings.Join(append(pre, r.Cmd), " && ")
+	if cfg.Premis != "" {
+		if err := writePremis(cfg, src, dest, r.Engine, err); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: premis: %s\n", err)))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if hashed != nil && r.SrcHash == "" {
+		h, err := hashed()
+		if err != nil {
+			return err
+		}
+		r.SrcHash = h
+	}
+	if cfg.QualityGate != "" || cfg.VerifyLossless {
+		start := time.Now()
+		err := verifyOutput(cfg, r)
+		r.trace.span("verify", start, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Sidecars != "" {
+		if err := copySidecars(cfg, src, dest); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: sidecar: %s\n", err)))
+		}
+	}
+	if len(cfg.Post) > 0 {
+		if err := postProcess(cfg, w, dest); err != nil {
+			return err
+		}
+	}
+	if cfg.Provenance {
+		if err := writeProvenance(cfg, r); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: provenance: %s\n", err)))
+		}
+	}
+	if key != "" {
+		if err := toCache(cfg, key, dest); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: cache: %s\n", err)))
+		}
+		cacheRenditions(cfg, r)
+	}
+	return nil
 }
 
-func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\nOptions:\n", os.Args[0])
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr,
-			"\n  *default values have been changed via config.json if exists.\n")
+// verifyOutput checks r.Dest against r.Src by -quality-gate and
+// -verify-lossless.
+func verifyOutput(cfg *config, r *result) error {
+	if cfg.QualityGate != "" {
+		if err := checkQuality(cfg, r.Src, r.Dest); err != nil {
+			return err
+		}
 	}
+	if cfg.VerifyLossless {
+		return verifyLossless(cfg, r)
+	}
+	return nil
+}
 
-	cfg, err := loadConfig()
+// matchExt reports whether path has one of the source file extensions.
+func matchExt(cfg *config, path string) bool {
+	return hasExt(path, strings.Split(cfg.Ext, ","))
+}
+
+// walk queues source files according to cfg.Type.
+func walk(cfg *config, q chan string) error {
+	if cfg.Type == "files" {
+		return filesWalk(cfg, q)
+	}
+	return filelistWalk(cfg, q)
+}
+
+// run starts workers and feeds them via enqueue until it returns.
+func run(cfg *config, st *state, enqueue func(q chan string) error) {
+	// prepare workers
+	var wg sync.WaitGroup
+	q := make(chan string)
+	wg.Add(cfg.Proc)
+	for i := 0; i < cfg.Proc; i++ {
+		go doVips(cfg, st, &wg, q, i)
+	}
+
+	// files whose destinations exist are dropped on the way to workers.
+	if cfg.SkipExisting {
+		workers := q
+		q = make(chan string)
+		go func() {
+			precheck(cfg, st, q, workers, cfg.CheckProc)
+			close(workers)
+		}()
+	}
+
+	if (cfg.CacheDir != "" || cfg.Provenance) && cfg.HashProc > 0 &&
+		!cfg.DryRun {
+		st.hashes = newHasher(cfg.HashProc)
+		defer st.hashes.close()
+	}
+
+	// do queuing through dispatch so that the run can be stopped.
+	in := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		dispatch(cfg, st, in, q)
+		close(done)
+	}()
+	start := time.Now()
+	err := enqueue(in)
+	if st.tracer != nil {
+		st.tracer.walk(start, err)
+	}
 	if err != nil {
-		exitOnError(err)
+		cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
 	}
+	close(in)
+	<-done
 
-	// update by commandline options.
-	flag.BoolVar(&cfg.DryRun, "t", cfg.DryRun, "dry run (test)")
-	flag.BoolVar(&cfg.Verbose, "v", cfg.DryRun, "verbose")
-	flag.BoolVar(&cfg.Save, "save", cfg.Save,
+	close(q)
+	wg.Wait()
+}
+
+// exitStatus prints err and returns the exit status of a failure.
+func exitStatus(err error) int {
+	fmt.Println(err)
+	return 1
+}
+
+// setFlags registers options common to all commands on fs.
+func setFlags(fs *flag.FlagSet, cfg *config) {
+	fs.BoolVar(&cfg.DryRun, "t", cfg.DryRun, "dry run (test)")
+	fs.BoolVar(&cfg.Verbose, "v", cfg.DryRun, "verbose")
+	fs.BoolVar(&cfg.Save, "save", cfg.Save,
 		"overwrite config.json with current config")
-	flag.IntVar(&cfg.Proc, "p", cfg.Proc, "concurrent processes")
-	flag.StringVar(&cfg.Type, "type", cfg.Type,
+	fs.IntVar(&cfg.Proc, "p", cfg.Proc, "concurrent processes")
+	fs.StringVar(&cfg.Type, "type", cfg.Type,
 		"type (\"files\" or \"filelist[.{ext}]\")")
-	flag.StringVar(&cfg.SrcDir, "s", cfg.SrcDir,
+	fs.StringVar(&cfg.SrcDir, "s", cfg.SrcDir,
 		"source dir (absolutive/relative)")
-	flag.StringVar(&cfg.DestDir, "d", cfg.DestDir,
-		"destination dir (absolutive/relative)")
-	flag.StringVar(&cfg.ListDir, "b", cfg.ListDir,
+	fs.StringVar(&cfg.DestDir, "d", cfg.DestDir,
+		"destination dir (absolutive/relative, \"-\" for a tar to stdout)")
+	fs.StringVar(&cfg.ListDir, "b", cfg.ListDir,
 		"filelist dir (absolutive/relative)")
-	flag.StringVar(&cfg.Ext, "e", cfg.Ext, "source file extention")
-	flag.StringVar(&cfg.VipsFmt, "f", cfg.VipsFmt,
+	fs.StringVar(&cfg.Ext, "e", cfg.Ext,
+		"source file extentions, comma separated and case insensitive "+
+			"(e.g. \".jpg,.jpeg\")")
+	fs.StringVar(&cfg.DestExt, "dest-ext", cfg.DestExt,
+		"extension of destination files (\"\" to keep the source one)")
+	fs.StringVar(&cfg.DestTemplate, "dest-template", cfg.DestTemplate,
+		"text/template of destination paths relative to -d, "+
+			"e.g. \"{{.Year}}/{{.Identifier}}/{{.Seq}}.tif\"")
+	fs.StringVar(&cfg.IDRegex, "id-regex", cfg.IDRegex,
+		"regexp with named groups matched against source paths relative "+
+			"to -s, giving {{.Vars.NAME}} of -dest-template and ids of results")
+	fs.StringVar(&cfg.Zip, "zip", cfg.Zip,
+		"package outputs of each source dir into a zip in -d, \"deflate\" "+
+			"or \"store\" for no compression (\"\" for none)")
+	fs.StringVar(&cfg.QualityGate, "quality-gate", cfg.QualityGate,
+		"fail outputs less similar to their sources scaled down than "+
+			"\"ssim:MIN\" or \"psnr:MIN\" (dB), e.g. \"ssim:0.9\"")
+	fs.BoolVar(&cfg.VerifyLossless, "verify-lossless", cfg.VerifyLossless,
+		"fail outputs whose decoded pixels differ from their sources, "+
+			"for lossless formats")
+	fs.StringVar(&cfg.IIIF, "iiif", cfg.IIIF,
+		"base url of a iiif image server serving -d to request regions and "+
+			"sizes of the outputs from after the run (\"\" not to)")
+	fs.StringVar(&cfg.Mapping, "mapping", cfg.Mapping,
+		"csv (.csv) or json file to write sources, their -id-regex ids, "+
+			"outputs and urls into after the run (\"\" not to)")
+	fs.StringVar(&cfg.MappingURL, "mapping-url", cfg.MappingURL,
+		"format of urls of -mapping with %s for the path of the output "+
+			"relative to -d escaped, e.g. \"https://iiif.example.org/iiif/2/"+
+			"%s/info.json\" (\"\" for those of -iiif)")
+	fs.StringVar(&cfg.Index, "index", cfg.Index,
+		"push documents of the outputs into \"solr:URL\" of a core or "+
+			"\"es:URL\" of an elasticsearch index after the run (\"\" not to)")
+	fs.StringVar(&cfg.IndexTemplate, "index-template", cfg.IndexTemplate,
+		"text/template file making the json document of an output for "+
+			"-index (\"\" for the default)")
+	fs.BoolVar(&cfg.Generations, "generations", cfg.Generations,
+		"write name.v2.tif etc. instead of overwriting outputs of other "+
+			"settings recorded in -results (see promote)")
+	fs.StringVar(&cfg.Encrypt, "encrypt", cfg.Encrypt,
+		"encrypt outputs for \"age:RECIPIENT,...\" or "+
+			"\"gpg:RECIPIENT,...\" adding .age or .gpg")
+	fs.StringVar(&cfg.Upload, "upload", cfg.Upload,
+		"http(s)://, az://ACCOUNT/CONTAINER or gs://BUCKET url to send "+
+			"each output to, followed by its path relative to -d")
+	fs.StringVar(&cfg.UploadMethod, "upload-method", cfg.UploadMethod,
+		"\"PUT\" or \"POST\"")
+	fs.Var(&cfg.UploadHeaders, "upload-header",
+		"header of uploads, e.g. \"Authorization: Bearer $TOKEN\" "+
+			"with environment variables expanded (repeatable)")
+	fs.IntVar(&cfg.UploadProc, "upload-proc", cfg.UploadProc,
+		"concurrent uploads (0 for -p)")
+	fs.StringVar(&cfg.Layout, "layout", cfg.Layout,
+		"spread outputs by their identifiers over \"pairtree\" or "+
+			"\"hash:N\" levels of hashed directories, or store them by their "+
+			"sha256 with \"cas\" (\"\" for none)")
+	fs.StringVar(&cfg.CASMap, "cas-map", cfg.CASMap,
+		"json lines mapping outputs to their objects of -layout cas "+
+			"(default DEST/cas.jsonl)")
+	fs.StringVar(&cfg.Engine, "engine", cfg.Engine,
+		"converter (\"vips\", \"libvips\", \"imagemagick\", "+
+			"\"graphicsmagick\", \"gpu\", \"thumbnail\" or \"steps\")")
+	fs.StringVar(&cfg.Profile, "profile", cfg.Profile,
+		"output profile defined in config.json (\"\" for top level settings)")
+	fs.StringVar(&cfg.Fallback, "fallback", cfg.Fallback,
+		"engines to retry with in order when conversion fails "+
+			"(comma separated, e.g. \"imagemagick\"; \"none\" for no fallback)")
+	fs.StringVar(&cfg.VipsFmt, "f", cfg.VipsFmt,
 		"vips command format for fmt.Sprintf with two args "+
 			"(src filename, dest filename)")
-	flag.StringVar(&cfg.LogName, "log", cfg.LogName,
+	fs.StringVar(&cfg.VipsStream, "vips-stream", cfg.VipsStream,
+		"pipe sources into vips as stdin (\"in\"), write outputs from its "+
+			"stdout given as e.g. .tif (\"out\"), or \"both\" (\"\" for files)")
+	fs.StringVar(&cfg.IMFmt, "im-fmt", cfg.IMFmt,
+		"ImageMagick command format (same args as -f)")
+	fs.StringVar(&cfg.GMFmt, "gm-fmt", cfg.GMFmt,
+		"GraphicsMagick command format (same args as -f)")
+	fs.StringVar(&cfg.NativeOpts, "native-opts", cfg.NativeOpts,
+		"save options appended to dest filename for the libvips engine")
+	fs.StringVar(&cfg.ThumbFmt, "thumb-fmt", cfg.ThumbFmt,
+		"vipsthumbnail command format of the thumbnail engine (same args "+
+			"as -f, the dest made absolute)")
+	fs.StringVar(&cfg.Renditions, "renditions", cfg.Renditions,
+		"profiles to save a source in besides the output, decoding it once "+
+			"with the libvips engine (comma separated)")
+	fs.StringVar(&cfg.Animated, "animated", cfg.Animated,
+		"for animated gif and webp sources: convert the \"first\" frame, "+
+			"all frames as \"pages\", or \"skip\" them with a warning "+
+			"(\"\" as the engine does)")
+	fs.StringVar(&cfg.BitDepth, "bit-depth", cfg.BitDepth,
+		"for sources of more than 8 bits a sample: \"keep\" them, failing "+
+			"for jpeg, webp and gif, or scale them to \"8\" bits "+
+			"(\"\" as the engine does)")
+	fs.StringVar(&cfg.DepthMethod, "depth-method", cfg.DepthMethod,
+		"how -bit-depth 8 scales: \"shift\" the full range, \"scale\" "+
+			"the range used, or by \"colourspace\"")
+	fs.StringVar(&cfg.Alpha, "alpha", cfg.Alpha,
+		"for sources with alpha: \"keep\" it, failing for jpeg, "+
+			"\"flatten:#rrggbb\" it on the colour, or \"error\" "+
+			"(\"\" as the engine does)")
+	fs.StringVar(&cfg.GPUFmt, "gpu-fmt", cfg.GPUFmt,
+		"GPU tool command format (same args as -f), "+
+			"falling back to vips unless -fallback is set")
+	fs.StringVar(&cfg.GPUs, "gpus", cfg.GPUs,
+		"GPU device ids set as CUDA_VISIBLE_DEVICES, assigned to workers "+
+			"in turn (e.g. \"0,1\")")
+	fs.StringVar(&cfg.VipsCheck, "vips-check", cfg.VipsCheck,
+		"on missing vips or an unsupported operation: \"warn\", \"fail\" or \"off\"")
+	fs.BoolVar(&cfg.VipsTranslate, "vips-translate", cfg.VipsTranslate,
+		"translate im_* and new vips syntax to what installed vips supports")
+	fs.StringVar(&cfg.CPUSet, "cpuset", cfg.CPUSet,
+		"cpu lists for taskset separated by \"/\", assigned to workers "+
+			"in turn (e.g. \"0-7/8-15\")")
+	fs.IntVar(&cfg.VipsConcurrency, "vips-concurrency", cfg.VipsConcurrency,
+		"VIPS_CONCURRENCY for each vips process (0 to inherit)")
+	fs.StringVar(&cfg.VipsDiscThreshold, "vips-disc-threshold",
+		cfg.VipsDiscThreshold,
+		"VIPS_DISC_THRESHOLD for each vips process, e.g. \"1G\" "+
+			"(\"\" to inherit)")
+	fs.BoolVar(&cfg.IsolateEnv, "isolate-env", cfg.IsolateEnv,
+		"start converter processes with only the variables of -env-pass "+
+			"and -env, not the whole environment")
+	fs.StringVar(&cfg.EnvPass, "env-pass", cfg.EnvPass,
+		"variables passed to converter processes with -isolate-env "+
+			"(comma separated)")
+	fs.Var(&cfg.Env, "env",
+		"set KEY=VALUE for converter processes (repeatable)")
+	fs.StringVar(&cfg.MemBudget, "mem-budget", cfg.MemBudget,
+		"memory for all workers, e.g. \"16G\", to tune vips settings "+
+			"left unset")
+	fs.IntVar(&cfg.Sample, "sample", cfg.Sample,
+		"convert only N sampled files into the sample dir (0 to disable)")
+	fs.Float64Var(&cfg.SamplePercent, "sample-percent", cfg.SamplePercent,
+		"convert only P percent of files into the sample dir (0 to disable)")
+	fs.StringVar(&cfg.SampleStrategy, "sample-strategy", cfg.SampleStrategy,
+		"sampling strategy (\"random\" or \"stratified\" by directory)")
+	fs.Int64Var(&cfg.SampleSeed, "sample-seed", cfg.SampleSeed,
+		"random seed for sampling (0 to use current time)")
+	fs.StringVar(&cfg.SampleDir, "sample-dir", cfg.SampleDir,
+		"destination dir for sampled runs (absolutive/relative)")
+	fs.IntVar(&cfg.Limit, "limit", cfg.Limit,
+		"convert only the first N files (0 for all)")
+	fs.IntVar(&cfg.MaxFiles, "max-files", cfg.MaxFiles,
+		"stop cleanly after N files, e.g. for nightly windows (0 for no quota)")
+	fs.StringVar(&cfg.MaxBytes, "max-bytes", cfg.MaxBytes,
+		"stop cleanly after sources of this size, e.g. \"500G\" "+
+			"(\"\" for no quota)")
+	fs.StringVar(&cfg.Plan, "plan", cfg.Plan,
+		"convert exactly the files of a plan file written by "+
+			"\"plan -format json\"")
+	fs.StringVar(&cfg.PlanKey, "plan-key", cfg.PlanKey,
+		"public key the plan file must be signed with (\"\" not to verify)")
+	fs.StringVar(&cfg.PlanSHA256, "plan-sha256", cfg.PlanSHA256,
+		"sha256 the plan file must have (\"\" not to verify)")
+	fs.StringVar(&cfg.SinceSnapshot, "since-snapshot", cfg.SinceSnapshot,
+		"convert only files new or changed since the snapshot file "+
+			"(\"\" for all)")
+	fs.StringVar(&cfg.Failed, "failed", cfg.Failed,
+		"convert again only files failed in this results file into the "+
+			"same dests (\"\" for all)")
+	fs.StringVar(&cfg.Collisions, "collisions", cfg.Collisions,
+		"on sources sharing a destination found by planning before the run: "+
+			"\"warn\", \"fail\" or \"off\" not to plan (plan always warns)")
+	fs.StringVar(&cfg.Journal, "journal", cfg.Journal,
+		"record files before and after converting them to this file, so "+
+			"that those in flight when the process dies are cleaned up and "+
+			"converted first by the next run (\"\" for none)")
+	fs.StringVar(&cfg.Shard, "shard", cfg.Shard,
+		"convert only part I of N of the sources by \"I/N\", I from 0, "+
+			"e.g. for processes on several hosts (\"\" for all)")
+	fs.BoolVar(&cfg.ShardFromEnv, "shard-from-env", cfg.ShardFromEnv,
+		"take -shard from JOB_COMPLETION_INDEX and JOB_COMPLETIONS, e.g. "+
+			"of an indexed Kubernetes Job, or the like")
+	fs.StringVar(&cfg.Checkpoint, "checkpoint", cfg.Checkpoint,
+		"file recording where a stopped run was, to resume from there "+
+			"(\"\" not to record)")
+	fs.IntVar(&cfg.StopAfterErrors, "stop-after-errors", cfg.StopAfterErrors,
+		"abort the run after N errors (0 never to abort)")
+	fs.StringVar(&cfg.HTTPAddr, "http", cfg.HTTPAddr,
+		"address to serve the dashboard on (e.g. \":8080\" on localhost, "+
+			"\"0.0.0.0:8080\" on all, \"\" to disable)")
+	fs.StringVar(&cfg.HTTPToken, "http-token", cfg.HTTPToken,
+		"token the dashboard requires, as \"Authorization: Bearer TOKEN\" "+
+			"or \"?token=TOKEN\" (\"\" for none)")
+	setTLSFlags(fs, cfg)
+	fs.BoolVar(&cfg.TUI, "tui", cfg.TUI,
+		"show workers, failures and rates on the terminal instead of logs "+
+			"(keys: p pause/resume, d drain)")
+	fs.StringVar(&cfg.ControlSock, "control", cfg.ControlSock,
+		"unix socket accepting pause/resume/drain/status (\"\" to disable)")
+	fs.StringVar(&cfg.Audit, "audit", cfg.Audit,
+		"json lines file to append control actions to with who took them "+
+			"(\"\" for none)")
+	fs.StringVar(&cfg.PriorityList, "priority", cfg.PriorityList,
+		"filelist converted ahead of the others (\"\" for none)")
+	fs.Var(&cfg.Tags, "tag",
+		"tag the run as key=value in logs and reports (repeatable)")
+	fs.BoolVar(&cfg.DestRunSubdir, "dest-run-subdir", cfg.DestRunSubdir,
+		"put outputs under a subdir of the destination dir named after "+
+			"the run ID")
+	fs.StringVar(&cfg.RunID, "run-id", cfg.RunID,
+		"run ID (default: the \"run\" tag or the start time)")
+	fs.StringVar(&cfg.FilelistEncoding, "filelist-encoding",
+		cfg.FilelistEncoding,
+		"encoding of filelists (\"auto\", \"utf-8\", \"shift_jis\", "+
+			"\"utf-16le\" or \"utf-16be\")")
+	fs.IntVar(&cfg.FilelistStartLine, "filelist-start-line",
+		cfg.FilelistStartLine,
+		"process filelists from this line on, counting from 1 (0 for all)")
+	fs.IntVar(&cfg.FilelistEndLine, "filelist-end-line", cfg.FilelistEndLine,
+		"process filelists up to this line (0 for all)")
+	fs.StringVar(&cfg.Missing, "missing", cfg.Missing,
+		"file to list filelist entries without sources in, with the list "+
+			"and line (\"\" not to write)")
+	fs.StringVar(&cfg.ListReports, "list-reports", cfg.ListReports,
+		"dir to write a summary with failures of each filelist to "+
+			"(\"\" not to write)")
+	fs.StringVar(&cfg.Breaker, "breaker", cfg.Breaker,
+		"pause the run when more than \"PCT%/FILES\" of the last files "+
+			"have failed, e.g. \"50%/20\", until resumed by ctl or the "+
+			"dashboard (\"\" for none)")
+	fs.Var(&cfg.Notify, "notify",
+		"\"[EVENT,...=]KIND:URL\" to notify of events start, end, "+
+			"failures and breaker (all by default) by KIND webhook, slack, "+
+			"teams or email (smtp://[USER@]HOST:PORT?from=ADDR&to=ADDR,...) "+
+			"(repeatable)")
+	fs.IntVar(&cfg.NotifyFailures, "notify-failures", cfg.NotifyFailures,
+		"number of failed files to notify of")
+	fs.StringVar(&cfg.ListWebhook, "list-webhook", cfg.ListWebhook,
+		"URL to post the summary of each filelist to (\"\" not to post)")
+	fs.StringVar(&cfg.Manifest, "manifest", cfg.Manifest,
+		"run manifest file for provenance (\"\" not to write)")
+	fs.StringVar(&cfg.Premis, "premis", cfg.Premis,
+		"write a PREMIS event per file next to it (\"xml\", \"json\" or \"\")")
+	fs.StringVar(&cfg.Sidecars, "copy-sidecars", cfg.Sidecars,
+		"extensions of metadata files next to sources to copy "+
+			"(comma separated, e.g. \".xml,.json\")")
+	fs.StringVar(&cfg.SidecarFmt, "sidecar-fmt", cfg.SidecarFmt,
+		"sidecar name format for fmt.Sprintf with two args "+
+			"(dest filename without ext, sidecar ext)")
+	fs.BoolVar(&cfg.Flatten, "flatten", cfg.Flatten,
+		"put all outputs directly in the dest dir joining subdirs with \"_\"")
+	fs.Var(&cfg.Rewrites, "rewrite",
+		"rewrite relative dest paths by s|regexp|replacement| (repeatable)")
+	fs.StringVar(&cfg.Normalize, "normalize", cfg.Normalize,
+		"unicode normalization of dest names (\"nfc\" or \"none\")")
+	fs.StringVar(&cfg.Transliterate, "transliterate", cfg.Transliterate,
+		"write dest names in ascii by the rules of \"latin\", \"de\", "+
+			"\"da\" or \"ja\" (\"\" not to)")
+	fs.StringVar(&cfg.TransliterateMap, "transliterate-map",
+		cfg.TransliterateMap, "file to keep transliterated names and "+
+			"their names in (default transliteration.json in -d)")
+	fs.BoolVar(&cfg.Renumber, "renumber", cfg.Renumber,
+		"rename outputs to sequence numbers per directory in natural order")
+	fs.IntVar(&cfg.RenumberWidth, "renumber-width", cfg.RenumberWidth,
+		"zero padded width of sequence numbers")
+	fs.StringVar(&cfg.TmpDir, "tmp-dir", cfg.TmpDir,
+		"base dir for temporary files (\"\" to use the system default)")
+	fs.StringVar(&cfg.TmpMax, "tmp-max", cfg.TmpMax,
+		"size cap of temporary files, e.g. \"20G\" (\"\" for no cap)")
+	fs.StringVar(&cfg.MinFree, "min-free", cfg.MinFree,
+		"pause while free space of the dest dir is below this, e.g. \"10G\" "+
+			"(\"\" not to check)")
+	fs.BoolVar(&cfg.Watch, "watch", cfg.Watch,
+		"keep polling the source dir for new files until drained (files type)")
+	fs.DurationVar(&cfg.WatchInterval, "watch-interval", cfg.WatchInterval,
+		"polling interval of -watch")
+	fs.DurationVar(&cfg.WatchStable, "watch-stable", cfg.WatchStable,
+		"time files must keep their size and mtime before converted in -watch")
+	fs.DurationVar(&cfg.WatchQuiet, "watch-quiet", cfg.WatchQuiet,
+		"time no file in a directory may change before its files are "+
+			"converted in -watch (0 not to wait)")
+	fs.StringVar(&cfg.WatchMarker, "watch-marker", cfg.WatchMarker,
+		"file marking a delivery complete, e.g. \"DONE.txt\", required in "+
+			"the directory or a parent before converting in -watch")
+	fs.StringVar(&cfg.CacheDir, "cache-dir", cfg.CacheDir,
+		"reuse outputs cached by source hash and profile (\"\" not to cache)")
+	fs.StringVar(&cfg.PassThrough, "pass-through", cfg.PassThrough,
+		"put sources of the destination extension matching this condition "+
+			"as of rules at their destinations without converting, e.g. "+
+			"\"width <= 10000 and coding == none\" (\"\" never to)")
+	fs.StringVar(&cfg.PassThroughBy, "pass-through-by", cfg.PassThroughBy,
+		"how to put sources of -pass-through: \"reflink\", \"copy\" or "+
+			"\"link\" (hard link, sharing the file with the source), "+
+			"falling back to copies")
+	fs.StringVar(&cfg.Results, "results", cfg.Results,
+		"append per file results as NDJSON to this file (\"\" not to write)")
+	fs.StringVar(&cfg.EmitScript, "emit-script", cfg.EmitScript,
+		"write the command of each file into this sh script to run by hand "+
+			"(\"\" not to write)")
+	fs.BoolVar(&cfg.Provenance, "provenance", cfg.Provenance,
+		"write a provenance sidecar {dest}.json next to each output")
+	fs.IntVar(&cfg.HashProc, "hash-proc", cfg.HashProc,
+		"workers hashing sources along with conversion "+
+			"(0 to hash in conversion workers)")
+	fs.BoolVar(&cfg.LargestFirst, "largest-first", cfg.LargestFirst,
+		"queue the largest files of each directory first")
+	fs.BoolVar(&cfg.StealLists, "steal-lists", cfg.StealLists,
+		"queue filelists side by side, one per worker, letting workers "+
+			"done with theirs take over files of the longest ones left")
+	fs.BoolVar(&cfg.SkipExisting, "skip-existing", cfg.SkipExisting,
+		"skip files whose destinations exist, e.g. to resume a run")
+	fs.IntVar(&cfg.CheckProc, "check-proc", cfg.CheckProc,
+		"workers looking for existing destinations of -skip-existing")
+	fs.Var(&cfg.Post, "post",
+		"command format run on each output for fmt.Sprintf with one arg "+
+			"(dest filename), e.g. \"exiftool -Artist=X %s\" (repeatable)")
+	fs.StringVar(&cfg.DebugBundle, "debug-bundle", cfg.DebugBundle,
+		"dir to write a tar.gz of the command, environment, vips version, "+
+			"source header and stderr of each failed file into, e.g. for "+
+			"vips bug reports (\"\" for none)")
+	fs.DurationVar(&cfg.Heartbeat, "heartbeat", cfg.Heartbeat,
+		"log the file of each worker and how long it has taken every "+
+			"duration (0 for none)")
+	fs.DurationVar(&cfg.StallAfter, "stall-after", cfg.StallAfter,
+		"warn of a file converted longer than this (0 for none)")
+	fs.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout,
+		"kill conversion and post commands running longer (0 for no limit)")
+	fs.IntVar(&cfg.Retries, "retries", cfg.Retries,
+		"retries of failed conversion, post commands and uploads")
+	fs.StringVar(&cfg.LogName, "log", cfg.LogName,
 		"log file name (\"\" to use stdout)")
-	flag.StringVar(&cfg.StdoutLog, "stdout", cfg.StdoutLog,
+	fs.BoolVar(&cfg.Oneshot, "oneshot", cfg.Oneshot,
+		"run once in a container: no config.json but options from "+
+			"IMCONVVIPS_<OPTION> variables, json logs to stdout, nothing "+
+			"saved or asked, and exit 1 if a file fails")
+	fs.BoolVar(&cfg.Systemd, "systemd", cfg.Systemd,
+		"run as a systemd notify service: tell readiness and ping the "+
+			"watchdog, and reload the settings on SIGHUP")
+	fs.StringVar(&cfg.OTLP, "otlp", cfg.OTLP,
+		"OTLP/HTTP endpoint to send OpenTelemetry traces of the walk and "+
+			"files to, e.g. \"http://localhost:4318\" (\"\" for none)")
+	fs.Float64Var(&cfg.TraceSample, "trace-sample", cfg.TraceSample,
+		"ratio of files to trace")
+	fs.StringVar(&cfg.LogSink, "log-sink", cfg.LogSink,
+		"log to \"syslog\" of the host, \"syslog://HOST:PORT\" by udp, "+
+			"\"syslog+tcp://HOST:PORT\" or \"journald\" instead of stdout "+
+			"(\"\" for none)")
+	fs.StringVar(&cfg.StdoutLog, "stdout", cfg.StdoutLog,
 		"stdout logfile of vips (\"\" to use stdout)")
-	flag.StringVar(&cfg.StderrLog, "stderr", cfg.StderrLog,
+	fs.StringVar(&cfg.StderrLog, "stderr", cfg.StderrLog,
 		"stderr logfile of vips (\"\" to use stderr)")
-	flag.Parse()
+}
+
+// setup applies parsed options to cfg and opens log files.
+// the returned function closes them.
+func setup(cfg *config) (func(), error) {
+	var files []io.Closer
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		if cfg.tmp != nil {
+			cfg.tmp.remove()
+		}
+	}
 
-	// after parsing args
 	if cfg.DryRun {
 		cfg.Verbose = true
 	}
+	// stdout is for the tar of outputs with -d -.
+	out := os.Stdout
+	if cfg.DestDir == "-" {
+		out = os.Stderr
+		if cfg.StdoutLog == "" {
+			cfg.Stdout = out
+		}
+	}
+	if cfg.Oneshot {
+		// stdout is for json log lines, and nothing is saved or asked.
+		if cfg.StdoutLog == "" {
+			cfg.Stdout = os.Stderr
+		}
+		cfg.Save = false
+		cfg.TUI = false
+	}
+	// a sink of the host takes the log instead of the terminal.
+	var log io.Writer = out
+	if cfg.Oneshot {
+		log = &jsonLog{w: out}
+	}
+	if cfg.LogSink != "" {
+		sink, err := newLogSink(cfg, cfg.LogSink)
+		if err != nil {
+			return closeAll, err
+		}
+		files = append(files, sink)
+		log = sink
+	}
 	if cfg.LogName != "" {
 		logfile, err := os.Create(cfg.LogName)
 		if err != nil {
-			exitOnError(err)
+			return closeAll, err
 		}
-		defer logfile.Close()
-		cfg.Log = io.MultiWriter(os.Stdout, logfile)
+		files = append(files, logfile)
+		cfg.Log = io.MultiWriter(log, logfile)
 	} else {
-		cfg.Log = os.Stdout
+		cfg.Log = log
 	}
 	if cfg.StdoutLog != "" {
-		cfg.Stdout, err = os.Create(cfg.StdoutLog)
+		f, err := os.Create(cfg.StdoutLog)
 		if err != nil {
-			exitOnError(err)
+			return closeAll, err
 		}
-		defer cfg.Stdout.(*os.File).Close()
+		files = append(files, f)
+		cfg.Stdout = f
 	}
 	if cfg.StderrLog != "" {
-		cfg.Stderr, err = os.Create(cfg.StderrLog)
+		f, err := os.Create(cfg.StderrLog)
 		if err != nil {
-			exitOnError(err)
+			return closeAll, err
 		}
-		defer cfg.Stderr.(*os.File).Close()
+		files = append(files, f)
+		cfg.Stderr = f
 	}
 	if cfg.Type != "files" {
-		if cfg.Type[0:8] != "filelist" {
-			exitOnError(errors.New(
-				"type must be \"files\" or \"filelist[.{ext}]\""))
-		} else {
-			cfg.FilelistExt = cfg.Type[8:]
+		if !strings.HasPrefix(cfg.Type, "filelist") {
+			return closeAll, errors.New(
+				"type must be \"files\" or \"filelist[.{ext}]\"")
+		}
+		cfg.FilelistExt = cfg.Type[8:]
+		cfg.lists = newListSet()
+		if cfg.FilelistEndLine > 0 &&
+			cfg.FilelistEndLine < cfg.FilelistStartLine {
+			return closeAll, errors.New("filelist-end-line is before the start line")
+		}
+		switch cfg.FilelistEncoding {
+		case "auto", "utf-8", "shift_jis", "utf-16le", "utf-16be":
+		default:
+			return closeAll, fmt.Errorf("unknown filelist encoding: %s",
+				cfg.FilelistEncoding)
 		}
 	}
 
 	// save conf if necessary.
 	if cfg.Save {
-		if err = saveConfig(cfg); err != nil {
-			exitOnError(err)
+		if err := saveConfig(cfg); err != nil {
+			return closeAll, err
 		}
 	}
 
@@ -284,31 +1371,770 @@ func main() {
 	cfg.SrcDir = filepath.FromSlash(cfg.SrcDir)
 	cfg.DestDir = filepath.FromSlash(cfg.DestDir)
 	cfg.ListDir = filepath.FromSlash(cfg.ListDir)
+	cfg.SampleDir = filepath.FromSlash(cfg.SampleDir)
+
+	// apply the profile without saving.
+	if cfg.Profile != "" {
+		pc, err := cfg.withProfile(cfg.Profile)
+		if err != nil {
+			return closeAll, err
+		}
+		*cfg = *pc
+	}
+
+	if cfg.Watch && cfg.Type != "files" {
+		return closeAll, errors.New("watch works only with type \"files\"")
+	}
+	if cfg.sampling() {
+		if cfg.SampleStrategy != "random" && cfg.SampleStrategy != "stratified" {
+			return closeAll, errors.New(
+				"sample-strategy must be \"random\" or \"stratified\"")
+		}
+		// never write samples over the real destination.
+		cfg.DestDir = cfg.SampleDir
+	}
+	max, err := parseSize(cfg.MaxBytes)
+	if err != nil {
+		return closeAll, err
+	}
+	cfg.maxBytes = max
+	if cfg.Plan != "" && (cfg.Watch || cfg.sampling()) {
+		return closeAll, errors.New("plan does not work with watch or sampling")
+	}
+	if cfg.IIIF != "" {
+		switch {
+		case !strings.HasPrefix(cfg.IIIF, "http://") &&
+			!strings.HasPrefix(cfg.IIIF, "https://"):
+			return closeAll, errors.New("iiif must be an http(s) url")
+		case cfg.Zip != "" || cfg.DestDir == "-" || cfg.Encrypt != "" ||
+			cfg.Layout == "cas":
+			return closeAll, errors.New("iiif does not work with zip, a tar " +
+				"to stdout, encrypt or layout cas")
+		}
+	}
+	if cfg.MappingURL != "" && strings.Count(cfg.MappingURL, "%s") != 1 {
+		return closeAll, errors.New("mapping-url must have a %s")
+	}
+	if cfg.Index != "" {
+		if cfg.index, err = newIndexer(cfg); err != nil {
+			return closeAll, err
+		}
+	}
+	if cfg.SinceSnapshot != "" &&
+		(cfg.Watch || cfg.sampling() || cfg.Plan != "") {
+		return closeAll, errors.New(
+			"since-snapshot does not work with watch, sampling or plan")
+	}
+	if cfg.Failed != "" && (cfg.Watch || cfg.sampling() || cfg.Plan != "" ||
+		cfg.SinceSnapshot != "") {
+		return closeAll, errors.New("failed does not work with watch, " +
+			"sampling, plan or since-snapshot")
+	}
+	switch cfg.Collisions {
+	case "off", "warn", "fail":
+	default:
+		return closeAll, errors.New(
+			"collisions must be \"warn\", \"fail\" or \"off\"")
+	}
+	if cfg.Checkpoint != "" && (cfg.Watch || cfg.sampling()) {
+		return closeAll, errors.New("checkpoint does not work with watch or sampling")
+	}
+	if cfg.DestRunSubdir {
+		if cfg.RunID == "" {
+			cfg.RunID = cfg.Tags["run"]
+		}
+		if cfg.RunID == "" {
+			cfg.RunID = time.Now().Format("20060102-150405")
+		}
+		if strings.ContainsAny(cfg.RunID, `/\`) || cfg.RunID == ".." {
+			return closeAll, fmt.Errorf("invalid run ID: %q", cfg.RunID)
+		}
+		cfg.DestDir = filepath.Join(cfg.DestDir, cfg.RunID)
+		cfg.Log.Write([]byte(fmt.Sprintf("info: destination: %s\n", cfg.DestDir)))
+	}
+
+	if _, err := converters(cfg); err != nil {
+		return closeAll, err
+	}
+	for _, r := range cfg.Rules {
+		if r.Profile != "" {
+			if _, err := cfg.withProfile(r.Profile); err != nil {
+				return closeAll, err
+			}
+		}
+		c, err := parseCond(r.If)
+		if err != nil {
+			return closeAll, err
+		}
+		cfg.conds = append(cfg.conds, c)
+	}
+	if _, err := parseCond(cfg.PassThrough); err != nil {
+		return closeAll, err
+	}
+	for _, p := range cfg.Profiles {
+		if _, err := parseCond(p.PassThrough); err != nil {
+			return closeAll, err
+		}
+	}
+	switch cfg.PassThroughBy {
+	case "link", "reflink", "copy":
+	default:
+		return closeAll, errors.New(
+			"pass-through-by must be \"link\", \"reflink\" or \"copy\"")
+	}
+	if err := tuneMemory(cfg); err != nil {
+		return closeAll, err
+	}
+	if cfg.slots, err = newSlots(cfg); err != nil {
+		return closeAll, err
+	}
+	if cfg.Renditions != "" {
+		if err := checkRenditions(cfg); err != nil {
+			return closeAll, err
+		}
+		if cfg.Zip != "" || cfg.DestDir == "-" || cfg.Layout == "cas" {
+			return closeAll, errors.New("renditions cannot be used with " +
+				"zip, a tar to stdout or cas layout")
+		}
+	}
+	for _, kv := range cfg.Env {
+		if i := strings.Index(kv, "="); i < 1 {
+			return closeAll, fmt.Errorf("env must be KEY=VALUE: %q", kv)
+		}
+	}
+	if cfg.Normalize != "nfc" && cfg.Normalize != "none" {
+		return closeAll, errors.New("normalize must be \"nfc\" or \"none\"")
+	}
+	if _, ok := translitLangs[cfg.Transliterate]; !ok &&
+		cfg.Transliterate != "" {
+		return closeAll, errors.New(
+			"transliterate must be \"latin\", \"de\", \"da\" or \"ja\"")
+	}
+	for _, s := range cfg.Rewrites {
+		rw, err := parseRewrite(s)
+		if err != nil {
+			return closeAll, err
+		}
+		cfg.rewrites = append(cfg.rewrites, rw)
+	}
+	if cfg.IDRegex != "" {
+		re, err := parseIDRegex(cfg.IDRegex)
+		if err != nil {
+			return closeAll, err
+		}
+		cfg.idRe = re
+	}
+	if cfg.Zip != "" && cfg.Zip != "deflate" && cfg.Zip != "store" {
+		return closeAll, errors.New("zip must be \"deflate\", \"store\" or \"\"")
+	}
+	switch cfg.VipsStream {
+	case "", "in", "out", "both":
+	default:
+		return closeAll, errors.New(
+			"vips-stream must be \"in\", \"out\", \"both\" or \"\"")
+	}
+	if cfg.BitDepth != "" && cfg.BitDepth != "keep" && cfg.BitDepth != "8" {
+		return closeAll, errors.New("bit-depth must be \"keep\", \"8\" or \"\"")
+	}
+	for _, p := range cfg.Profiles {
+		if p.BitDepth != "" && p.BitDepth != "keep" && p.BitDepth != "8" {
+			return closeAll, errors.New(
+				"bit_depth of profiles must be \"keep\", \"8\" or \"\"")
+		}
+	}
+	if _, ok := depthMethods[cfg.DepthMethod]; !ok {
+		return closeAll, errors.New(
+			"depth-method must be \"shift\", \"scale\" or \"colourspace\"")
+	}
+	if _, err := parseAlpha(cfg.Alpha); err != nil {
+		return closeAll, err
+	}
+	for name, p := range cfg.Profiles {
+		if _, err := parseAlpha(p.Alpha); err != nil {
+			return closeAll, fmt.Errorf("profile %s: %s", name, err)
+		}
+	}
+	switch cfg.Animated {
+	case "", "skip":
+	case "first", "pages":
+		if cfg.VipsStream == "in" || cfg.VipsStream == "both" {
+			return closeAll, errors.New("animated \"first\" or \"pages\" " +
+				"cannot be used with sources streamed")
+		}
+	default:
+		return closeAll, errors.New(
+			"animated must be \"first\", \"pages\", \"skip\" or \"\"")
+	}
+	if cfg.QualityGate != "" {
+		if _, _, err := parseQualityGate(cfg.QualityGate); err != nil {
+			return closeAll, err
+		}
+	}
+	if cfg.Encrypt != "" {
+		if _, _, err := parseEncrypt(cfg.Encrypt); err != nil {
+			return closeAll, err
+		}
+	}
+	if cfg.OTLP != "" && (cfg.TraceSample <= 0 || cfg.TraceSample > 1) {
+		return closeAll, errors.New("trace-sample must be in (0, 1]")
+	}
+	if cfg.ShardFromEnv {
+		if cfg.Shard, err = shardFromEnv(); err != nil {
+			return closeAll, fmt.Errorf("shard from env: %s", err)
+		}
+	}
+	if cfg.Shard != "" {
+		if cfg.shard, err = parseShard(cfg.Shard); err != nil {
+			return closeAll, err
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("info: shard %d of %d\n",
+			cfg.shard.i, cfg.shard.n)))
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSClientCA != "" {
+		if cfg.tls, err = tlsConfig(cfg); err != nil {
+			return closeAll, err
+		}
+	}
+	if cfg.Audit != "" {
+		if cfg.audit, err = openAudit(cfg); err != nil {
+			return closeAll, err
+		}
+		files = append(files, cfg.audit)
+	}
+	if cfg.Breaker != "" {
+		if cfg.breaker, err = parseBreaker(cfg.Breaker); err != nil {
+			return closeAll, err
+		}
+	}
+	if len(cfg.Notify) > 0 {
+		if cfg.notify, err = newNotifiers(cfg.Notify); err != nil {
+			return closeAll, err
+		}
+	}
+	if cfg.Upload != "" {
+		if cfg.up, err = newUploader(cfg); err != nil {
+			return closeAll, err
+		}
+	}
+	if cfg.SkipExisting {
+		switch {
+		case cfg.CheckProc < 1:
+			return closeAll, errors.New("check-proc must be positive")
+		case cfg.Zip != "" || cfg.DestDir == "-" || cfg.Layout == "cas" ||
+			cfg.Encrypt != "" || cfg.Generations:
+			return closeAll, errors.New("skip-existing cannot be used with " +
+				"zip, a tar to stdout, cas layout, encrypt or generations")
+		}
+	}
+	if cfg.Zip != "" && cfg.DestDir == "-" {
+		return closeAll, errors.New("zip cannot be used with a tar to stdout")
+	}
+	if _, err := parseLayout(cfg.Layout); err != nil {
+		return closeAll, err
+	}
+	if cfg.Layout == "cas" && cfg.CASMap == "" {
+		if cfg.DestDir == "-" {
+			return closeAll, errors.New("cas-map is needed for a tar to stdout")
+		}
+		cfg.CASMap = filepath.Join(cfg.DestDir, "cas.jsonl")
+	}
+	if cfg.DestTemplate != "" {
+		t, err := parseDestTemplate(cfg.DestTemplate)
+		if err != nil {
+			return closeAll, err
+		}
+		cfg.destTmpl = t
+	}
+	if cfg.Premis != "" && cfg.Premis != "xml" && cfg.Premis != "json" {
+		return closeAll, errors.New("premis must be \"xml\", \"json\" or \"\"")
+	}
+
+	// scratch area, removed by the returned function or on signals.
+	if !cfg.DryRun {
+		max, err := parseSize(cfg.TmpMax)
+		if err != nil {
+			return closeAll, err
+		}
+		cfg.tmp, err = newScratch(cfg, cfg.TmpDir, max)
+		if err != nil {
+			return closeAll, err
+		}
+		tmp := cfg.tmp
+		onSignal(func() { tmp.remove() })
+
+		if cfg.DestDir == "-" {
+			cfg.DestDir = filepath.Join(tmp.dir, "out")
+			cfg.tar = newTarStream(os.Stdout, cfg.DestDir)
+		}
+	}
+
+	// probe vips before converting anything.
+	if !cfg.DryRun && cfg.Engine == "vips" && cfg.VipsCheck != "off" {
+		if err := checkVips(cfg); err != nil {
+			return closeAll, err
+		}
+	}
+
+	return closeAll, nil
+}
+
+func main() {
+	os.Exit(mainRun())
+}
+
+// mainRun runs the command of os.Args, returning the exit status, so that
+// the deferred closing of logs and removal of the scratch area run before
+// exiting.
+func mainRun() int {
+	// a oneshot run is configured only by flags and the environment.
+	oneshot := len(os.Args) > 1 && oneshotRequested(os.Args[1:])
+	if oneshot {
+		confFile = ""
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return exitStatus(err)
+	}
+
+	// subcommands
+	sub := ""
+	if len(os.Args) > 1 && (os.Args[1] == "convert" ||
+		os.Args[1] == "ingest" || os.Args[1] == "replay") {
+		// the same as no subcommand, ingest with -since-snapshot and
+		// replay with -failed.
+		sub = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			if err := benchMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "report":
+			if err := reportMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "ctl":
+			if err := ctlMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "version":
+			if err := versionMain(os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "self-update":
+			if err := selfUpdateMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "completion":
+			if err := completionMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "init":
+			if err := initMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "plan":
+			if err := planMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "list":
+			if err := listMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "clean":
+			if err := cleanMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "promote":
+			if err := promoteMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "snapshot":
+			if err := snapshotMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "compare":
+			if err := compareMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		case "serve":
+			if err := serveMain(cfg, os.Args[2:]); err != nil {
+				return exitStatus(err)
+			}
+			return 0
+		}
+	}
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [convert] [options]\n"+
+			"       %s bench [options]\n"+
+			"       %s ctl [options] pause|resume|drain|status|reload\n"+
+			"       %s report diff RESULTS_A RESULTS_B\n"+
+			"       %s version\n"+
+			"       %s self-update [-check] [-api URL]\n"+
+			"       %s completion bash|zsh|fish\n"+
+			"       %s init\n"+
+			"       %s plan [-format text|json] [-o FILE] [options]\n"+
+			"       %s plan keygen|sign|verify ...\n"+
+			"       %s list [-chunks N|-by-dir] [-name NAME] [options]\n"+
+			"       %s clean [-older-than AGE] [-obsolete-profiles P,...] "+
+			"[-report FILE] [options]\n"+
+			"       %s promote -results FILE [options]\n"+
+			"       %s compare [-from PROFILE] -to PROFILE [-n N] [options]\n"+
+			"       %s snapshot [-hash] [-o FILE] [options]\n"+
+			"       %s ingest -since-snapshot FILE [options]\n"+
+			"       %s replay -failed RESULTS [options]\n"+
+			"       %s serve [-addr ADDR] [-store FILE] [-max-runs N] "+
+			"[-max-proc N]\n\nOptions:\n",
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+			os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0],
+			os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr,
+			"\n  *default values have been changed via config.json if exists.\n")
+	}
+
+	// update by commandline options.
+	setFlags(flag.CommandLine, cfg)
+	if oneshot {
+		if err := setEnvFlags(flag.CommandLine); err != nil {
+			return exitStatus(err)
+		}
+	}
+	flag.Parse()
+	if sub == "ingest" && cfg.SinceSnapshot == "" {
+		return exitStatus(errors.New("ingest needs -since-snapshot"))
+	}
+	if sub == "replay" && cfg.Failed == "" {
+		return exitStatus(errors.New("replay needs -failed"))
+	}
+
+	// after parsing args
+	closeLogs, err := setup(cfg)
+	defer closeLogs()
+	if err != nil {
+		return exitStatus(err)
+	}
 
 	if cfg.Verbose {
 		cfg.Log.Write([]byte(fmt.Sprintf("config: %#v\n", cfg)))
 	}
+	if len(cfg.Tags) > 0 {
+		cfg.Log.Write([]byte(fmt.Sprintf("tags: %s\n", cfg.Tags.String())))
+	}
 
-	// prepare workers
-	q := make(chan string)
-	wg.Add(cfg.Proc)
-	for i := 0; i < cfg.Proc; i++ {
-		go doVips(cfg, &wg, q)
+	enqueue := func(q chan string) error {
+		return walk(cfg, q)
+	}
+	if cfg.sampling() {
+		enqueue = func(q chan string) error {
+			return sampleWalk(cfg, q)
+		}
+	}
+	if cfg.SinceSnapshot != "" {
+		snap, err := loadSnapshot(cfg, cfg.SinceSnapshot)
+		if err != nil {
+			return exitStatus(err)
+		}
+		enqueue = func(q chan string) error {
+			return snap.walk(cfg, q)
+		}
+	}
+	st := newState()
+	if cfg.Failed != "" {
+		es, err := loadFailed(cfg, cfg.Failed)
+		if err != nil {
+			return exitStatus(err)
+		}
+		// -profile given decides the profiles and dests anew.
+		newProfile := false
+		flag.Visit(func(f *flag.Flag) {
+			newProfile = newProfile || f.Name == "profile"
+		})
+		st.planned = map[string]*planEntry{}
+		for _, e := range es {
+			if e.Dest != "" && !newProfile {
+				st.planned[e.Src] = e
+			}
+		}
+		enqueue = func(q chan string) error {
+			return replayWalk(es, q)
+		}
+	}
+	if cfg.Watch {
+		enqueue = func(q chan string) error {
+			return pollWalk(cfg, st, q)
+		}
+	}
+	if cfg.Plan != "" {
+		p, err := loadPlan(cfg)
+		if err != nil {
+			return exitStatus(err)
+		}
+		st.planned = p.entries()
+		enqueue = func(q chan string) error {
+			return p.walk(cfg, q)
+		}
+	}
+	st.tags = cfg.Tags
+	if cfg.PriorityList != "" {
+		if err := loadPriority(cfg, st, cfg.PriorityList); err != nil {
+			return exitStatus(err)
+		}
+	}
+	if cfg.Checkpoint != "" {
+		if err := loadCheckpoint(cfg, st); err != nil {
+			return exitStatus(err)
+		}
+	}
+	if cfg.Generations {
+		if cfg.Results == "" {
+			return exitStatus(errors.New("generations needs -results"))
+		}
+		if _, err := os.Stat(cfg.Results); err == nil {
+			_, all, err := loadResults(cfg.Results)
+			if err != nil {
+				return exitStatus(err)
+			}
+			// outputs there are, not failed attempts.
+			st.prev = map[string]*result{}
+			for _, r := range all {
+				if r.ok() {
+					st.prev[r.Src] = r
+				}
+			}
+		}
+	}
+	if cfg.Results != "" {
+		f, err := os.OpenFile(cfg.Results,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		st.results = json.NewEncoder(f)
+	}
+	if cfg.OTLP != "" {
+		st.tracer = newTracer(cfg)
+	}
+	if cfg.Journal != "" && !cfg.DryRun {
+		j, err := openJournal(cfg, st, cfg.Journal)
+		if err != nil {
+			return exitStatus(err)
+		}
+		st.journal = j
+	}
+	if cfg.Layout == "cas" && !cfg.DryRun {
+		os.MkdirAll(filepath.Dir(cfg.CASMap), 0755)
+		f, err := os.OpenFile(cfg.CASMap,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		st.casMap = json.NewEncoder(f)
+	}
+	if cfg.EmitScript != "" && !cfg.DryRun {
+		f, err := os.OpenFile(cfg.EmitScript,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		writeScriptHead(f)
+		st.scriptOut = f
+	}
+	if cfg.Missing != "" && cfg.lists != nil {
+		f, err := os.Create(cfg.Missing)
+		if err != nil {
+			return exitStatus(err)
+		}
+		defer f.Close()
+		st.missingOut = f
 	}
+	if needSequence(cfg) {
+		if err := loadSequence(cfg, st); err != nil {
+			return exitStatus(err)
+		}
+	}
+	if min, err := parseSize(cfg.MinFree); err != nil {
+		return exitStatus(err)
+	} else if min > 0 && !cfg.DryRun {
+		go guardDisk(cfg, st, min)
+	}
+	if cfg.Heartbeat > 0 || cfg.StallAfter > 0 {
+		go heartbeat(cfg, st)
+	}
+	if cfg.HTTPAddr != "" {
+		go func() {
+			if err := serveDashboard(cfg, st); err != nil {
+				cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
+			}
+		}()
+	}
+	if cfg.ControlSock != "" {
+		go func() {
+			if err := serveControl(cfg, st); err != nil {
+				cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
+			}
+		}()
+		defer os.Remove(cfg.ControlSock)
+	}
+	if cfg.Collisions != "off" && cfg.Plan == "" && !cfg.Watch {
+		if err := checkDests(cfg); err != nil {
+			return exitStatus(err)
+		}
+	}
+	if !cfg.DryRun {
+		onSignal(func() {
+			// stop writers before removing what they wrote.
+			killCmds()
+			st.removePartials(cfg)
+		})
+	}
+	stopTUI := func() {}
+	if cfg.TUI {
+		stopTUI = startTUI(cfg, st)
+	}
+	if cfg.Watch || cfg.Systemd {
+		onHangup(func() {
+			if cfg.Systemd {
+				sdNotify("RELOADING=1")
+			}
+			control(cfg, st, "reload", "signal SIGHUP")
+			if cfg.Systemd {
+				sdNotify("READY=1\n" + sdStatus(st))
+			}
+		})
+	}
+	if cfg.Systemd {
+		go sdWatchdog(cfg, st)
+		if err := sdNotify("READY=1\n" + sdStatus(st)); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: systemd: %s\n", err)))
+		}
+	}
+	if cfg.notify != nil {
+		cfg.notify.send(cfg, st, "start", fmt.Sprintf(
+			"started converting %s into %s", cfg.SrcDir, cfg.DestDir))
+	}
+	run(cfg, st, enqueue)
+	stopTUI()
 
-	// do queuing
-	if cfg.Type == "files" {
-		if err = filesWalk(cfg, q); err != nil {
+	if st.aborted != "" {
+		cfg.Log.Write([]byte(fmt.Sprintf("aborted: %s\n", st.aborted)))
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("converted: %d, failed: %d, skipped: %d\n",
+		st.converted, st.failed, st.skipped)))
+	if st.failed > 0 {
+		cfg.Log.Write([]byte(fmt.Sprintf("failed by class: %s\n",
+			st.classCounts())))
+	}
+	if st.cached > 0 {
+		cfg.Log.Write([]byte(fmt.Sprintf("from cache: %d\n", st.cached)))
+	}
+	if st.passed > 0 {
+		cfg.Log.Write([]byte(fmt.Sprintf("passed through: %d\n", st.passed)))
+	}
+	if st.missingN > 0 {
+		cfg.Log.Write([]byte(fmt.Sprintf("missing in filelists: %d\n",
+			st.missingN)))
+	}
+	if len(cfg.Tags) > 0 {
+		cfg.Log.Write([]byte(fmt.Sprintf("tags: %s\n", cfg.Tags.String())))
+	}
+	if cfg.lists != nil {
+		cfg.lists.flush(cfg)
+	}
+	if err := packZips(cfg, st); err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: zip: %s\n", err)))
+	}
+	if cfg.tar != nil {
+		if err := cfg.tar.close(); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: tar: %s\n", err)))
+		}
+	}
+	if cfg.IIIF != "" && len(st.outputs) > 0 {
+		st.iiifFailed = checkOutputsIIIF(cfg, st)
+	}
+	if st.translit != nil && !cfg.DryRun {
+		if err := writeTranslit(cfg, st); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: transliterate: %s\n",
+				err)))
+		}
+	}
+	if cfg.Mapping != "" && !cfg.DryRun {
+		if err := writeMapping(cfg, st); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: mapping: %s\n", err)))
+		}
+	}
+	if cfg.index != nil && len(st.outputs) > 0 {
+		n, err := cfg.index.push(cfg, st)
+		if err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: index: %s\n", err)))
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("indexed: %d\n", n)))
+	}
+	if cfg.Manifest != "" {
+		if err := writeManifest(cfg, st); err != nil {
 			cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
 		}
-	} else {
-		if err = filelistWalk(cfg, q); err != nil {
+	}
+	if st.journal != nil {
+		if err := st.journal.close(); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: journal: %s\n", err)))
+		}
+	}
+	if cfg.Checkpoint != "" && !cfg.DryRun {
+		if err := saveCheckpoint(cfg, st); err != nil {
 			cfg.Log.Write([]byte(fmt.Sprintf("error: %s\n", err)))
 		}
 	}
-
-	close(q)
-	wg.Wait()
-
+	if cfg.Systemd {
+		sdNotify("STOPPING=1\n" + sdStatus(st))
+	}
+	if st.tracer != nil {
+		st.tracer.close()
+	}
+	if cfg.notify != nil {
+		text := fmt.Sprintf("finished %s: converted %d, failed %d, skipped %d",
+			cfg.SrcDir, st.converted, st.failed, st.skipped)
+		if st.aborted != "" {
+			text = fmt.Sprintf("stopped %s by %s: converted %d, failed %d, "+
+				"skipped %d", cfg.SrcDir, st.aborted, st.converted, st.failed,
+				st.skipped)
+		}
+		cfg.notify.send(cfg, st, "end", text)
+		cfg.notify.wait()
+	}
+	if cfg.Oneshot {
+		cfg.Log.Write([]byte("done!\n"))
+		// tell a failed job by the exit status.
+		if st.failed > 0 || st.missingN > 0 || st.aborted != "" ||
+			st.iiifFailed > 0 {
+			return 1
+		}
+		return 0
+	}
+	if cfg.tar != nil {
+		fmt.Fprintln(os.Stderr, "done!")
+		return 0
+	}
 	fmt.Println("done!")
+	return 0
 }
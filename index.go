@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// indexBatch is the number of documents sent in a request.
+const indexBatch = 500
+
+// defaultIndexTemplate makes the document of an output by default.
+const defaultIndexTemplate = `{"id": {{json .Src}}, "src": {{json .Src}},
+ "dest": {{json .Dest}}, "url": {{json .URL}}, "profile": {{json .Profile}},
+ "width": {{num .Props.width}}, "height": {{num .Props.height}},
+ "bands": {{num .Props.bands}}, "filesize": {{num .Props.filesize}},
+ "format": {{json .Props.ext}}}`
+
+// indexDoc is what the template of -index-template makes a document of.
+type indexDoc struct {
+	*mapping
+	Profile string
+	Engine  string
+	Tags    tags
+	// Props are the header fields of the output by vipsheader -a along
+	// with filesize and ext.
+	Props map[string]string
+}
+
+var indexFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// num writes a number as it is and anything else as null.
+	"num": func(s string) string {
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return "null"
+		}
+		return s
+	},
+}
+
+// indexer pushes documents of the outputs into solr or elasticsearch.
+type indexer struct {
+	kind string // "solr" or "es"
+	url  string
+	tmpl *template.Template
+}
+
+// newIndexer returns the indexer of cfg.Index, "solr:URL" of a core or
+// "es:URL" of an index, making documents by cfg.IndexTemplate.
+func newIndexer(cfg *config) (*indexer, error) {
+	kv := strings.SplitN(cfg.Index, ":", 2)
+	if len(kv) != 2 || (kv[0] != "solr" && kv[0] != "es") ||
+		!strings.HasPrefix(kv[1], "http") {
+		return nil, fmt.Errorf("bad index %q, solr:URL or es:URL", cfg.Index)
+	}
+	text := defaultIndexTemplate
+	if cfg.IndexTemplate != "" {
+		b, err := os.ReadFile(cfg.IndexTemplate)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("index").Funcs(indexFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &indexer{kind: kv[0], url: strings.TrimSuffix(kv[1], "/"),
+		tmpl: tmpl}, nil
+}
+
+// doc returns the json document of r.
+func (ix *indexer) doc(cfg *config, r *result) (json.RawMessage, error) {
+	props, err := probe(cfg, r.Dest)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := ix.tmpl.Execute(&b, &indexDoc{mapping: newMapping(cfg, r),
+		Profile: r.Profile, Engine: r.Engine, Tags: r.Tags,
+		Props: props}); err != nil {
+		return nil, err
+	}
+	// on a line for the bulk api.
+	var c bytes.Buffer
+	if err := json.Compact(&c, b.Bytes()); err != nil {
+		return nil, fmt.Errorf("not json: %s: %s", err, b.String())
+	}
+	return json.RawMessage(c.Bytes()), nil
+}
+
+// send posts docs in a request.
+func (ix *indexer) send(client *http.Client, docs []json.RawMessage) error {
+	var body bytes.Buffer
+	u, ctype := ix.url+"/update?commit=true", "application/json"
+	if ix.kind == "solr" {
+		json.NewEncoder(&body).Encode(docs)
+	} else {
+		u, ctype = ix.url+"/_bulk?refresh=true", "application/x-ndjson"
+		for _, d := range docs {
+			var id struct {
+				ID interface{} `json:"id"`
+			}
+			json.Unmarshal(d, &id)
+			action := map[string]interface{}{}
+			if id.ID != nil {
+				action["_id"] = fmt.Sprint(id.ID)
+			}
+			json.NewEncoder(&body).Encode(map[string]interface{}{
+				"index": action})
+			body.Write(d)
+			body.WriteByte('\n')
+		}
+	}
+	res, err := client.Post(u, ctype, &body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s: %s", u, res.Status, bytes.TrimSpace(b))
+	}
+	if ix.kind == "es" {
+		// the bulk api tells failures of documents in the body.
+		var r struct {
+			Errors bool `json:"errors"`
+		}
+		if json.Unmarshal(b, &r) == nil && r.Errors {
+			return fmt.Errorf("%s: some documents failed: %.200s", u, b)
+		}
+	}
+	return nil
+}
+
+// push indexes the outputs of the run, probing them in cfg.Proc goroutines.
+// it returns the number of documents indexed.
+func (ix *indexer) push(cfg *config, st *state) (int, error) {
+	docs := make([]json.RawMessage, len(st.outputs))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Proc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				d, err := ix.doc(cfg, st.outputs[i])
+				if err != nil {
+					cfg.Log.Write([]byte(fmt.Sprintf("error: index: %s: %s\n",
+						st.outputs[i].Dest, err)))
+					continue
+				}
+				docs[i] = d
+			}
+		}()
+	}
+	for i := range st.outputs {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	n := 0
+	var batch []json.RawMessage
+	for i, d := range docs {
+		if d != nil {
+			batch = append(batch, d)
+		}
+		if len(batch) == indexBatch || (i == len(docs)-1 && len(batch) > 0) {
+			if err := ix.send(client, batch); err != nil {
+				return n, err
+			}
+			n += len(batch)
+			batch = batch[:0]
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// vips formats offered by init.
+var initFormats = []struct{ name, fmt string }{
+	{"ptiff", "vips im_vips2tiff %s %s:jpeg:60,tile:256x256,pyramid"},
+	{"tiff", "vips tiffsave %s %s --compression lzw"},
+	{"jpeg", "vips jpegsave %s %s --Q 90"},
+}
+
+// wizard asks questions on a terminal.
+type wizard struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+// ask returns the answer to q, def if empty.
+func (wz *wizard) ask(q, def string) (string, error) {
+	fmt.Fprintf(wz.w, "%s [%s]: ", q, def)
+	s, err := wz.r.ReadString('\n')
+	if err != nil && s == "" {
+		return "", err
+	}
+	if s = strings.TrimSpace(s); s == "" {
+		return def, nil
+	}
+	return s, nil
+}
+
+// choose asks until the answer is one of choices.
+func (wz *wizard) choose(q, def string, choices []string) (string, error) {
+	for {
+		s, err := wz.ask(fmt.Sprintf("%s (%s)", q, strings.Join(choices, ", ")),
+			def)
+		if err != nil {
+			return "", err
+		}
+		if indexOf(choices, s) >= 0 {
+			return s, nil
+		}
+		fmt.Fprintf(wz.w, "  choose one of %s\n", strings.Join(choices, ", "))
+	}
+}
+
+// dir asks for a directory until it exists unless create is set.
+func (wz *wizard) dir(q, def string, create bool) (string, error) {
+	for {
+		s, err := wz.ask(q, def)
+		if err != nil {
+			return "", err
+		}
+		fi, err := os.Stat(s)
+		if err == nil && fi.IsDir() {
+			return s, nil
+		}
+		if err == nil {
+			fmt.Fprintf(wz.w, "  %s is not a directory\n", s)
+			continue
+		}
+		if create {
+			fmt.Fprintf(wz.w, "  %s will be created\n", s)
+			return s, nil
+		}
+		fmt.Fprintf(wz.w, "  %s does not exist\n", s)
+	}
+}
+
+// initMain asks for the basic settings and writes them to confFile.
+func initMain(cfg *config, args []string) error {
+	wz := &wizard{bufio.NewReader(os.Stdin), os.Stdout}
+	cfg.Log = os.Stderr
+
+	if _, err := os.Stat(confFile); err == nil {
+		s, err := wz.choose(confFile+" exists. overwrite?", "n",
+			[]string{"y", "n"})
+		if err != nil || s == "n" {
+			return err
+		}
+	}
+
+	var err error
+	if cfg.SrcDir, err = wz.dir("source dir", cfg.SrcDir, false); err != nil {
+		return err
+	}
+	if cfg.Ext, err = wz.ask("source file extension", cfg.Ext); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(cfg.Ext, ".") {
+		cfg.Ext = "." + cfg.Ext
+	}
+	if cfg.DestDir, err = wz.dir("destination dir", cfg.DestDir, true); err != nil {
+		return err
+	}
+
+	engines := []string{"vips", "imagemagick", "graphicsmagick"}
+	if cfg.Engine, err = wz.choose("engine", cfg.Engine, engines); err != nil {
+		return err
+	}
+	if cfg.Engine == "vips" {
+		var names []string
+		def := "ptiff"
+		for _, f := range initFormats {
+			names = append(names, f.name)
+			if f.fmt == cfg.VipsFmt {
+				def = f.name
+			}
+		}
+		name, err := wz.choose("output format", def, names)
+		if err != nil {
+			return err
+		}
+		cfg.VipsFmt = initFormats[indexOf(names, name)].fmt
+	}
+
+	if len(cfg.Profiles) > 0 {
+		names := []string{"none"}
+		for p := range cfg.Profiles {
+			names = append(names, p)
+		}
+		sort.Strings(names[1:])
+		def := cfg.Profile
+		if def == "" {
+			def = "none"
+		}
+		p, err := wz.choose("profile", def, names)
+		if err != nil {
+			return err
+		}
+		if cfg.Profile = p; p == "none" {
+			cfg.Profile = ""
+		}
+	}
+
+	for {
+		s, err := wz.ask("concurrent processes", strconv.Itoa(cfg.Proc))
+		if err != nil {
+			return err
+		}
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			cfg.Proc = n
+			break
+		}
+		fmt.Fprintln(wz.w, "  give a positive number")
+	}
+
+	// validate as a run would.
+	c := *cfg
+	if c.Profile != "" {
+		pc, err := c.withProfile(c.Profile)
+		if err != nil {
+			return err
+		}
+		c = *pc
+	}
+	if _, err := converters(&c); err != nil {
+		return err
+	}
+	return saveConfig(cfg)
+}
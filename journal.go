@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// journal records files before and after they are converted, so that those
+// in flight when the process died can be cleaned up and converted again.
+type journal struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+type journalEntry struct {
+	Event string `json:"event"` // "started" or "finished"
+	Src   string `json:"src"`
+	Dest  string `json:"dest,omitempty"`
+	// paths a started conversion may create, of newPartials.
+	Partials []string  `json:"partials,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// openJournal reads the journal at path, removes partial outputs of the
+// files started but not finished in it and queues them ahead of the others,
+// and then starts the journal over with those files.
+func openJournal(cfg *config, st *state, path string) (*journal, error) {
+	open, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f}
+	for _, e := range open {
+		cfg.Log.Write([]byte(fmt.Sprintf(
+			"info: %s was being converted when the run died, converting again\n",
+			e.Src)))
+		ps := e.Partials
+		if ps == nil && e.Dest != "" {
+			// of a journal written before partials were.
+			ps = []string{e.Dest}
+		}
+		removePartial(cfg, ps, e.Time)
+		if err := j.write(e); err != nil {
+			f.Close()
+			return nil, err
+		}
+		st.prioritize(e.Src)
+	}
+	return j, nil
+}
+
+// readJournal returns the entries started but not finished, in order.
+func readJournal(path string) ([]*journalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var srcs []string
+	started := map[string]*journalEntry{}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		e := &journalEntry{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			// the last line may be cut by the crash.
+			continue
+		}
+		switch e.Event {
+		case "started":
+			if started[e.Src] == nil {
+				srcs = append(srcs, e.Src)
+			}
+			started[e.Src] = e
+		case "finished":
+			delete(started, e.Src)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var open []*journalEntry
+	for _, src := range srcs {
+		if e := started[src]; e != nil {
+			open = append(open, e)
+			delete(started, src)
+		}
+	}
+	return open, nil
+}
+
+// write appends e and syncs it to the disk.
+func (j *journal) write(e *journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) start(cfg *config, src, dest string, partials []string) {
+	err := j.write(&journalEntry{Event: "started", Src: src, Dest: dest,
+		Partials: partials, Time: time.Now()})
+	if err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: journal: %s\n", err)))
+	}
+}
+
+func (j *journal) finish(cfg *config, r *result) {
+	err := j.write(&journalEntry{Event: "finished", Src: r.Src,
+		Dest: r.Dest, Status: r.Status, Time: time.Now()})
+	if err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: journal: %s\n", err)))
+	}
+}
+
+// close removes the journal, in which every file has finished once the
+// workers are done.
+func (j *journal) close() error {
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(j.f.Name())
+}
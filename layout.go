@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseLayout checks -layout: "" for none, "pairtree", "hash:N" for N
+// levels of directories, or "cas" for content addressed outputs, which are
+// moved after conversion (see storeCAS).
+func parseLayout(s string) (int, error) {
+	switch {
+	case s == "" || s == "pairtree" || s == "cas":
+		return 0, nil
+	case strings.HasPrefix(s, "hash:"):
+		n, err := strconv.Atoi(s[len("hash:"):])
+		if err != nil || n < 1 || n > sha1.Size {
+			return 0, fmt.Errorf("bad hash levels: %q", s)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf(
+		"layout must be \"pairtree\", \"hash:N\", \"cas\" or \"\": %q", s)
+}
+
+// pairtree returns the pairtree path of id, e.g. ab/cd/e for abcde, after
+// the character cleaning of the pairtree specification.
+func pairtree(id string) string {
+	var b strings.Builder
+	for _, c := range []byte(id) {
+		switch {
+		case c < 0x21 || c > 0x7e || strings.IndexByte(`"*+,<=>?\^|`, c) >= 0:
+			fmt.Fprintf(&b, "^%02x", c)
+		case c == '/':
+			b.WriteByte('=')
+		case c == ':':
+			b.WriteByte('+')
+		case c == '.':
+			b.WriteByte(',')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	s := b.String()
+	var dirs []string
+	for len(s) > 2 {
+		dirs = append(dirs, s[:2])
+		s = s[2:]
+	}
+	return strings.Join(append(dirs, s), "/")
+}
+
+// hashDirs returns n levels of two hex digits of the sha1 of id, e.g. 3f/a0.
+func hashDirs(id string, n int) string {
+	h := fmt.Sprintf("%x", sha1.Sum([]byte(id)))
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = h[2*i : 2*i+2]
+	}
+	return strings.Join(dirs, "/")
+}
+
+// layoutDir returns the directories by cfg.Layout put before slash
+// separated rel of src, so that millions of outputs spread over many
+// directories.
+func layoutDir(cfg *config, src, rel string) (string, error) {
+	if cfg.Layout == "" || cfg.Layout == "cas" {
+		return "", nil
+	}
+	id, _, err := identifier(cfg, src, rel)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Layout == "pairtree" {
+		return pairtree(id), nil
+	}
+	n, _ := parseLayout(cfg.Layout)
+	return hashDirs(id, n), nil
+}
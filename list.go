@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// writeList writes srcs relative to the source dir into path, one per line
+// as filelist mode reads them.
+func writeList(cfg *config, path string, srcs []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, src := range srcs {
+		rel, err := filepath.Rel(cfg.SrcDir, src)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		fmt.Fprintln(w, filepath.ToSlash(rel))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("%s: %d files\n", path, len(srcs))))
+	return f.Close()
+}
+
+// listMain walks the source dir and writes filelists into the filelist dir.
+func listMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	setFlags(fs, cfg)
+	name := fs.String("name", "list", "filelist name without extension")
+	chunks := fs.Int("chunks", 0, "split into N filelists (0 not to split)")
+	byDir := fs.Bool("by-dir", false,
+		"write a filelist per directory of the source dir")
+	fs.Parse(args)
+	if *chunks > 0 && *byDir {
+		return errors.New("-chunks and -by-dir are exclusive")
+	}
+
+	cfg.Save = false
+	cfg.DryRun = true
+	closeLogs, err := setup(cfg)
+	defer closeLogs()
+	if err != nil {
+		return err
+	}
+	ext := cfg.FilelistExt
+	cfg.Type = "files"
+
+	srcs, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(cfg.ListDir, 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case *byDir:
+		dirs := map[string][]string{}
+		for _, src := range srcs {
+			rel, err := filepath.Rel(cfg.SrcDir, filepath.Dir(src))
+			if err != nil {
+				return err
+			}
+			dirs[rel] = append(dirs[rel], src)
+		}
+		var keys []string
+		for d := range dirs {
+			keys = append(keys, d)
+		}
+		sort.Strings(keys)
+		for _, d := range keys {
+			n := *name
+			if d != "." {
+				n += "-" + strings.Replace(filepath.ToSlash(d), "/", "_", -1)
+			}
+			if err := writeList(cfg, filepath.Join(cfg.ListDir, n+ext),
+				dirs[d]); err != nil {
+				return err
+			}
+		}
+	case *chunks > 0:
+		size := (len(srcs) + *chunks - 1) / *chunks
+		for i := 0; i < *chunks && i*size < len(srcs); i++ {
+			end := (i + 1) * size
+			if end > len(srcs) {
+				end = len(srcs)
+			}
+			path := filepath.Join(cfg.ListDir,
+				fmt.Sprintf("%s-%03d%s", *name, i+1, ext))
+			if err := writeList(cfg, path, srcs[i*size:end]); err != nil {
+				return err
+			}
+		}
+	default:
+		return writeList(cfg, filepath.Join(cfg.ListDir, *name+ext), srcs)
+	}
+	return nil
+}
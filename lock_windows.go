@@ -0,0 +1,16 @@
+package main
+
+import "os"
+
+// lockFile creates path and keeps it open until the returned file is
+// closed or the process exits, which keeps it from being removed.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// locked reports whether a process holds the lock of path, removing it if
+// not.
+func locked(path string) bool {
+	err := os.Remove(path)
+	return err != nil && !os.IsNotExist(err)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+)
+
+// log levels by the prefixes of log lines, and their syslog priorities.
+var logLevels = []struct {
+	prefix   string
+	level    string
+	priority int
+}{
+	{"alert:", "alert", 1},
+	{"error:", "error", 3},
+	{"warning:", "warning", 4},
+	{"missing:", "missing", 5},
+}
+
+// logLevel returns the level and syslog priority of the log line s, info
+// (6) if it has no known prefix.
+func logLevel(s string) (string, int) {
+	for _, l := range logLevels {
+		if strings.HasPrefix(s, l.prefix) {
+			return l.level, l.priority
+		}
+	}
+	return "info", 6
+}
+
+// journalField returns s in upper case letters, digits and underscores for
+// a part of a journald field name.
+func journalField(s string) string {
+	b := []byte(strings.ToUpper(s))
+	for i, c := range b {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,134 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// newLogSink returns a writer of log lines to "syslog" of the host,
+// "syslog://HOST:PORT" by udp or "syslog+tcp://HOST:PORT", or "journald".
+func newLogSink(cfg *config, s string) (io.WriteCloser, error) {
+	if s == "journald" {
+		return newJournald(cfg)
+	}
+	network, addr := "", ""
+	if s != "syslog" {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "syslog":
+			network = "udp"
+		case "syslog+tcp":
+			network = "tcp"
+		default:
+			return nil, fmt.Errorf("unknown log sink: %s", s)
+		}
+		addr = u.Host
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON,
+		"imconvvips")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w}, nil
+}
+
+// syslogSink writes each log line with its continuation lines as a message
+// of the priority by its prefix.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	var err error
+	switch _, pri := logLevel(msg); pri {
+	case 1:
+		err = s.w.Alert(msg)
+	case 3:
+		err = s.w.Err(msg)
+	case 4:
+		err = s.w.Warning(msg)
+	case 5:
+		err = s.w.Notice(msg)
+	default:
+		err = s.w.Info(msg)
+	}
+	return len(p), err
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// journald sends log lines by the native protocol of systemd-journald with
+// the level, the run ID, the dirs and tags of the run as fields.
+type journald struct {
+	conn   *net.UnixConn
+	fields []byte
+}
+
+func newJournald(cfg *config) (*journald, error) {
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	j := &journald{conn: conn}
+	var b bytes.Buffer
+	field := func(k, v string) {
+		if !strings.Contains(v, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", k, v)
+			return
+		}
+		b.WriteString(k + "\n")
+		binary.Write(&b, binary.LittleEndian, uint64(len(v)))
+		b.WriteString(v + "\n")
+	}
+	field("SYSLOG_IDENTIFIER", "imconvvips")
+	field("IMCONVVIPS_SRC_DIR", cfg.SrcDir)
+	field("IMCONVVIPS_DEST_DIR", cfg.DestDir)
+	if cfg.RunID != "" {
+		field("IMCONVVIPS_RUN_ID", cfg.RunID)
+	}
+	keys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field("IMCONVVIPS_TAG_"+journalField(k), cfg.Tags[k])
+	}
+	j.fields = b.Bytes()
+	return j, nil
+}
+
+func (j *journald) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level, pri := logLevel(msg)
+	var b bytes.Buffer
+	b.Write(j.fields)
+	fmt.Fprintf(&b, "PRIORITY=%d\nIMCONVVIPS_LEVEL=%s\n", pri, level)
+	b.WriteString("MESSAGE\n")
+	binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.WriteString(msg + "\n")
+	_, err := j.conn.Write(b.Bytes())
+	return len(p), err
+}
+
+func (j *journald) Close() error {
+	return j.conn.Close()
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// newLogSink fails; there are no syslog and journald on windows.
+func newLogSink(cfg *config, s string) (io.WriteCloser, error) {
+	return nil, errors.New("log sinks are not supported on windows")
+}
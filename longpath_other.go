@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// longPath returns path as it is since there is no MAX_PATH limit.
+func longPath(path string) string {
+	return path
+}
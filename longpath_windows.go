@@ -0,0 +1,23 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath returns path in the extended-length form so that paths longer
+// than MAX_PATH can be created.
+func longPath(path string) string {
+	if len(path) < 248 || strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		// UNC path
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
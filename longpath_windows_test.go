@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLongPathWindows(t *testing.T) {
+	long := strings.Repeat(`長い名前\`, 60) + "a.tif"
+	for _, c := range []struct{ path, want string }{
+		{`C:\a.tif`, `C:\a.tif`},
+		{`C:\` + long, `\\?\C:\` + long},
+		{`\\server\share\` + long, `\\?\UNC\server\share\` + long},
+		{`\\?\C:\` + long, `\\?\C:\` + long},
+	} {
+		if got := longPath(c.path); got != c.want {
+			t.Errorf("longPath(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// manifest is the provenance record of a run.
+type manifest struct {
+	Tool        string    `json:"tool"`
+	Version     string    `json:"version"`
+	VipsVersion string    `json:"vips_version"`
+	Host        string    `json:"host"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Tags        tags      `json:"tags,omitempty"`
+	Config      *config   `json:"config"`
+	Queued      int64     `json:"queued"`
+	Converted   int64     `json:"converted"`
+	Failed      int64     `json:"failed"`
+	Skipped     int64     `json:"skipped"`
+	Aborted     string    `json:"aborted,omitempty"`
+}
+
+// writeManifest writes the manifest of a finished run to cfg.Manifest.
+func writeManifest(cfg *config, st *state) error {
+	m := &manifest{
+		Tool:        "imconvvips",
+		Version:     version,
+		VipsVersion: cfg.VipsVersion,
+		Start:       st.started,
+		End:         time.Now(),
+		Tags:        cfg.Tags,
+		Config:      cfg,
+		Queued:      atomic.LoadInt64(&st.queued),
+		Converted:   atomic.LoadInt64(&st.converted),
+		Failed:      atomic.LoadInt64(&st.failed),
+		Skipped:     atomic.LoadInt64(&st.skipped),
+		Aborted:     st.aborted,
+	}
+	if m.VipsVersion == "" {
+		m.VipsVersion, _ = vipsVersion()
+	}
+	m.Host, _ = os.Hostname()
+
+	f, err := os.Create(cfg.Manifest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
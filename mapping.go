@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mapping links a source and its identifiers to its output and the url it
+// is served at, for catalogs to update their links.
+type mapping struct {
+	Src  string            `json:"src"` // relative to the source dir
+	IDs  map[string]string `json:"ids,omitempty"`
+	Dest string            `json:"dest"`
+	URL  string            `json:"url,omitempty"`
+}
+
+// output records r, a file done, for checks and exports after the run.
+func (st *state) output(r *result) {
+	st.mu.Lock()
+	st.outputs = append(st.outputs, r)
+	st.mu.Unlock()
+}
+
+// mappingURL returns the url of dest by cfg.MappingURL, a format with %s
+// for the iiif identifier of dest, or the iiif base url of -iiif. it is ""
+// if neither is given.
+func mappingURL(cfg *config, dest string) string {
+	f := cfg.MappingURL
+	if f == "" && cfg.IIIF != "" {
+		f = strings.TrimSuffix(cfg.IIIF, "/") + "/%s"
+	}
+	if f == "" {
+		return ""
+	}
+	id, err := iiifID(cfg, dest)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(f, id)
+}
+
+// newMapping returns the mapping of r.
+func newMapping(cfg *config, r *result) *mapping {
+	rel, err := filepath.Rel(cfg.SrcDir, r.Src)
+	if err != nil {
+		rel = r.Src
+	}
+	return &mapping{Src: filepath.ToSlash(rel), IDs: r.IDs, Dest: r.Dest,
+		URL: mappingURL(cfg, r.Dest)}
+}
+
+// mappings returns the mapping of the outputs of the run by source.
+func mappings(cfg *config, st *state) []*mapping {
+	ms := make([]*mapping, 0, len(st.outputs))
+	for _, r := range st.outputs {
+		ms = append(ms, newMapping(cfg, r))
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Src < ms[j].Src })
+	return ms
+}
+
+// writeMapping writes the mapping of the outputs of the run into
+// cfg.Mapping, csv if it ends with .csv and json otherwise.
+func writeMapping(cfg *config, st *state) error {
+	ms := mappings(cfg, st)
+
+	f, err := os.Create(cfg.Mapping)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !strings.EqualFold(filepath.Ext(cfg.Mapping), ".csv") {
+		b, err := json.MarshalIndent(ms, "", " ")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(append(b, '\n'))
+		return err
+	}
+
+	// a column for each identifier of -id-regex.
+	names := map[string]bool{}
+	for _, m := range ms {
+		for n := range m.IDs {
+			names[n] = true
+		}
+	}
+	var ids []string
+	for n := range names {
+		ids = append(ids, n)
+	}
+	sort.Strings(ids)
+	w := csv.NewWriter(f)
+	w.Write(append(append([]string{"src"}, ids...), "dest", "url"))
+	for _, m := range ms {
+		row := []string{m.Src}
+		for _, n := range ids {
+			row = append(row, m.IDs[n])
+		}
+		w.Write(append(row, m.Dest, m.URL))
+	}
+	w.Flush()
+	return w.Error()
+}
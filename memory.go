@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+)
+
+// memory a vips thread needs at least, roughly a few tile buffers of a wide
+// image.
+const threadMem = 64 << 20
+
+// tuneMemory fits the vips settings of each worker into cfg.MemBudget for
+// the whole run. settings given explicitly are kept. VipsDiscThreshold is
+// normalized in bytes since vips does not take fractions like "1.5G".
+func tuneMemory(cfg *config) error {
+	if cfg.VipsDiscThreshold != "" {
+		n, err := parseSize(cfg.VipsDiscThreshold)
+		if err != nil {
+			return err
+		}
+		cfg.VipsDiscThreshold = strconv.FormatInt(n, 10)
+	}
+	budget, err := parseSize(cfg.MemBudget)
+	if err != nil || budget == 0 {
+		return err
+	}
+	per := budget / int64(cfg.Proc)
+
+	// images decoded beyond the threshold go to the scratch dir instead of
+	// memory, so let a half of the share for them and the rest for threads.
+	if cfg.VipsDiscThreshold == "" {
+		cfg.VipsDiscThreshold = strconv.FormatInt(per/2, 10)
+	}
+	if cfg.VipsConcurrency == 0 {
+		n := runtime.NumCPU() / cfg.Proc
+		if m := int(per / 2 / threadMem); m < n {
+			n = m
+		}
+		if n < 1 {
+			n = 1
+		}
+		cfg.VipsConcurrency = n
+	}
+	if per < 2*threadMem {
+		cfg.Log.Write([]byte(fmt.Sprintf(
+			"warning: mem budget %s is tight for %d workers\n",
+			cfg.MemBudget, cfg.Proc)))
+	}
+	if cfg.Verbose {
+		cfg.Log.Write([]byte(fmt.Sprintf(
+			"memory: %d bytes per worker, VIPS_DISC_THRESHOLD=%s "+
+				"VIPS_CONCURRENCY=%d\n",
+			per, cfg.VipsDiscThreshold, cfg.VipsConcurrency)))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// pathExt returns the extension of path as filepath.Ext does, but none for
+// a dotfile, e.g. ".tif", whose dot starts its name.
+func pathExt(path string) string {
+	e := filepath.Ext(path)
+	if e == filepath.Base(path) {
+		return ""
+	}
+	return e
+}
+
+// trimExt returns path without its extension.
+func trimExt(path string) string {
+	return strings.TrimSuffix(path, pathExt(path))
+}
+
+// hasExt reports whether path has one of exts, ignoring case. an empty
+// ext matches paths without extension.
+func hasExt(path string, exts []string) bool {
+	e := pathExt(path)
+	for _, ext := range exts {
+		if strings.EqualFold(e, strings.TrimSpace(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withExt returns path with its extension, of any length and case,
+// replaced by ext, or with ext added if it has none.
+func withExt(path, ext string) string {
+	return trimExt(path) + ext
+}
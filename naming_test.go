@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTrimExt(t *testing.T) {
+	for _, c := range []struct{ path, want string }{
+		{"a.tif", "a"},
+		{"a.TIF", "a"},
+		{"a", "a"},
+		{"a.b.tif", "a.b"},
+		{".tif", ".tif"},
+		{"dir/.tif", "dir/.tif"},
+		{"dir/.hidden.tif", "dir/.hidden"},
+		{"v1.2/scan", "v1.2/scan"},
+		{"v1.2/scan.jp2", "v1.2/scan"},
+		{"a.", "a"},
+	} {
+		path, want := filepath.FromSlash(c.path), filepath.FromSlash(c.want)
+		if got := trimExt(path); got != want {
+			t.Errorf("trimExt(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestHasExt(t *testing.T) {
+	exts := []string{".jpg", " .jpeg", ".TIF"}
+	for _, c := range []struct {
+		path string
+		want bool
+	}{
+		{"a.jpg", true},
+		{"a.JPG", true},
+		{"a.jpeg", true},
+		{"a.tif", true},
+		{"a.png", false},
+		{"a", false},
+		{".jpg", false},
+		{"a.jpg.png", false},
+		{"x.jpg/a", false},
+	} {
+		path := filepath.FromSlash(c.path)
+		if got := hasExt(path, exts); got != c.want {
+			t.Errorf("hasExt(%q) = %v, want %v", path, got, c.want)
+		}
+	}
+
+	// "" for paths without extension.
+	for _, c := range []struct {
+		path string
+		want bool
+	}{
+		{"a", true},
+		{".profile", true},
+		{"a.txt", false},
+		{"x.d/a", true},
+	} {
+		path := filepath.FromSlash(c.path)
+		if got := hasExt(path, []string{""}); got != c.want {
+			t.Errorf("hasExt(%q, \"\") = %v, want %v", path, got, c.want)
+		}
+	}
+}
+
+func TestWithExt(t *testing.T) {
+	for _, c := range []struct{ path, ext, want string }{
+		{"a.tif", ".jpg", "a.jpg"},
+		{"a.TIFF", ".jpg", "a.jpg"},
+		{"a", ".jpg", "a.jpg"},
+		{"a.b.tif", ".jp2", "a.b.jp2"},
+		{".tif", ".jpg", ".tif.jpg"},
+		{"dir/.tif", ".jpg", "dir/.tif.jpg"},
+		{"v1.2/scan", ".jpg", "v1.2/scan.jpg"},
+		{"v1.2/scan.tif", "", "v1.2/scan"},
+	} {
+		path, want := filepath.FromSlash(c.path), filepath.FromSlash(c.want)
+		if got := withExt(path, c.ext); got != want {
+			t.Errorf("withExt(%q, %q) = %q, want %q", path, c.ext, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+//go:build vipsnative
+
+package main
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+static int convert(const char *src, const char *dest) {
+	VipsImage *in = vips_image_new_from_file(src, NULL);
+	int r;
+
+	if (!in)
+		return -1;
+	r = vips_image_write_to_file(in, dest, NULL);
+	g_object_unref(in);
+	return r;
+}
+
+// load decodes src into memory, to be saved several times.
+static VipsImage *load(const char *src) {
+	VipsImage *in, *mem;
+
+	in = vips_image_new_from_file(src, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+	if (!in)
+		return NULL;
+	mem = vips_image_copy_memory(in);
+	g_object_unref(in);
+	return mem;
+}
+
+static int save(VipsImage *im, const char *dest) {
+	return vips_image_write_to_file(im, dest, NULL);
+}
+
+static void unref(VipsImage *im) {
+	g_object_unref(im);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+var nativeOnce sync.Once
+
+// nativeErrMu guards the error buffer of libvips, global to the process,
+// for a worker to read and clear it at once. errors of workers failing
+// together may still be read together.
+var nativeErrMu sync.Mutex
+
+// nativeError returns the errors of libvips, clearing them.
+func nativeError() string {
+	nativeErrMu.Lock()
+	defer nativeErrMu.Unlock()
+	msg := C.GoString(C.vips_error_buffer())
+	C.vips_error_clear()
+	return msg
+}
+
+// nativeConverter converts in process with libvips.
+type nativeConverter struct {
+	cfg *config
+}
+
+func newNativeConverter(cfg *config) (converter, error) {
+	var err error
+	nativeOnce.Do(func() {
+		// read by libvips at the first load.
+		if cfg.VipsDiscThreshold != "" {
+			os.Setenv("VIPS_DISC_THRESHOLD", cfg.VipsDiscThreshold)
+		}
+		name := C.CString(os.Args[0])
+		defer C.free(unsafe.Pointer(name))
+		if C.vips_init(name) != 0 {
+			err = errors.New("vips_init failed")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.VipsConcurrency > 0 {
+		C.vips_concurrency_set(C.int(cfg.VipsConcurrency))
+	}
+	return &nativeConverter{cfg: cfg}, nil
+}
+
+func (c *nativeConverter) Name() string {
+	return "libvips"
+}
+
+func (c *nativeConverter) Command(src, dest string) string {
+	return fmt.Sprintf("libvips: load %s, save %s%s", src, dest, c.cfg.NativeOpts)
+}
+
+func (c *nativeConverter) Convert(w *worker, src, dest string) error {
+	s := C.CString(src)
+	defer C.free(unsafe.Pointer(s))
+	d := C.CString(dest + c.cfg.NativeOpts)
+	defer C.free(unsafe.Pointer(d))
+
+	if C.convert(s, d) != 0 {
+		return fmt.Errorf("libvips: %s -> %s:\n  %s", src, dest,
+			nativeError())
+	}
+	return nil
+}
+
+// ConvertAll decodes src once and saves it into each of dests, filenames
+// with save options.
+func (c *nativeConverter) ConvertAll(w *worker, src string,
+	dests []string) error {
+	s := C.CString(src)
+	defer C.free(unsafe.Pointer(s))
+	im := C.load(s)
+	if im == nil {
+		return fmt.Errorf("libvips: %s:\n  %s", src, nativeError())
+	}
+	defer C.unref(im)
+
+	for _, dest := range dests {
+		d := C.CString(dest)
+		r := C.save(im, d)
+		C.free(unsafe.Pointer(d))
+		if r != 0 {
+			return fmt.Errorf("libvips: %s -> %s:\n  %s", src, dest,
+				nativeError())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !vipsnative
+
+package main
+
+import "errors"
+
+func newNativeConverter(cfg *config) (converter, error) {
+	return nil, errors.New(
+		"libvips engine is not built in (build with -tags vipsnative)")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// nfc composes decomposed characters in s that nfcPairs knows, e.g.
+// "\u304b\u3099" (KA + COMBINING VOICED SOUND MARK) -> "\u304c" (GA).
+func nfc(s string) string {
+	rs := make([]rune, 0, len(s))
+	for _, r := range s {
+		if n := len(rs); n > 0 {
+			if c, ok := nfcPairs[[2]rune{rs[n-1], r}]; ok {
+				rs[n-1] = c
+				continue
+			}
+		}
+		rs = append(rs, r)
+	}
+	return string(rs)
+}
+
+// normalizeName normalizes a relative path according to cfg.Normalize.
+// names not in UTF-8 are left as they are.
+func normalizeName(cfg *config, rel string) string {
+	if !utf8.ValidString(rel) {
+		cfg.Log.Write([]byte(fmt.Sprintf(
+			"warning: file name not in UTF-8 is kept as is: %q\n", rel)))
+		return rel
+	}
+	if cfg.Normalize == "nfc" {
+		return nfc(rel)
+	}
+	return rel
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notification events.
+var notifyEvents = []string{"start", "end", "failures", "breaker"}
+
+// event is a notification of the run.
+type event struct {
+	Event     string    `json:"event"`
+	Text      string    `json:"text"`
+	Host      string    `json:"host"`
+	Src       string    `json:"src"`
+	Dest      string    `json:"dest"`
+	Converted int64     `json:"converted"`
+	Failed    int64     `json:"failed"`
+	Skipped   int64     `json:"skipped"`
+	Aborted   string    `json:"aborted,omitempty"`
+	Tags      tags      `json:"tags,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// notifier sends events somewhere.
+type notifier interface {
+	notify(e *event) error
+}
+
+// webhook posts events as json.
+type webhook struct{ url string }
+
+func (n *webhook) notify(e *event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.url, b)
+}
+
+// chatHook posts the text of events to a Slack or Teams incoming webhook,
+// both of which take {"text": ...}.
+type chatHook struct{ url string }
+
+func (n *chatHook) notify(e *event) error {
+	b, err := json.Marshal(map[string]string{"text": e.Text})
+	if err != nil {
+		return err
+	}
+	return postJSON(n.url, b)
+}
+
+// mailer mails events by smtp://[USER@]HOST:PORT?from=ADDR&to=ADDR,...
+// with the password in SMTP_PASSWORD.
+type mailer struct {
+	addr     string
+	user     string
+	host     string
+	from     string
+	to       []string
+	password string
+}
+
+func newMailer(s string) (*mailer, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "smtp" || u.Host == "" {
+		return nil, fmt.Errorf("not smtp://HOST:PORT: %s", s)
+	}
+	m := &mailer{addr: u.Host, host: u.Hostname(), from: u.Query().Get("from"),
+		password: os.Getenv("SMTP_PASSWORD")}
+	if u.Port() == "" {
+		m.addr += ":25"
+	}
+	if u.User != nil {
+		m.user = u.User.Username()
+	}
+	for _, to := range strings.Split(u.Query().Get("to"), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			m.to = append(m.to, to)
+		}
+	}
+	if m.from == "" || len(m.to) == 0 {
+		return nil, fmt.Errorf("from and to are needed: %s", s)
+	}
+	return m, nil
+}
+
+func (n *mailer) notify(e *event) error {
+	var auth smtp.Auth
+	if n.user != "" {
+		auth = smtp.PlainAuth("", n.user, n.password, n.host)
+	}
+	subject := strings.SplitN(e.Text, "\n", 2)[0]
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), subject,
+		strings.Replace(e.Text, "\n", "\r\n", -1))
+	return smtp.SendMail(n.addr, auth, n.from, n.to, []byte(msg))
+}
+
+// notifyTarget is a notifier of some events.
+type notifyTarget struct {
+	events map[string]bool
+	n      notifier
+}
+
+// parseNotify parses "[EVENT,...=]KIND:URL" of -notify, where KIND is
+// webhook, slack, teams or email, e.g.
+//
+//	end,failures=slack:https://hooks.slack.com/services/...
+//	email:smtp://me@mail.example.org:587?from=me@example.org&to=ops@example.org
+func parseNotify(s string) (*notifyTarget, error) {
+	t := &notifyTarget{events: map[string]bool{}}
+	if i := strings.Index(s, "="); i >= 0 && !strings.Contains(s[:i], ":") {
+		for _, e := range strings.Split(s[:i], ",") {
+			e = strings.TrimSpace(e)
+			if indexOf(notifyEvents, e) < 0 {
+				return nil, fmt.Errorf("unknown notify event %q", e)
+			}
+			t.events[e] = true
+		}
+		s = s[i+1:]
+	} else {
+		for _, e := range notifyEvents {
+			t.events[e] = true
+		}
+	}
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("notify must be [EVENT,...=]KIND:URL: %s", s)
+	}
+	switch kv[0] {
+	case "webhook":
+		t.n = &webhook{kv[1]}
+	case "slack", "teams":
+		t.n = &chatHook{kv[1]}
+	case "email":
+		m, err := newMailer(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		t.n = m
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", kv[0])
+	}
+	return t, nil
+}
+
+// notifiers sends events to the targets of -notify in the background.
+type notifiers struct {
+	targets []*notifyTarget
+	wg      sync.WaitGroup
+}
+
+func newNotifiers(specs []string) (*notifiers, error) {
+	ns := &notifiers{}
+	for _, s := range specs {
+		t, err := parseNotify(s)
+		if err != nil {
+			return nil, err
+		}
+		ns.targets = append(ns.targets, t)
+	}
+	return ns, nil
+}
+
+// send notifies the targets of the event ev with text.
+func (ns *notifiers) send(cfg *config, st *state, ev, text string) {
+	host, _ := os.Hostname()
+	e := &event{
+		Event:     ev,
+		Text:      fmt.Sprintf("imconvvips on %s: %s", host, text),
+		Host:      host,
+		Src:       cfg.SrcDir,
+		Dest:      cfg.DestDir,
+		Converted: atomic.LoadInt64(&st.converted),
+		Failed:    atomic.LoadInt64(&st.failed),
+		Skipped:   atomic.LoadInt64(&st.skipped),
+		Tags:      cfg.Tags,
+		Time:      time.Now(),
+	}
+	if st.stopped() {
+		e.Aborted = st.aborted
+	}
+	for _, t := range ns.targets {
+		if !t.events[ev] {
+			continue
+		}
+		ns.wg.Add(1)
+		go func(n notifier) {
+			defer ns.wg.Done()
+			if err := n.notify(e); err != nil {
+				cfg.Log.Write([]byte(fmt.Sprintf("error: notify: %s\n", err)))
+			}
+		}(t.n)
+	}
+}
+
+// wait waits for the notifications sent.
+func (ns *notifiers) wait() {
+	ns.wg.Wait()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureStore puts outputs as block blobs to az://ACCOUNT/CONTAINER/PREFIX
+// with the shared access signature in $AZURE_STORAGE_SAS_TOKEN.
+type azureStore struct {
+	url string
+	sas string
+}
+
+func newAzureStore(u *url.URL) (*azureStore, error) {
+	container, prefix := splitBucket(u.Path)
+	if u.Host == "" || container == "" {
+		return nil, errors.New("upload must be az://ACCOUNT/CONTAINER[/PREFIX]")
+	}
+	sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	if sas == "" {
+		return nil, errors.New("AZURE_STORAGE_SAS_TOKEN is not set")
+	}
+	return &azureStore{
+		url: "https://" + u.Host + ".blob.core.windows.net/" + container + "/" +
+			prefix,
+		sas: sas,
+	}, nil
+}
+
+func (s *azureStore) newRequest(o *object) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(cmdCtx, http.MethodPut,
+		s.url+escapePath(o.rel)+"?"+s.sas, o.body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = o.size
+	req.Header.Set("Content-Type", o.ctype)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", "2020-10-02")
+	// metadata values must be ascii.
+	req.Header.Set("x-ms-meta-sha256", o.sha256)
+	for k, v := range o.meta {
+		req.Header.Set("x-ms-meta-"+k, url.QueryEscape(v))
+	}
+	return req, nil
+}
+
+// gcsStore puts outputs to gs://BUCKET/PREFIX by the json api, with the
+// access token in $GOOGLE_OAUTH_ACCESS_TOKEN or else from gcloud.
+// $STORAGE_EMULATOR_HOST points to an emulator as for the client libraries.
+type gcsStore struct {
+	endpoint string
+	bucket   string
+	prefix   string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newGCSStore(u *url.URL) (*gcsStore, error) {
+	if u.Host == "" {
+		return nil, errors.New("upload must be gs://BUCKET[/PREFIX]")
+	}
+	s := &gcsStore{
+		endpoint: "https://storage.googleapis.com",
+		bucket:   u.Host,
+		prefix:   strings.TrimPrefix(u.Path, "/"),
+	}
+	if h := os.Getenv("STORAGE_EMULATOR_HOST"); h != "" {
+		if !strings.Contains(h, "://") {
+			h = "http://" + h
+		}
+		s.endpoint = strings.TrimSuffix(h, "/")
+	} else if _, err := s.accessToken(); err != nil {
+		return nil, err
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+	return s, nil
+}
+
+// accessToken returns the token, asking gcloud again for one well before it
+// expires in an hour.
+func (s *gcsStore) accessToken() (string, error) {
+	if t := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); t != "" {
+		return t, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+	out, err := exec.Command("gcloud", "auth", "print-access-token").Output()
+	if err != nil {
+		return "", errors.New("GOOGLE_OAUTH_ACCESS_TOKEN is not set " +
+			"and gcloud gave no access token")
+	}
+	s.token = strings.TrimSpace(string(out))
+	s.expires = time.Now().Add(30 * time.Minute)
+	return s.token, nil
+}
+
+// newRequest uploads o with its metadata as a multipart/related body of
+// the object resource and the media.
+func (s *gcsStore) newRequest(o *object) (*http.Request, error) {
+	meta := map[string]string{"sha256": o.sha256}
+	for k, v := range o.meta {
+		meta[k] = v
+	}
+	res, err := json.Marshal(map[string]interface{}{
+		"name":        s.prefix + o.rel,
+		"contentType": o.ctype,
+		"metadata":    meta,
+	})
+	if err != nil {
+		return nil, err
+	}
+	boundary := "imconvvips-" + o.sha256
+	head := "--" + boundary + "\r\n" +
+		"Content-Type: application/json; charset=UTF-8\r\n\r\n" +
+		string(res) + "\r\n--" + boundary + "\r\n" +
+		"Content-Type: " + o.ctype + "\r\n\r\n"
+	tail := "\r\n--" + boundary + "--\r\n"
+
+	req, err := http.NewRequestWithContext(cmdCtx, http.MethodPost,
+		s.endpoint+"/upload/storage/v1/b/"+url.PathEscape(s.bucket)+
+			"/o?uploadType=multipart",
+		io.MultiReader(strings.NewReader(head), o.body,
+			strings.NewReader(tail)))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(head)) + o.size + int64(len(tail))
+	req.Header.Set("Content-Type", "multipart/related; boundary="+boundary)
+	if !strings.HasPrefix(s.endpoint, "http://") {
+		t, err := s.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	return req, nil
+}
+
+// splitBucket splits /BUCKET/PREFIX into BUCKET and PREFIX/, or "".
+func splitBucket(p string) (string, string) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:] + "/"
+	}
+	return p, ""
+}
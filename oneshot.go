@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oneshotRequested reports whether -oneshot is given in args or by
+// IMCONVVIPS_ONESHOT, which has to be known before reading config.json.
+func oneshotRequested(args []string) bool {
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		switch strings.TrimLeft(a, "-") {
+		case "oneshot", "oneshot=true", "oneshot=1":
+			return strings.HasPrefix(a, "-")
+		}
+	}
+	v := os.Getenv("IMCONVVIPS_ONESHOT")
+	return v == "1" || v == "true"
+}
+
+// envName returns the environment variable of the flag name, e.g.
+// IMCONVVIPS_DEST_EXT for -dest-ext.
+func envName(name string) string {
+	return "IMCONVVIPS_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setEnvFlags sets the flags of fs given by environment variables, before
+// parsing the command line which wins.
+func setEnvFlags(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %s", envName(f.Name), e)
+		}
+	})
+	return err
+}
+
+// jsonLog writes each log line with its continuation lines as a json
+// object with the time and the level by its prefix.
+type jsonLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *jsonLog) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level, _ := logLevel(msg)
+	b, err := json.Marshal(struct {
+		Time  time.Time `json:"time"`
+		Level string    `json:"level"`
+		Msg   string    `json:"msg"`
+	}{time.Now(), level, msg})
+	if err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
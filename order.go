@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// largestFirst returns the indices of srcs ordered largest file first
+// within each directory, the directories in the order they first appear, so
+// that a huge file does not start last and keep the run going alone.
+// files which cannot be stat'ed count as empty.
+func largestFirst(srcs []string) []int {
+	dirs := map[string]int{}
+	rank := make([]int, len(srcs))
+	size := make([]int64, len(srcs))
+	idx := make([]int, len(srcs))
+	for i, src := range srcs {
+		d := filepath.Dir(src)
+		r, ok := dirs[d]
+		if !ok {
+			r = len(dirs)
+			dirs[d] = r
+		}
+		rank[i] = r
+		if fi, err := os.Stat(longPath(src)); err == nil {
+			size[i] = fi.Size()
+		}
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		i, j := idx[a], idx[b]
+		if rank[i] != rank[j] {
+			return rank[i] < rank[j]
+		}
+		return size[i] > size[j]
+	})
+	return idx
+}
+
+// queueDir queues the files of dir, not descending into subdirectories,
+// largest first.
+func queueDir(dir string, q chan string) error {
+	es, err := os.ReadDir(longPath(dir))
+	if err != nil {
+		return err
+	}
+	var srcs []string
+	for _, e := range es {
+		if !e.IsDir() {
+			srcs = append(srcs, filepath.Join(dir, e.Name()))
+		}
+	}
+	for _, i := range largestFirst(srcs) {
+		q <- srcs[i]
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// partials returns what converting into dest may create: dest itself and the
+// tile dir and descriptor of deep zoom outputs.
+func partials(dest string) []string {
+	base := trimExt(dest)
+	return []string{dest, base + "_files", base + ".dzi"}
+}
+
+// newPartials returns the partials of dest that converting into it would
+// create: dest, and the tile dir and descriptor unless they are there
+// already, e.g. a dir of the user named alike, not to be removed.
+func newPartials(dest string) []string {
+	ps := []string{dest}
+	for _, p := range partials(dest)[1:] {
+		if _, err := os.Lstat(longPath(p)); os.IsNotExist(err) {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// companions returns the files of the output of r: its partials and those
+// of its renditions, with their provenance, PREMIS and sidecar files.
+func companions(cfg *config, r *result) []string {
+	dests := []string{r.Dest}
+	for _, d := range r.Renditions {
+		dests = append(dests, d)
+	}
+	var ps []string
+	for _, d := range dests {
+		ps = append(ps, partials(d)...)
+		ps = append(ps, d+".json", d+".premis.xml", d+".premis.json")
+	}
+	for _, ext := range strings.Split(cfg.Sidecars, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			ps = append(ps, fmt.Sprintf(cfg.SidecarFmt, trimExt(r.Dest), ext))
+		}
+	}
+	return ps
+}
+
+// removePartial removes the paths, partials of a conversion, written since
+// start so that a failed conversion leaves nothing behind. older ones are
+// kept as they are not from this conversion.
+func removePartial(cfg *config, paths []string, start time.Time) {
+	// some file systems keep mtime in seconds.
+	start = start.Truncate(time.Second)
+	for _, p := range paths {
+		fi, err := os.Stat(longPath(p))
+		if err != nil || fi.ModTime().Before(start) {
+			continue
+		}
+		if err := os.RemoveAll(longPath(p)); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: cleanup: %s\n", err)))
+			continue
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("info: removed partial output: %s\n", p)))
+	}
+}
+
+// removePartials removes outputs of the files being converted, e.g. when
+// the process is killed.
+func (st *state) removePartials(cfg *config) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, p := range st.current {
+		removePartial(cfg, p.partials, p.Since)
+	}
+}
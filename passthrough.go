@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// passThrough puts src at dest as it is, without converting, if it has the
+// extension of dest and matches cfg.PassThrough, e.g. a tiled pyramid tiff
+// among sources to be converted into them. it reports whether it did.
+func passThrough(cfg *config, src, dest string) (bool, error) {
+	if !strings.EqualFold(filepath.Ext(src), filepath.Ext(dest)) {
+		return false, nil
+	}
+	cs, err := parseCond(cfg.PassThrough)
+	if err != nil {
+		return false, err
+	}
+	props, err := probe(cfg, src)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range cs {
+		if !c.match(props) {
+			return false, nil
+		}
+	}
+
+	switch cfg.PassThroughBy {
+	case "link":
+		err = linkOrCopy(src, dest)
+	case "reflink":
+		err = reflinkOrCopy(src, dest)
+	default:
+		err = copyFile(src, dest)
+	}
+	if err != nil {
+		return false, fmt.Errorf("pass through %s: %s", src, err)
+	}
+	return true, nil
+}
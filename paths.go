@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// shellQuote quotes s for sh so that spaces, quotes, newlines and other
+// special characters in file names are passed as they are.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// handQuotedRe matches %s quoted in command formats by hand, as formats
+// did before file names were quoted on substitution.
+var handQuotedRe = regexp.MustCompile(`"%s"|'%s'`)
+
+// formatCmd substitutes args quoted for sh for the %s of the command format
+// f, taking %s quoted by hand, e.g. "%s", as %s.
+func formatCmd(f string, args ...string) string {
+	f = handQuotedRe.ReplaceAllString(f, "%s")
+	as := make([]interface{}, len(args))
+	for i, a := range args {
+		as[i] = shellQuote(a)
+	}
+	return fmt.Sprintf(f, as...)
+}
+
+// windowsReserved reports whether name can not be used as a file name on
+// Windows: device names like CON or LPT1 with any extension, or names
+// ending with a dot or a space.
+func windowsReserved(name string) bool {
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return name != "." && name != ".."
+	}
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") ||
+		strings.HasPrefix(base, "LPT")) && '1' <= base[3] && base[3] <= '9' {
+		return true
+	}
+	return false
+}
+
+// reservedOnce warns of reserved names once a run, not for each file.
+var reservedOnce sync.Once
+
+// checkDest rejects dest paths that can not be created on Windows there,
+// and warns elsewhere, once, since such trees often end up on Windows
+// shares.
+func checkDest(cfg *config, dest string) error {
+	for _, name := range strings.Split(filepath.ToSlash(dest), "/") {
+		if !windowsReserved(name) {
+			continue
+		}
+		err := fmt.Errorf("reserved name on Windows: %q in %q", name, dest)
+		if runtime.GOOS == "windows" {
+			return err
+		}
+		reservedOnce.Do(func() {
+			cfg.Log.Write([]byte(fmt.Sprintf(
+				"warning: %s (others not warned of)\n", err)))
+		})
+		return nil
+	}
+	return nil
+}
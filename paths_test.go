@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// names of files sh would split, expand or mangle unquoted.
+var oddNames = []string{
+	"plain.tif",
+	"with space.tif",
+	"it's.tif",
+	`say "hi".tif`,
+	"new\nline.tif",
+	"$HOME `id` *.tif",
+	"-dash.tif",
+	"日本語 ファイル.tif",
+	"café.tif",
+	"e\u0301.tif",
+}
+
+// shArgs runs the sh command line s printing its args, one a line.
+func shArgs(t *testing.T, s string) []string {
+	t.Helper()
+	out, err := exec.Command("sh", "-c", `printf '%s\0' `+s).Output()
+	if err != nil {
+		t.Fatalf("sh -c %q: %s", s, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
+
+func TestShellQuote(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	for _, n := range oddNames {
+		if got := shArgs(t, shellQuote(n)); len(got) != 1 || got[0] != n {
+			t.Errorf("shellQuote(%q) gives %q", n, got)
+		}
+	}
+}
+
+func TestFormatCmd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	for _, f := range []string{
+		`%s %s[Q=85]`,
+		`"%s" "%s"[Q=85]`,
+		`'%s' '%s'[Q=85]`,
+	} {
+		for _, n := range oddNames {
+			got := shArgs(t, formatCmd(f, n, n))
+			if len(got) != 2 || got[0] != n || got[1] != n+"[Q=85]" {
+				t.Errorf("formatCmd(%q, %q) gives %q", f, n, got)
+			}
+		}
+	}
+}
+
+func TestWindowsReserved(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		want bool
+	}{
+		{"CON", true},
+		{"con.tif", true},
+		{"Aux.tar.gz", true},
+		{"LPT1.jpg", true},
+		{"COM9", true},
+		{"COM0", false},
+		{"COMA", false},
+		{"CONSOLE.tif", false},
+		{"name.", true},
+		{"name ", true},
+		{".", false},
+		{"..", false},
+		{"日本語.tif", false},
+	} {
+		if got := windowsReserved(c.name); got != c.want {
+			t.Errorf("windowsReserved(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestLongPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		return // longpath_windows_test.go
+	}
+	for _, p := range []string{"a.tif", strings.Repeat("long/", 100) + "a.tif",
+		"日本語/" + strings.Repeat("長", 300) + ".tif"} {
+		if got := longPath(p); got != p {
+			t.Errorf("longPath(%q) = %q", p, got)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"syscall"
+)
+
+// peerActor describes the process at the other end of the unix socket conn
+// for the audit log.
+func peerActor(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "control"
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "control"
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return "control"
+	}
+	name := fmt.Sprint(cred.Uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	return fmt.Sprintf("control %s uid=%d pid=%d", name, cred.Uid, cred.Pid)
+}
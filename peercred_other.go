@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// peerActor describes the other end of the control socket conn, which is
+// not told on this platform.
+func peerActor(conn net.Conn) string {
+	return "control"
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// planEntry is what a run would do with a source.
+type planEntry struct {
+	Src     string `json:"src"`
+	Dest    string `json:"dest,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// plan is the decisions of a run made without converting.
+type plan struct {
+	Created time.Time    `json:"created"`
+	Config  *config      `json:"config"`
+	Files   []*planEntry `json:"files"`
+}
+
+// makePlan walks the sources through the same filters as a run and
+// decides the destination and profile of each.
+func makePlan(cfg *config) (*plan, error) {
+	st := newState()
+	if cfg.Checkpoint != "" {
+		if err := loadCheckpoint(cfg, st); err != nil {
+			return nil, err
+		}
+	}
+	if needSequence(cfg) {
+		if err := loadSequence(cfg, st); err != nil {
+			return nil, err
+		}
+	}
+
+	in, q := make(chan string), make(chan string)
+	var werr error
+	go func() {
+		if cfg.sampling() {
+			werr = sampleWalk(cfg, in)
+		} else {
+			werr = walk(cfg, in)
+		}
+		close(in)
+	}()
+	go func() {
+		dispatch(cfg, st, in, q)
+		close(q)
+	}()
+
+	p := &plan{Created: time.Now(), Config: cfg}
+	for src := range q {
+		if !matchExt(cfg, src) {
+			continue
+		}
+		e := &planEntry{Src: src, Profile: cfg.Profile}
+		p.Files = append(p.Files, e)
+		var list string
+		if cfg.lists != nil {
+			o, _ := cfg.lists.origin(src)
+			list = o.list
+			if _, err := os.Stat(longPath(src)); os.IsNotExist(err) {
+				e.Error = fmt.Sprintf("missing (%s:%d)", o.list, o.line)
+				continue
+			}
+		}
+		dest, err := listDest(cfg, st, src, list)
+		if err != nil {
+			e.Error = err.Error()
+			continue
+		}
+		e.Dest = dest
+		if d := cfg.lists.directives(list); d.profile != "" {
+			e.Profile = d.profile
+		} else if len(cfg.Rules) > 0 {
+			p, err := cfg.branch(src)
+			if err != nil {
+				e.Error = err.Error()
+			} else if p != "" {
+				e.Profile = p
+			}
+		}
+	}
+	if st.aborted != "" {
+		cfg.Log.Write([]byte(fmt.Sprintf("info: plan stops at %s\n", st.aborted)))
+	}
+	return p, werr
+}
+
+// checkCollisions marks entries whose destination is that of an earlier one
+// and returns how many there are.
+func (p *plan) checkCollisions(cfg *config) int {
+	// e.g. "A.jpg" and "a.jpg" are the same file there.
+	fold := runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	seen := map[string]string{}
+	n := 0
+	for _, e := range p.Files {
+		if e.Error != "" {
+			continue
+		}
+		k := e.Dest
+		if fold {
+			k = strings.ToLower(k)
+		}
+		if src, ok := seen[k]; ok {
+			e.Error = fmt.Sprintf("destination %s collides with %s", e.Dest, src)
+			cfg.Log.Write([]byte(fmt.Sprintf("warning: %s: %s\n", e.Src, e.Error)))
+			n++
+			continue
+		}
+		seen[k] = e.Src
+	}
+	return n
+}
+
+// checkDests plans the run to find destination collisions before
+// converting anything.
+func checkDests(cfg *config) error {
+	c := *cfg
+	c.Log = io.Discard
+	p, err := makePlan(&c)
+	if err != nil {
+		return err
+	}
+	c.Log = cfg.Log
+	if n := p.checkCollisions(&c); n > 0 && cfg.Collisions == "fail" {
+		return fmt.Errorf("%d destination collisions", n)
+	}
+	return nil
+}
+
+func (p *plan) writeText(w io.Writer) {
+	for _, e := range p.Files {
+		switch {
+		case e.Error != "":
+			fmt.Fprintf(w, "%s: error: %s\n", e.Src, e.Error)
+		case e.Profile != "":
+			fmt.Fprintf(w, "%s -> %s (%s)\n", e.Src, e.Dest, e.Profile)
+		default:
+			fmt.Fprintf(w, "%s -> %s\n", e.Src, e.Dest)
+		}
+	}
+}
+
+// planMain prints what a run would do.
+func planMain(cfg *config, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "keygen":
+			return planKeygen(args[1:])
+		case "sign":
+			return planSign(args[1:])
+		case "verify":
+			return planVerify(args[1:])
+		}
+	}
+
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	setFlags(fs, cfg)
+	format := fs.String("format", "text", "output format (\"text\" or \"json\")")
+	out := fs.String("o", "", "output file (\"\" for stdout)")
+	fs.Parse(args)
+	if *format != "text" && *format != "json" {
+		return errors.New("format must be \"text\" or \"json\"")
+	}
+
+	cfg.Save = false
+	cfg.DryRun = true
+	closeLogs, err := setup(cfg)
+	defer closeLogs()
+	if err != nil {
+		return err
+	}
+	if cfg.Watch {
+		return errors.New("plan does not work with watch")
+	}
+
+	p, err := makePlan(cfg)
+	if err != nil {
+		return err
+	}
+	if n := p.checkCollisions(cfg); n > 0 && cfg.Collisions == "fail" {
+		return fmt.Errorf("%d destination collisions", n)
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		b, err := json.MarshalIndent(p, "", " ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if *out != "" {
+			// for reviewers to record, see -plan-sha256.
+			cfg.Log.Write([]byte(fmt.Sprintf("sha256: %s\n", sha256Hex(b))))
+		}
+		return nil
+	}
+	p.writeText(w)
+
+	errs := 0
+	for _, e := range p.Files {
+		if e.Error != "" {
+			errs++
+		}
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("planned: %d, errors: %d\n",
+		len(p.Files), errs)))
+	return nil
+}
+
+// loadPlan reads cfg.Plan, verifying it if a checksum or a key is given.
+func loadPlan(cfg *config) (*plan, error) {
+	b, err := os.ReadFile(cfg.Plan)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PlanSHA256 != "" {
+		if h := sha256Hex(b); h != strings.ToLower(cfg.PlanSHA256) {
+			return nil, fmt.Errorf("%s: sha256 %s does not match", cfg.Plan, h)
+		}
+	}
+	if cfg.PlanKey != "" {
+		if err := verifyPlan(cfg.Plan, b, cfg.PlanKey); err != nil {
+			return nil, err
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("info: %s verified\n", cfg.Plan)))
+	}
+	var p plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %s", cfg.Plan, err)
+	}
+	// what was reviewed and signed is what runs.
+	if p.Config != nil {
+		if n := diffCommands(p.Config, cfg); n != "" {
+			return nil, fmt.Errorf("%s: %s differs from the plan", cfg.Plan, n)
+		}
+	}
+	return &p, nil
+}
+
+// diffCommands returns the name of the first setting deciding the commands
+// run that differs between the configs a and b, or "".
+func diffCommands(a, b *config) string {
+	settings := func(c *config) []interface{} {
+		// as given, translated for the vips installed alike.
+		vipsFmt := c.VipsFmt
+		if c.vipsFmt != "" {
+			vipsFmt = c.vipsFmt
+		}
+		return []interface{}{c.Engine, c.Fallback, vipsFmt, c.IMFmt,
+			c.GMFmt, c.NativeOpts, c.ThumbFmt, c.GPUFmt, c.Steps, c.Post,
+			c.Profile, c.Profiles, c.Rules, c.IsolateEnv, c.EnvPass, c.Env}
+	}
+	names := []string{"engine", "fallback", "vips_fmt", "im_fmt", "gm_fmt",
+		"native_opts", "thumb_fmt", "gpu_fmt", "steps", "post", "profile",
+		"profiles", "rules", "isolate_env", "env_pass", "env"}
+	// nil as empty, as a config file may have either.
+	js := func(v interface{}) string {
+		j, _ := json.Marshal(v)
+		if s := string(j); s != "[]" && s != "{}" {
+			return s
+		}
+		return "null"
+	}
+	sa, sb := settings(a), settings(b)
+	for i := range sa {
+		if js(sa[i]) != js(sb[i]) {
+			return names[i]
+		}
+	}
+	return ""
+}
+
+// entries returns the planned files by source.
+func (p *plan) entries() map[string]*planEntry {
+	m := map[string]*planEntry{}
+	for _, e := range p.Files {
+		if e.Error == "" {
+			m[e.Src] = e
+		}
+	}
+	return m
+}
+
+// walk queues the planned files, skipping ones the plan failed to decide.
+func (p *plan) walk(cfg *config, q chan string) error {
+	for _, e := range p.Files {
+		if e.Error != "" {
+			cfg.Log.Write([]byte(fmt.Sprintf("skip (plan error): %s\n", e.Src)))
+			continue
+		}
+		q <- e.Src
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// precheck forwards files from in to out except those whose destinations
+// exist already, stat'ing them in n goroutines of its own so that resumed
+// runs do not keep the workers busy with files done before. the order of
+// the files is kept, and their destinations are found in it, so that names
+// numbered by -flatten or -transliterate do not depend on the goroutines.
+func precheck(cfg *config, st *state, in <-chan string, out chan<- string,
+	n int) {
+	type check struct {
+		src  string
+		keep chan bool
+	}
+	checks := make(chan *check, n)
+	sem := make(chan struct{}, n)
+	go func() {
+		for src := range in {
+			c := &check{src, make(chan bool, 1)}
+			dest, ok := precheckDest(cfg, st, src)
+			sem <- struct{}{}
+			go func() {
+				c.keep <- !ok || !converted(cfg, st, c.src, dest)
+				<-sem
+			}()
+			checks <- c
+		}
+		close(checks)
+	}()
+
+	for c := range checks {
+		if !<-c.keep {
+			continue
+		}
+		if st.hashes != nil && matchExt(cfg, c.src) {
+			st.hashes.submit(c.src)
+		}
+		out <- c.src
+	}
+}
+
+// precheckDest returns the destination of src to check, false if there is
+// none. the destination is kept for the worker so that names numbered in
+// the run are not taken twice.
+func precheckDest(cfg *config, st *state, src string) (string, bool) {
+	if !matchExt(cfg, src) {
+		return "", false
+	}
+	if e := st.planned[src]; e != nil {
+		return e.Dest, true
+	}
+	var list string
+	if cfg.lists != nil {
+		o, _ := cfg.lists.origin(src)
+		list = o.list
+	}
+	dest, err := listDest(cfg, st, src, list)
+	if err != nil {
+		// let the worker report it.
+		return "", false
+	}
+	st.mu.Lock()
+	if st.dests == nil {
+		st.dests = map[string]string{}
+	}
+	st.dests[src] = dest
+	st.mu.Unlock()
+	return dest, true
+}
+
+// converted reports whether dest, the destination of src, exists.
+func converted(cfg *config, st *state, src, dest string) bool {
+	if _, err := os.Stat(longPath(dest)); err != nil {
+		return false
+	}
+
+	if cfg.Verbose {
+		cfg.Log.Write([]byte(fmt.Sprintf("skip (exists): %s\n", src)))
+	}
+	st.takeDest(src)
+	if st.tracer != nil {
+		// not to be traced.
+		st.tracer.file(src)
+	}
+	atomic.AddInt64(&st.skipped, 1)
+	if cfg.lists != nil {
+		cfg.lists.done(cfg, &result{Src: src}, false)
+	}
+	return true
+}
+
+// takeDest returns the destination of src found by precheck, if any.
+func (st *state) takeDest(src string) (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	dest, ok := st.dests[src]
+	delete(st.dests, src)
+	return dest, ok
+}
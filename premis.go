@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"time"
+)
+
+const premisNS = "http://www.loc.gov/premis/v3"
+
+// premisEvent is a PREMIS 3 migration event of a converted file.
+type premisEvent struct {
+	XMLName    xml.Name `xml:"premis:event" json:"-"`
+	NS         string   `xml:"xmlns:premis,attr" json:"-"`
+	Version    string   `xml:"version,attr" json:"-"`
+	Identifier struct {
+		Type  string `xml:"premis:eventIdentifierType" json:"eventIdentifierType"`
+		Value string `xml:"premis:eventIdentifierValue" json:"eventIdentifierValue"`
+	} `xml:"premis:eventIdentifier" json:"eventIdentifier"`
+	Type     string `xml:"premis:eventType" json:"eventType"`
+	DateTime string `xml:"premis:eventDateTime" json:"eventDateTime"`
+	Detail   string `xml:"premis:eventDetailInformation>premis:eventDetail" json:"eventDetail"`
+	Outcome  struct {
+		Outcome string      `xml:"premis:eventOutcome" json:"eventOutcome"`
+		Detail  *premisNote `xml:"premis:eventOutcomeDetail,omitempty" json:"eventOutcomeDetail,omitempty"`
+	} `xml:"premis:eventOutcomeInformation" json:"eventOutcomeInformation"`
+	Agent struct {
+		Type  string `xml:"premis:linkingAgentIdentifierType" json:"linkingAgentIdentifierType"`
+		Value string `xml:"premis:linkingAgentIdentifierValue" json:"linkingAgentIdentifierValue"`
+		Role  string `xml:"premis:linkingAgentRole" json:"linkingAgentRole"`
+	} `xml:"premis:linkingAgentIdentifier" json:"linkingAgentIdentifier"`
+	Objects []premisObject `xml:"premis:linkingObjectIdentifier" json:"linkingObjectIdentifier"`
+}
+
+type premisNote struct {
+	Note string `xml:"premis:eventOutcomeDetailNote" json:"eventOutcomeDetailNote"`
+}
+
+type premisObject struct {
+	Type  string `xml:"premis:linkingObjectIdentifierType" json:"linkingObjectIdentifierType"`
+	Value string `xml:"premis:linkingObjectIdentifierValue" json:"linkingObjectIdentifierValue"`
+	Role  string `xml:"premis:linkingObjectRole" json:"linkingObjectRole"`
+}
+
+// uuid4 returns a random UUID.
+func uuid4() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// writePremis writes the migration event of src into dest next to dest.
+// convErr is the result of the conversion.
+func writePremis(cfg *config, src, dest, engine string, convErr error) error {
+	ev := &premisEvent{NS: premisNS, Version: "3.0"}
+	ev.Identifier.Type = "UUID"
+	ev.Identifier.Value = uuid4()
+	ev.Type = "migration"
+	ev.DateTime = time.Now().Format(time.RFC3339)
+	ev.Detail = fmt.Sprintf("converted with %s engine", engine)
+	ev.Outcome.Outcome = "success"
+	if convErr != nil {
+		ev.Outcome.Outcome = "failure"
+		ev.Outcome.Detail = &premisNote{convErr.Error()}
+	}
+	ev.Agent.Type = "software"
+	ev.Agent.Value = "imconvvips " + version
+	if engine == "vips" && cfg.VipsVersion != "" {
+		ev.Agent.Value += " (vips " + cfg.VipsVersion + ")"
+	}
+	ev.Agent.Role = "executing program"
+	ev.Objects = []premisObject{
+		{"local", src, "source"},
+		{"local", dest, "outcome"},
+	}
+
+	var b []byte
+	var err error
+	if cfg.Premis == "json" {
+		b, err = json.MarshalIndent(ev, "", " ")
+	} else {
+		b, err = xml.MarshalIndent(ev, "", " ")
+		b = append([]byte(xml.Header), b...)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest+".premis."+cfg.Premis, append(b, '\n'), 0644)
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcGroup makes cmd a process group leader which is killed as a group
+// when cancelled.
+func setProcGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// stopProcess asks p to stop as by kill, letting it clean up.
+func stopProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcGroup does nothing; cancelled commands are killed by exec.
+func setProcGroup(cmd *exec.Cmd) {
+}
+
+// stopProcess kills p, which cannot be asked to stop.
+func stopProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// profile is a named set of output settings overriding the top level ones.
+type profile struct {
+	Engine string `json:"engine,omitempty"`
+	// Fmt is the command format of Engine, or save options for libvips.
+	Fmt   string `json:"fmt,omitempty"`
+	Steps []step `json:"steps,omitempty"`
+	// PassThrough overrides -pass-through.
+	PassThrough string `json:"pass_through,omitempty"`
+	// BitDepth overrides -bit-depth, e.g. "keep" for masters and "8" for
+	// access copies.
+	BitDepth string `json:"bit_depth,omitempty"`
+	// Alpha overrides -alpha, e.g. "keep" for masters in tiff.
+	Alpha string `json:"alpha,omitempty"`
+	// Weight is the worker slots a file takes, 1 by default, and Mem the
+	// memory it takes of -mem-budget, e.g. "4G", while converting.
+	Weight int    `json:"weight,omitempty"`
+	Mem    string `json:"mem,omitempty"`
+	// Ext is the extension of the outputs of the profile as one of
+	// -renditions, e.g. ".jp2", the same as the output by default.
+	Ext string `json:"ext,omitempty"`
+}
+
+// step is a command of a chained pipeline.
+type step struct {
+	// Cmd is a format for fmt.Sprintf with two args (input filename, output
+	// filename). the input of the first step is the source and the output
+	// of the last step is the destination.
+	Cmd string `json:"cmd"`
+	// Ext is the extension of the intermediate output, ".v" by default.
+	Ext string `json:"ext,omitempty"`
+}
+
+// withProfile returns a copy of cfg with the profile name applied.
+func (cfg *config) withProfile(name string) (*config, error) {
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	c := *cfg
+	if p.Engine != "" {
+		c.Engine = p.Engine
+	}
+	if p.Fmt != "" {
+		switch c.Engine {
+		case "vips":
+			c.VipsFmt = p.Fmt
+		case "imagemagick":
+			c.IMFmt = p.Fmt
+		case "graphicsmagick":
+			c.GMFmt = p.Fmt
+		case "gpu":
+			c.GPUFmt = p.Fmt
+		case "libvips":
+			c.NativeOpts = p.Fmt
+		case "thumbnail":
+			c.ThumbFmt = p.Fmt
+		}
+	}
+	if len(p.Steps) > 0 {
+		c.Engine = "steps"
+		c.Steps = p.Steps
+	}
+	if p.PassThrough != "" {
+		c.PassThrough = p.PassThrough
+	}
+	if p.BitDepth != "" {
+		c.BitDepth = p.BitDepth
+	}
+	if p.Alpha != "" {
+		c.Alpha = p.Alpha
+	}
+	return &c, nil
+}
+
+// stepsConverter runs cfg.Steps feeding the output of each step to the next
+// through files in the scratch dir.
+type stepsConverter struct {
+	cfg *config
+}
+
+// paths returns the input and output of each step.
+func (c *stepsConverter) paths(src, dest string) [][2]string {
+	var ps [][2]string
+	in := src
+	for i, s := range c.cfg.Steps {
+		out := dest
+		if i < len(c.cfg.Steps)-1 {
+			ext := s.Ext
+			if ext == "" {
+				ext = ".v"
+			}
+			// named after dest so that Command tells the same paths.
+			name := fmt.Sprintf("%x-step%d%s", sha1.Sum([]byte(dest)), i+1, ext)
+			if c.cfg.tmp != nil {
+				out = filepath.Join(c.cfg.tmp.dir, name)
+			} else {
+				out = trimExt(dest) + "." + name
+			}
+		}
+		ps = append(ps, [2]string{in, out})
+		in = out
+	}
+	return ps
+}
+
+func (c *stepsConverter) Name() string {
+	return "steps"
+}
+
+func (c *stepsConverter) Command(src, dest string) string {
+	var cmds []string
+	for i, p := range c.paths(src, dest) {
+		cmds = append(cmds, formatCmd(c.cfg.Steps[i].Cmd, p[0], p[1]))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+func (c *stepsConverter) Convert(w *worker, src, dest string) error {
+	ps := c.paths(src, dest)
+	// intermediate files are removed whatever happens.
+	defer func() {
+		for _, p := range ps[:len(ps)-1] {
+			os.Remove(p[1])
+		}
+	}()
+	for i, p := range ps {
+		s := formatCmd(c.cfg.Steps[i].Cmd, p[0], p[1])
+		if err := runCmd(c.cfg, w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
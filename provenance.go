@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// provenance is the sidecar tracing an output back to its source.
+type provenance struct {
+	Source      string            `json:"source"`
+	SourceHash  string            `json:"source_sha256"`
+	PixelHash   string            `json:"pixel_sha256,omitempty"`
+	Output      string            `json:"output"`
+	Engine      string            `json:"engine"`
+	Command     string            `json:"command"`
+	Tool        string            `json:"tool"`
+	VipsVersion string            `json:"vips_version,omitempty"`
+	Time        time.Time         `json:"time"`
+	Tags        tags              `json:"tags,omitempty"`
+	IDs         map[string]string `json:"ids,omitempty"`
+}
+
+// writeProvenance writes the provenance of r next to its output.
+func writeProvenance(cfg *config, r *result) error {
+	b, err := json.MarshalIndent(&provenance{
+		Source:      r.Src,
+		SourceHash:  r.SrcHash,
+		PixelHash:   r.PixelHash,
+		Output:      r.Dest,
+		Engine:      r.Engine,
+		Command:     r.Cmd,
+		Tool:        "imconvvips " + version,
+		VipsVersion: cfg.VipsVersion,
+		Time:        time.Now(),
+		Tags:        cfg.Tags,
+		IDs:         r.IDs,
+	}, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.Dest+".json", append(b, '\n'), 0644)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// qualitySize is the side both images are scaled to for -quality-gate.
+const qualitySize = 512
+
+// parseQualityGate parses -quality-gate, e.g. "ssim:0.9" or "psnr:30".
+func parseQualityGate(s string) (string, float64, error) {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) == 2 && (kv[0] == "ssim" || kv[0] == "psnr") {
+		if min, err := strconv.ParseFloat(kv[1], 64); err == nil {
+			return kv[0], min, nil
+		}
+	}
+	return "", 0, fmt.Errorf(
+		"quality gate must be \"ssim:MIN\" or \"psnr:MIN\": %q", s)
+}
+
+// thumbnail decodes path scaled to qualitySize squared by vips.
+func thumbnail(cfg *config, path string) (image.Image, error) {
+	png := cfg.tmp.path("quality.png")
+	defer os.Remove(png)
+	_, err := cmdOutput(cfg, fmt.Sprintf(
+		"vips thumbnail %s %s %d --height %d --size force", shellQuote(path),
+		shellQuote(png), qualitySize, qualitySize))
+	if err != nil {
+		return nil, err
+	}
+	return decodeImage(cfg, png, "")
+}
+
+// checkQuality fails dest if it is less similar to src than the minimum of
+// -quality-gate, catching bad quality settings for particular images.
+func checkQuality(cfg *config, src, dest string) error {
+	metric, min, err := parseQualityGate(cfg.QualityGate)
+	if err != nil {
+		return err
+	}
+	a, err := thumbnail(cfg, src)
+	if err != nil {
+		return err
+	}
+	b, err := thumbnail(cfg, dest)
+	if err != nil {
+		return err
+	}
+	v := ssim(a, b)
+	if metric == "psnr" {
+		v = psnr(a, b)
+	}
+	if cfg.Verbose {
+		cfg.Log.Write([]byte(fmt.Sprintf("quality: %s: %s %.4f\n",
+			dest, metric, v)))
+	}
+	if v < min {
+		return fmt.Errorf("quality: %s: %s %.4f is below %g", dest, metric, v,
+			min)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is FICLONE of linux/fs.h.
+const ficlone = 0x40049409
+
+// reflink makes dest a copy of src sharing its blocks until either is
+// written, on file systems which can.
+func reflink(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone,
+		in.Fd())
+	if errno != 0 {
+		out.Close()
+		os.Remove(dest)
+		return errno
+	}
+	return out.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// reflink is not supported on this platform.
+func reflink(src, dest string) error {
+	return errors.New("reflink not supported")
+}
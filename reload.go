@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// reloadConfig rereads config.json and the command line into a copy of cur
+// with the conversion settings replaced: the engines, command formats,
+// profiles, rules, filters of source files, post commands, timeout and
+// retries. the others, e.g. the dirs, stay as they are for the rest of the
+// run.
+func reloadConfig(cur *config) (*config, error) {
+	fresh, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	setFlags(fs, fresh)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	c := *cur
+	c.Ext = fresh.Ext
+	c.WatchStable = fresh.WatchStable
+	c.WatchQuiet = fresh.WatchQuiet
+	c.WatchMarker = fresh.WatchMarker
+	c.Engine = fresh.Engine
+	c.Fallback = fresh.Fallback
+	c.VipsFmt, c.vipsFmt = fresh.VipsFmt, ""
+	c.IMFmt = fresh.IMFmt
+	c.GMFmt = fresh.GMFmt
+	c.NativeOpts = fresh.NativeOpts
+	c.GPUFmt = fresh.GPUFmt
+	c.Steps = fresh.Steps
+	c.Profile = fresh.Profile
+	c.Profiles = fresh.Profiles
+	c.Rules = fresh.Rules
+	c.Post = fresh.Post
+	c.Timeout = fresh.Timeout
+	c.Retries = fresh.Retries
+	if c.Profile != "" {
+		pc, err := c.withProfile(c.Profile)
+		if err != nil {
+			return nil, err
+		}
+		c = *pc
+	}
+	if _, err := converters(&c); err != nil {
+		return nil, err
+	}
+	c.conds = nil
+	for _, r := range c.Rules {
+		if r.Profile != "" {
+			if _, err := c.withProfile(r.Profile); err != nil {
+				return nil, err
+			}
+		}
+		cs, err := parseCond(r.If)
+		if err != nil {
+			return nil, err
+		}
+		c.conds = append(c.conds, cs)
+	}
+	if !c.DryRun && c.Engine == "vips" && c.VipsCheck != "off" {
+		if err := checkVips(&c); err != nil {
+			return nil, err
+		}
+	}
+	// a plan runs by the commands reviewed.
+	if n := diffCommands(cur, &c); c.Plan != "" && n != "" {
+		return nil, fmt.Errorf("%s differs from the plan", n)
+	}
+	return &c, nil
+}
+
+// reload applies reloaded settings to the files dispatched from now on.
+// files being converted go on with the old ones.
+func reload(cfg *config, st *state) error {
+	c, err := reloadConfig(st.config(cfg))
+	if err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf(
+			"error: reload: %s, keeping the settings\n", err)))
+		return err
+	}
+	st.mu.Lock()
+	st.reloaded = c
+	st.mu.Unlock()
+	cfg.Log.Write([]byte("info: reloaded the settings\n"))
+	return nil
+}
+
+// config returns the settings for the next file, cfg unless reloaded.
+func (st *state) config(cfg *config) *config {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.reloaded != nil {
+		return st.reloaded
+	}
+	return cfg
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// multiConverter writes several outputs from a decode of a source, as
+// libvips linked in does.
+type multiConverter interface {
+	converter
+	// ConvertAll writes each of dests, filenames with save options.
+	ConvertAll(w *worker, src string, dests []string) error
+}
+
+// renditionNames returns the profiles of cfg.Renditions.
+func renditionNames(cfg *config) []string {
+	var names []string
+	for _, n := range strings.Split(cfg.Renditions, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// checkRenditions checks that the profiles of cfg.Renditions are saved by
+// libvips.
+func checkRenditions(cfg *config) error {
+	if cfg.Engine != "libvips" {
+		return errors.New("renditions need the libvips engine")
+	}
+	for _, n := range renditionNames(cfg) {
+		p, ok := cfg.Profiles[n]
+		switch {
+		case !ok:
+			return fmt.Errorf("renditions: unknown profile: %s", n)
+		case (p.Engine != "" && p.Engine != "libvips") || len(p.Steps) > 0:
+			return fmt.Errorf("renditions: profile %s is not of libvips", n)
+		}
+	}
+	return nil
+}
+
+// renditionConfig returns the output settings of the profile name of
+// cfg.Renditions: those of cfg with the save options and extension of the
+// profile, without post commands, which are run on the output only.
+func renditionConfig(cfg *config, name string) *config {
+	c := *cfg
+	p := cfg.Profiles[name]
+	if p.Fmt != "" {
+		c.NativeOpts = p.Fmt
+	}
+	if p.Ext != "" {
+		c.DestExt = p.Ext
+	}
+	c.Post = nil
+	return &c
+}
+
+// renditionDest returns the output of the profile name for dest, in the
+// dir of the profile in the destination dir with the extension of the
+// profile if it has one.
+func renditionDest(cfg *config, dest, name string) (string, error) {
+	rel, err := filepath.Rel(cfg.DestDir, dest)
+	if err != nil {
+		return "", err
+	}
+	d := filepath.Join(cfg.DestDir, name, rel)
+	if ext := cfg.Profiles[name].Ext; ext != "" {
+		d = withExt(d, ext)
+	}
+	return d, nil
+}
+
+// convertRenditions converts src, r.Src or what is made of it, into the
+// outputs of the profiles names, and r.Dest as well if main, from a decode
+// of it with conv, filling r.Renditions.
+func convertRenditions(cfg *config, w *worker, conv converter, r *result,
+	src, frames string, names []string, main bool) error {
+	mc, ok := conv.(multiConverter)
+	if !ok {
+		return fmt.Errorf("renditions: %s decodes a source for an output",
+			conv.Name())
+	}
+	var dests, made []string
+	if main {
+		dests = append(dests, r.Dest+cfg.NativeOpts)
+	}
+	if r.Renditions == nil {
+		r.Renditions = map[string]string{}
+	}
+	for _, n := range names {
+		d, err := renditionDest(cfg, r.Dest, n)
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(longPath(filepath.Dir(d)), 0755)
+		r.Renditions[n] = d
+		made = append(made, d)
+		dests = append(dests, d+renditionConfig(cfg, n).NativeOpts)
+	}
+	in := src + framesSuffix(conv.Name(), frames)
+	r.Cmd = fmt.Sprintf("libvips: load %s once, save %s", in,
+		strings.Join(dests, ", "))
+	if err := mc.ConvertAll(w, in, dests); err != nil {
+		for _, d := range made {
+			os.Remove(longPath(d))
+		}
+		return err
+	}
+	return nil
+}
+
+// renditionKey returns the cache key of the output of the profile name of
+// a source with the hash h.
+func renditionKey(cfg *config, name, h string) string {
+	return cacheKey(renditionConfig(cfg, name), h)
+}
+
+// cacheRenditions stores the outputs of r.Renditions in the cache.
+func cacheRenditions(cfg *config, r *result) {
+	for n, d := range r.Renditions {
+		if err := toCache(cfg, renditionKey(cfg, n, r.SrcHash), d); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: cache: %s\n", err)))
+		}
+	}
+}
+
+// renditionsOnly writes the outputs of cfg.Renditions for r, whose output
+// was passed through or taken from the cache: those in the cache from it,
+// the others converted from a decode of the source with conv.
+func renditionsOnly(cfg *config, w *worker, conv converter,
+	r *result) error {
+	if cfg.Renditions == "" {
+		return nil
+	}
+	r.Renditions = map[string]string{}
+	var names []string
+	for _, n := range renditionNames(cfg) {
+		if cfg.CacheDir != "" && r.SrcHash != "" {
+			d, err := renditionDest(cfg, r.Dest, n)
+			if err != nil {
+				return err
+			}
+			os.MkdirAll(longPath(filepath.Dir(d)), 0755)
+			ok, err := fromCache(cfg, renditionKey(cfg, n, r.SrcHash), d)
+			if err != nil {
+				return err
+			}
+			if ok {
+				r.Renditions[n] = d
+				continue
+			}
+		}
+		names = append(names, n)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	done := cfg.slots.take(cfg, r.Profile)
+	defer done()
+	in, pre, clean, err := fitSource(cfg, w, r.Src, r.frames, r.Dest)
+	defer clean()
+	if err != nil {
+		return err
+	}
+	err = convertRenditions(cfg, w, conv, r, in, r.frames, names, false)
+	r.Cmd = strings.Join(append(pre, r.Cmd), " && ")
+	if err != nil {
+		return err
+	}
+	if cfg.CacheDir != "" && r.SrcHash != "" {
+		cacheRenditions(cfg, r)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// naturalLess compares a and b treating digit runs as numbers,
+// so that img_2 < img_10.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := isDigit(a[0]), isDigit(b[0])
+		switch {
+		case da && db:
+			na, nb := digits(a), digits(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			a, b = a[len(na):], b[len(nb):]
+		case a[0] != b[0]:
+			return a[0] < b[0]
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func digits(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+// numberFiles assigns sequence numbers from 1 to srcs per directory in
+// natural order of their names.
+func numberFiles(srcs []string) map[string]int {
+	dirs := map[string][]string{}
+	for _, src := range srcs {
+		d := filepath.Dir(src)
+		dirs[d] = append(dirs[d], src)
+	}
+	seq := map[string]int{}
+	for _, fs := range dirs {
+		sort.Slice(fs, func(i, j int) bool {
+			return naturalLess(filepath.Base(fs[i]), filepath.Base(fs[j]))
+		})
+		for i, f := range fs {
+			seq[f] = i + 1
+		}
+	}
+	return seq
+}
+
+// needSequence tells if sources are numbered for -renumber or {{.Seq}} of
+// -dest-template.
+func needSequence(cfg *config) bool {
+	return cfg.Renumber || strings.Contains(cfg.DestTemplate, ".Seq")
+}
+
+// loadSequence walks the sources in advance for -renumber.
+func loadSequence(cfg *config, st *state) error {
+	srcs, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+	st.seq = numberFiles(srcs)
+	return nil
+}
+
+// seqName returns the renumbered name of slash separated rel for src.
+func seqName(cfg *config, st *state, src, rel string) string {
+	n, ok := st.seq[src]
+	if !ok {
+		return rel
+	}
+	name := fmt.Sprintf("%0*d%s", cfg.RenumberWidth, n, filepath.Ext(rel))
+	if i := strings.LastIndex(rel, "/"); i >= 0 {
+		return rel[:i+1] + name
+	}
+	return name
+}
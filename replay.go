@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+)
+
+// loadFailed returns the files whose last records in the results file at
+// path failed, in the order they were recorded, as planned entries to
+// convert them again into the same destinations with the same profiles.
+// files failed before their destinations were decided have none.
+func loadFailed(cfg *config, path string) ([]*planEntry, error) {
+	bySrc, all, err := loadResults(path)
+	if err != nil {
+		return nil, err
+	}
+	var es []*planEntry
+	for _, r := range all {
+		if bySrc[r.Src] != r || r.Status != "failed" {
+			continue
+		}
+		es = append(es, &planEntry{Src: r.Src, Dest: r.Dest,
+			Profile: r.Profile})
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("info: %d files failed in %s\n",
+		len(es), path)))
+	return es, nil
+}
+
+// replayWalk queues the sources of es.
+func replayWalk(es []*planEntry, q chan string) error {
+	for _, e := range es {
+		q <- e.Src
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// result is the record of a file in a results file.
+type result struct {
+	Src       string            `json:"src"`
+	Dest      string            `json:"dest,omitempty"`
+	Status    string            `json:"status"` // converted, cached, passed-through, promoted, failed or missing
+	Error     string            `json:"error,omitempty"`
+	Class     string            `json:"class,omitempty"` // of failures
+	Profile   string            `json:"profile,omitempty"`
+	Engine    string            `json:"engine,omitempty"`
+	Cmd       string            `json:"cmd,omitempty"`
+	SrcHash   string            `json:"src_sha256,omitempty"`
+	PixelHash string            `json:"pixel_sha256,omitempty"` // -verify-lossless
+	Start     time.Time         `json:"start"`
+	Duration  float64           `json:"duration"` // seconds
+	Tags      tags              `json:"tags,omitempty"`
+	IDs       map[string]string `json:"ids,omitempty"`  // by -id-regex
+	List      string            `json:"list,omitempty"` // in filelist mode
+	Line      int               `json:"line,omitempty"`
+	// the output settings and generation of Dest with -generations.
+	ProfileKey string `json:"profile_key,omitempty"`
+	Gen        int    `json:"generation,omitempty"`
+	// the outputs of -renditions by profile.
+	Renditions map[string]string `json:"renditions,omitempty"`
+
+	trace *fileTrace // if sampled by -otlp
+	// the policy of -animated for an animated source.
+	frames string
+}
+
+func (r *result) ok() bool {
+	return r.Status != "failed" && r.Status != "missing"
+}
+
+// loadResults reads a results file. later records of a source win.
+func loadResults(path string) (map[string]*result, []*result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	bySrc := map[string]*result{}
+	var all []*result
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		r := &result{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", path, err)
+		}
+		bySrc[r.Src] = r
+		all = append(all, r)
+	}
+	return bySrc, all, scanner.Err()
+}
+
+// throughput returns converted files per second over the span of rs.
+func throughput(rs []*result) float64 {
+	var first, last time.Time
+	n := 0
+	for _, r := range rs {
+		end := r.Start.Add(time.Duration(r.Duration * float64(time.Second)))
+		if first.IsZero() || r.Start.Before(first) {
+			first = r.Start
+		}
+		if end.After(last) {
+			last = end
+		}
+		if r.ok() {
+			n++
+		}
+	}
+	if d := last.Sub(first).Seconds(); d > 0 {
+		return float64(n) / d
+	}
+	return 0
+}
+
+// reportMain prints reports over results files.
+func reportMain(cfg *config, args []string) error {
+	if len(args) != 3 || args[0] != "diff" {
+		return errors.New("usage: report diff RESULTS_A RESULTS_B")
+	}
+	a, allA, err := loadResults(args[1])
+	if err != nil {
+		return err
+	}
+	b, allB, err := loadResults(args[2])
+	if err != nil {
+		return err
+	}
+
+	var newlyFailed, fixed, added, removed []string
+	for src, rb := range b {
+		ra, ok := a[src]
+		switch {
+		case !ok:
+			added = append(added, src)
+		case ra.ok() && !rb.ok():
+			newlyFailed = append(newlyFailed, src)
+		case !ra.ok() && rb.ok():
+			fixed = append(fixed, src)
+		}
+	}
+	for src := range a {
+		if _, ok := b[src]; !ok {
+			removed = append(removed, src)
+		}
+	}
+
+	section := func(title string, srcs []string, rs map[string]*result) {
+		sort.Strings(srcs)
+		fmt.Printf("%s: %d\n", title, len(srcs))
+		for _, src := range srcs {
+			if r := rs[src]; r != nil && r.Error != "" {
+				fmt.Printf("  %s\n    %s\n", src, r.Error)
+			} else {
+				fmt.Printf("  %s\n", src)
+			}
+		}
+	}
+	section("newly failed", newlyFailed, b)
+	section("fixed", fixed, nil)
+	section("added sources", added, nil)
+	section("missing sources", removed, nil)
+
+	ta, tb := throughput(allA), throughput(allB)
+	fmt.Printf("throughput: %.2f -> %.2f files/s", ta, tb)
+	if ta > 0 {
+		fmt.Printf(" (%+.1f%%)", (tb-ta)/ta*100)
+	}
+	fmt.Println()
+	return nil
+}
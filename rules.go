@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// rule chooses a profile for files matching If, e.g.
+//
+//	{"if": "width > 10000", "profile": "huge"}
+//
+// rules are tried in order and files matching none of them are converted with
+// the top level settings. an empty If matches every file.
+type rule struct {
+	If      string `json:"if,omitempty"`
+	Profile string `json:"profile"`
+}
+
+// cond is a comparison of a file property with a value.
+type cond struct {
+	key, op, val string
+}
+
+var condOps = []string{">=", "<=", "!=", "==", ">", "<"}
+
+// parseCond parses conditions joined by "and", e.g.
+// "width > 10000 and bands == 3".
+func parseCond(s string) ([]cond, error) {
+	var cs []cond
+	if strings.TrimSpace(s) == "" {
+		return cs, nil
+	}
+	for _, e := range strings.Split(s, " and ") {
+		var c cond
+		for _, op := range condOps {
+			if i := strings.Index(e, op); i >= 0 {
+				c = cond{strings.TrimSpace(e[:i]), op,
+					strings.TrimSpace(e[i+len(op):])}
+				break
+			}
+		}
+		if c.key == "" || c.val == "" {
+			return nil, fmt.Errorf("bad rule condition: %q", e)
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// match reports whether props satisfy c. values are compared as numbers if
+// both are numbers and as strings otherwise.
+func (c cond) match(props map[string]string) bool {
+	v, ok := props[c.key]
+	if !ok {
+		return false
+	}
+	a, err1 := strconv.ParseFloat(v, 64)
+	b, err2 := strconv.ParseFloat(c.val, 64)
+	cmp := strings.Compare(v, c.val)
+	if err1 == nil && err2 == nil {
+		cmp = 0
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	}
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case "==":
+		return cmp == 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return false
+}
+
+// probe returns the header fields of src as listed by "vipsheader -a"
+// along with "filesize" and "ext".
+func probe(cfg *config, src string) (map[string]string, error) {
+	fi, err := os.Stat(longPath(src))
+	if err != nil {
+		return nil, err
+	}
+	props := map[string]string{
+		"filesize": strconv.FormatInt(fi.Size(), 10),
+		"ext":      strings.TrimPrefix(filepath.Ext(src), "."),
+	}
+	out, err := cmdOutput(cfg, formatCmd("vipsheader -a %s", src))
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ": ", 2)
+		if len(kv) == 2 {
+			props[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return props, nil
+}
+
+// branch returns the profile of the first rule src matches, or "" for the
+// top level settings.
+func (cfg *config) branch(src string) (string, error) {
+	var props map[string]string
+	for i, cs := range cfg.conds {
+		if len(cs) > 0 && props == nil {
+			var err error
+			if props, err = probe(cfg, src); err != nil {
+				return "", err
+			}
+		}
+		ok := true
+		for _, c := range cs {
+			if !c.match(props) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return cfg.Rules[i].Profile, nil
+		}
+	}
+	return "", nil
+}
+
+// branch is a profile chosen by rules with its converters.
+type branch struct {
+	cfg   *config
+	convs []converter
+}
+
+// converters returns the settings and converters of the profile name,
+// creating them at the first use by w.
+func (w *worker) converters(cfg *config, name string) (*config, []converter,
+	error) {
+	if b, ok := w.profiles[name]; ok {
+		return b.cfg, b.convs, nil
+	}
+	pc, err := cfg.withProfile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	convs, err := converters(pc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.profiles == nil {
+		w.profiles = map[string]*branch{}
+	}
+	w.profiles[name] = &branch{pc, convs}
+	return pc, convs, nil
+}
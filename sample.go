@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func (cfg *config) sampling() bool {
+	return cfg.Sample > 0 || cfg.SamplePercent > 0
+}
+
+// collect walks all source files with the source extension.
+func collect(cfg *config) ([]string, error) {
+	var srcs []string
+	q := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- walk(cfg, q)
+		close(q)
+	}()
+	for src := range q {
+		if matchExt(cfg, src) {
+			srcs = append(srcs, src)
+		}
+	}
+	return srcs, <-errc
+}
+
+// sampleWalk queues a random or stratified subset of the source files.
+func sampleWalk(cfg *config, q chan string) error {
+	srcs, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+
+	n := cfg.Sample
+	if cfg.SamplePercent > 0 {
+		n = int(math.Ceil(float64(len(srcs)) * cfg.SamplePercent / 100))
+	}
+	if n > len(srcs) {
+		n = len(srcs)
+	}
+
+	seed := cfg.SampleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+
+	var picked []int
+	if cfg.SampleStrategy == "stratified" {
+		picked = stratified(r, srcs, n)
+	} else {
+		picked = r.Perm(len(srcs))[:n]
+	}
+	// keep walking order.
+	sort.Ints(picked)
+
+	if cfg.Verbose {
+		cfg.Log.Write([]byte(fmt.Sprintf("sample: %d of %d files (seed %d)\n",
+			len(picked), len(srcs), seed)))
+	}
+	for _, i := range picked {
+		q <- srcs[i]
+	}
+	return nil
+}
+
+// stratified picks n indexes from srcs spreading them over directories in
+// proportion to their sizes, at least one per directory while n allows.
+func stratified(r *rand.Rand, srcs []string, n int) []int {
+	var dirs []string
+	groups := map[string][]int{}
+	for i, src := range srcs {
+		d := filepath.Dir(src)
+		if _, ok := groups[d]; !ok {
+			dirs = append(dirs, d)
+		}
+		groups[d] = append(groups[d], i)
+	}
+
+	quota := map[string]int{}
+	rest := n
+	if n >= len(dirs) {
+		for _, d := range dirs {
+			quota[d] = 1
+		}
+		rest -= len(dirs)
+	}
+	// distribute the rest in proportion, largest remainders first.
+	type frac struct {
+		dir string
+		f   float64
+	}
+	var fracs []frac
+	given := 0
+	for _, d := range dirs {
+		want := float64(rest) * float64(len(groups[d])) / float64(len(srcs))
+		k := int(want)
+		if quota[d]+k > len(groups[d]) {
+			k = len(groups[d]) - quota[d]
+		}
+		quota[d] += k
+		given += k
+		fracs = append(fracs, frac{d, want - float64(int(want))})
+	}
+	sort.SliceStable(fracs, func(i, j int) bool { return fracs[i].f > fracs[j].f })
+	for given < rest {
+		progress := false
+		for _, f := range fracs {
+			if given < rest && quota[f.dir] < len(groups[f.dir]) {
+				quota[f.dir]++
+				given++
+				progress = true
+			}
+		}
+		if !progress {
+			break
+		}
+	}
+
+	var picked []int
+	for _, d := range dirs {
+		g := groups[d]
+		for _, j := range r.Perm(len(g))[:quota[d]] {
+			picked = append(picked, g[j])
+		}
+	}
+	return picked
+}
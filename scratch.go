@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scratchPrefix = "imconvvips-"
+
+// parseSize parses sizes like "512M" or "10G" in bytes. "" is 0.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	mul := int64(1)
+	for i, u := range "KMGT" {
+		if strings.HasSuffix(s, string(u)) {
+			mul = 1 << (10 * uint(i+1))
+			s = strings.TrimSuffix(s, string(u))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(n * float64(mul)), nil
+}
+
+// scratch is a per process temporary directory for intermediate files,
+// removed on exit.
+type scratch struct {
+	dir  string
+	max  int64
+	lock *os.File
+
+	mu   sync.Mutex
+	seq  int
+	done bool
+}
+
+// scratchLock is the file in a scratch directory its process keeps locked.
+const scratchLock = ".lock"
+
+// newScratch creates the scratch directory under base after removing ones
+// left by crashed processes. it is named after the host, as base may be
+// shared with other hosts.
+func newScratch(cfg *config, base string, max int64) (*scratch, error) {
+	if base == "" {
+		base = os.TempDir()
+	}
+	host := scratchHost()
+	cleanStaleScratch(cfg, base, host)
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(base, scratchPrefix+host+"-")
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, scratchLock))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &scratch{dir: dir, max: max, lock: lock}, nil
+}
+
+// scratchHost returns the host name for names of scratch directories.
+func scratchHost() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "localhost"
+	}
+	return strings.NewReplacer("-", "_", string(filepath.Separator), "_").
+		Replace(host)
+}
+
+// cleanStaleScratch removes scratch directories of host whose processes
+// no longer hold their locks.
+func cleanStaleScratch(cfg *config, base, host string) {
+	prefix := scratchPrefix + host + "-"
+	dirs, _ := filepath.Glob(filepath.Join(base, prefix+"*"))
+	for _, d := range dirs {
+		_, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(d), prefix),
+			10, 64)
+		if err != nil || locked(filepath.Join(d, scratchLock)) {
+			continue
+		}
+		// one just made may not be locked yet.
+		fi, err := os.Stat(d)
+		if err != nil || time.Since(fi.ModTime()) < time.Minute {
+			continue
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("info: removing stale %s\n", d)))
+		os.RemoveAll(d)
+	}
+}
+
+// path returns a new file name in the scratch directory.
+func (s *scratch) path(name string) string {
+	s.mu.Lock()
+	s.seq++
+	n := s.seq
+	s.mu.Unlock()
+	return filepath.Join(s.dir, fmt.Sprintf("%d-%s", n, filepath.Base(name)))
+}
+
+// usage returns the total size of files in the scratch directory.
+func (s *scratch) usage() int64 {
+	var n int64
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
+
+// wait blocks while the scratch directory is over its size cap.
+func (s *scratch) wait() {
+	if s == nil || s.max <= 0 {
+		return
+	}
+	for s.usage() >= s.max {
+		time.Sleep(time.Second)
+	}
+}
+
+// remove removes the scratch directory.
+func (s *scratch) remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.done {
+		s.lock.Close()
+		os.RemoveAll(s.dir)
+		s.done = true
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shellCommand returns the command w ran to convert src to dest with conv,
+// post processing included, as sh would take it by hand: with the
+// variables and cpu set of w, the whole environment of -isolate-env, and
+// with the redirections of -vips-stream.
+// it is "" if conv runs no command, e.g. libvips linked in.
+func shellCommand(cfg *config, w *worker, conv converter, src,
+	dest string) string {
+	var s string
+	switch c := conv.(type) {
+	case *cmdConverter:
+		s = c.Command(src, dest)
+		if c.stream == "in" || c.stream == "both" {
+			s += " < " + shellQuote(src)
+		}
+		if c.stream == "out" || c.stream == "both" {
+			s += " > " + shellQuote(dest)
+		}
+	case *stepsConverter:
+		s = c.Command(src, dest)
+	default:
+		return ""
+	}
+	for _, f := range cfg.Post {
+		s += " && " + formatCmd(f, dest)
+	}
+
+	// as runCmdOnce runs it, in the environment of the operator as well
+	// unless -isolate-env.
+	vars := append(append([]string{}, cfg.Env...), childVars(cfg, w)...)
+	if cfg.IsolateEnv {
+		vars = append(baseEnv(cfg), childVars(cfg, w)...)
+	}
+	if len(vars) == 0 && w.cpuset == "" && !cfg.IsolateEnv {
+		return s
+	}
+	var pre []string
+	if cfg.IsolateEnv {
+		pre = append(pre, "env", "-i")
+	} else if len(vars) > 0 {
+		pre = append(pre, "env")
+	}
+	for _, v := range vars {
+		pre = append(pre, shellQuote(v))
+	}
+	if w.cpuset != "" {
+		pre = append(pre, "taskset", "-c", w.cpuset)
+	}
+	return strings.Join(pre, " ") + " sh -c " + shellQuote(s)
+}
+
+// writeScriptHead starts the script of -emit-script.
+func writeScriptHead(w io.Writer) {
+	fmt.Fprintf(w, "#!/bin/sh\n# by imconvvips %s at %s, a command for a file.\n",
+		version, time.Now().Format(time.RFC3339))
+}
+
+// writeScript appends the command of r to the script of -emit-script,
+// making the dir of its output first. the description of libvips linked
+// in is written as a comment.
+func writeScript(w io.Writer, r *result) {
+	fmt.Fprintf(w, "\n# %q (%s)\n", r.Src, r.Status)
+	if r.Engine == "libvips" {
+		fmt.Fprintf(w, "# %s\n", r.Cmd)
+		return
+	}
+	fmt.Fprintf(w, "mkdir -p %s && %s\n", shellQuote(filepath.Dir(r.Dest)),
+		r.Cmd)
+}
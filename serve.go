@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queuedRun is a run submitted to the queue server, carried out by a child
+// imconvvips with its args.
+type queuedRun struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"` // name of the api key
+	Args      []string  `json:"args"`
+	Priority  int       `json:"priority"` // higher first
+	Proc      int       `json:"proc"`     // workers, -p of the run
+	Status    string    `json:"status"`   // queued, running, done, failed or cancelled
+	Exit      int       `json:"exit"`
+	Err       string    `json:"error,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	Started   time.Time `json:"started"`
+	Ended     time.Time `json:"ended"`
+
+	proc      *os.Process
+	cancelled bool
+}
+
+func (qr *queuedRun) active() bool {
+	return qr.Status == "queued" || qr.Status == "running"
+}
+
+var runNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// queueServer runs submitted runs by priority within quotas of concurrent
+// runs and workers, keeping them in a json store to survive restarts.
+type queueServer struct {
+	cfg     *config
+	exe     string
+	store   string
+	logDir  string
+	maxRuns int
+	maxProc int
+	keys    []*apiKey // nil to take requests without keys
+
+	mu       sync.Mutex
+	runs     map[string]*queuedRun
+	stopping bool
+}
+
+// load reads the store. runs left running by a stopped server are queued
+// again.
+func (s *queueServer) load() error {
+	s.runs = map[string]*queuedRun{}
+	b, err := os.ReadFile(s.store)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var runs []*queuedRun
+	if err := json.Unmarshal(b, &runs); err != nil {
+		return fmt.Errorf("%s: %s", s.store, err)
+	}
+	for _, qr := range runs {
+		if qr.active() {
+			// submitted before the args were checked as they are now.
+			fs, err := checkArgs(qr.Args)
+			if err == nil {
+				err = checkKeyArgs(s.owner(qr.Owner), fs)
+			}
+			if err != nil {
+				qr.Status, qr.Err = "failed", err.Error()
+			}
+		}
+		if qr.Status == "running" {
+			s.cfg.Log.Write([]byte(fmt.Sprintf(
+				"info: run %s was stopped with the server, queued again\n",
+				qr.Name)))
+			qr.Status = "queued"
+		}
+		s.runs[qr.Name] = qr
+	}
+	return nil
+}
+
+// list returns the runs in the order of submission. s.mu is held.
+func (s *queueServer) list() []*queuedRun {
+	runs := make([]*queuedRun, 0, len(s.runs))
+	for _, qr := range s.runs {
+		runs = append(runs, qr)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Submitted.Before(runs[j].Submitted)
+	})
+	return runs
+}
+
+// save writes the store, replacing it at once. s.mu is held.
+func (s *queueServer) save() {
+	b, err := json.MarshalIndent(s.list(), "", " ")
+	if err == nil {
+		tmp := s.store + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, s.store)
+		}
+	}
+	if err != nil {
+		s.cfg.Log.Write([]byte(fmt.Sprintf("error: %s: %s\n", s.store, err)))
+	}
+}
+
+// submit queues qr for k, taking over a finished run of the same name.
+func (s *queueServer) submit(k *apiKey, qr *queuedRun) error {
+	if !runNameRe.MatchString(qr.Name) {
+		return fmt.Errorf("bad run name %q", qr.Name)
+	}
+	fs, err := checkArgs(qr.Args)
+	if err != nil {
+		return err
+	}
+	if err := checkKeyArgs(k, fs); err != nil {
+		return err
+	}
+	if qr.Proc < 0 {
+		return errors.New("proc must not be negative")
+	}
+	if qr.Proc == 0 {
+		qr.Proc = s.cfg.Proc
+	}
+	if s.maxProc > 0 && qr.Proc > s.maxProc {
+		return fmt.Errorf("proc %d is over the quota of %d", qr.Proc,
+			s.maxProc)
+	}
+	qr.Owner = ""
+	if k != nil {
+		if k.MaxProc > 0 && qr.Proc > k.MaxProc {
+			return fmt.Errorf("proc %d is over the quota of %s, %d", qr.Proc,
+				k.Name, k.MaxProc)
+		}
+		qr.Owner = k.Name
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.runs[qr.Name]; old != nil && old.active() {
+		return errRunExists
+	}
+	qr.Status = "queued"
+	qr.Submitted = time.Now()
+	s.runs[qr.Name] = qr
+	s.cfg.Log.Write([]byte(fmt.Sprintf("info: run %s queued (priority %d)\n",
+		qr.Name, qr.Priority)))
+	s.save()
+	s.schedule()
+	return nil
+}
+
+// checkArgs parses args as the child running them would, so that a run
+// with unknown or bad options, or with anything but options, e.g. a
+// subcommand, is refused on submission rather than left to the child. it
+// returns the options given.
+func checkArgs(args []string) (*flag.FlagSet, error) {
+	var c config
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	setFlags(fs, &c)
+	if err := fs.Parse(args); err != nil {
+		return nil, fmt.Errorf("bad args: %s", err)
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("bad arg %q, options only", fs.Arg(0))
+	}
+	return fs, nil
+}
+
+var errRunExists = errors.New("the run is queued or running")
+
+// cancel drops a queued run or stops a running one.
+func (s *queueServer) cancel(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qr := s.runs[name]
+	switch qr.Status {
+	case "queued":
+		qr.Status = "cancelled"
+		qr.Ended = time.Now()
+		s.save()
+	case "running":
+		qr.cancelled = true
+		if err := stopProcess(qr.proc); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("the run is %s", qr.Status)
+	}
+	s.cfg.Log.Write([]byte(fmt.Sprintf("info: run %s cancelled\n", name)))
+	return nil
+}
+
+// schedule starts queued runs, the highest priority first, as far as the
+// quotas allow. a run does not overtake another of higher priority waiting
+// for workers, unless it waits for the quotas of its key. s.mu is held.
+func (s *queueServer) schedule() {
+	for !s.stopping {
+		running, procs := 0, 0
+		ownRuns, ownProcs := map[string]int{}, map[string]int{}
+		for _, qr := range s.runs {
+			if qr.Status == "running" {
+				running++
+				procs += qr.Proc
+				ownRuns[qr.Owner]++
+				ownProcs[qr.Owner] += qr.Proc
+			}
+		}
+		var next *queuedRun
+		for _, qr := range s.list() {
+			if qr.Status != "queued" ||
+				(next != nil && qr.Priority <= next.Priority) {
+				continue
+			}
+			if k := s.owner(qr.Owner); k != nil &&
+				((k.MaxRuns > 0 && ownRuns[k.Name] >= k.MaxRuns) ||
+					(k.MaxProc > 0 && ownProcs[k.Name]+qr.Proc > k.MaxProc)) {
+				continue
+			}
+			next = qr
+		}
+		if next == nil || running >= s.maxRuns ||
+			(s.maxProc > 0 && procs+next.Proc > s.maxProc) {
+			return
+		}
+		s.start(next)
+	}
+}
+
+// start runs qr in a child process logging into the log dir. s.mu is held.
+func (s *queueServer) start(qr *queuedRun) {
+	qr.Started, qr.Ended = time.Now(), time.Time{}
+	qr.Exit, qr.Err, qr.cancelled = 0, "", false
+	// after the args of the run to take over theirs.
+	args := append(append(qr.Args[:len(qr.Args):len(qr.Args)],
+		"-p", fmt.Sprint(qr.Proc)), quotaArgs(s.owner(qr.Owner), qr.Args)...)
+	f, err := os.Create(filepath.Join(s.logDir, qr.Name+".log"))
+	if err != nil {
+		s.end(qr, err)
+		return
+	}
+	cmd := exec.Command(s.exe, args...)
+	cmd.Stdout, cmd.Stderr = f, f
+	if err := cmd.Start(); err != nil {
+		f.Close()
+		s.end(qr, err)
+		return
+	}
+	qr.Status = "running"
+	qr.proc = cmd.Process
+	s.cfg.Log.Write([]byte(fmt.Sprintf("info: run %s started (pid %d)\n",
+		qr.Name, cmd.Process.Pid)))
+	s.save()
+
+	go func() {
+		err := cmd.Wait()
+		f.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.end(qr, err)
+		s.schedule()
+	}()
+}
+
+// end records how qr ended. s.mu is held.
+func (s *queueServer) end(qr *queuedRun, err error) {
+	if s.stopping {
+		// left running in the store to be queued again.
+		return
+	}
+	qr.Ended = time.Now()
+	qr.proc = nil
+	var ee *exec.ExitError
+	switch {
+	case qr.cancelled:
+		qr.Status = "cancelled"
+	case err == nil:
+		qr.Status = "done"
+	default:
+		qr.Status = "failed"
+		qr.Err = err.Error()
+	}
+	if errors.As(err, &ee) {
+		qr.Exit = ee.ExitCode()
+	}
+	s.cfg.Log.Write([]byte(fmt.Sprintf("info: run %s %s (exit %d)\n",
+		qr.Name, qr.Status, qr.Exit)))
+	s.save()
+}
+
+// stopAll stops the running runs, which are queued again on the next start.
+func (s *queueServer) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopping = true
+	for _, qr := range s.runs {
+		if qr.proc != nil {
+			stopProcess(qr.proc)
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handler serves
+//
+//	GET    /runs           the runs
+//	POST   /runs           {"name", "args", "priority", "proc"} to submit
+//	GET    /runs/NAME      a run
+//	DELETE /runs/NAME      to cancel it
+//	GET    /runs/NAME/log  its output
+//
+// to the runs of the key of the request if keys are required.
+func (s *queueServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/runs", func(w http.ResponseWriter, r *http.Request) {
+		k, ok := s.auth(w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			runs := []*queuedRun{}
+			for _, qr := range s.list() {
+				if visible(k, qr) {
+					runs = append(runs, qr)
+				}
+			}
+			writeJSON(w, http.StatusOK, runs)
+		case http.MethodPost:
+			// not a form, which pages of other sites can post.
+			mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mt != "application/json" {
+				http.Error(w, "content type must be application/json",
+					http.StatusUnsupportedMediaType)
+				return
+			}
+			var qr queuedRun
+			if err := json.NewDecoder(r.Body).Decode(&qr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err := s.submit(k, &qr)
+			s.cfg.audit.record(keyActor(k, r), "submit", qr.Name, err)
+			if err == errRunExists {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			writeJSON(w, http.StatusCreated, &qr)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/runs/", func(w http.ResponseWriter, r *http.Request) {
+		k, ok := s.auth(w, r)
+		if !ok {
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/runs/")
+		name, log := strings.CutSuffix(name, "/log")
+		s.mu.Lock()
+		qr := s.runs[name]
+		s.mu.Unlock()
+		if qr == nil || !visible(k, qr) {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case log && r.Method == http.MethodGet:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.ServeFile(w, r, filepath.Join(s.logDir, name+".log"))
+		case !log && r.Method == http.MethodGet:
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			writeJSON(w, http.StatusOK, qr)
+		case !log && r.Method == http.MethodDelete:
+			err := s.cancel(name)
+			s.cfg.audit.record(keyActor(k, r), "cancel", name, err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			writeJSON(w, http.StatusOK, qr)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// guard refuses requests to the server on addr from other sites open in a
+// browser: changes need to come from the same origin, and on localhost
+// without keys, requests need to be for localhost, not for names of other
+// sites resolving to it.
+func (s *queueServer) guard(addr string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.keys == nil && loopback(addr) && !loopback(hostPort(r.Host)) {
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			!sameOrigin(r) {
+			action := "cancel"
+			if r.Method == http.MethodPost {
+				action = "submit"
+			}
+			s.cfg.audit.record(httpActor(r), action,
+				strings.TrimPrefix(r.URL.Path, "/runs/"),
+				errors.New("cross-origin request"))
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveMain runs the queue server.
+func serveMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "address to serve the api on")
+	grpcAddr := fs.String("grpc", "",
+		"address to serve the grpc job api of imconvvips.proto on, e.g. "+
+			"\"localhost:9090\" (\"\" not to)")
+	s := &queueServer{cfg: cfg}
+	fs.StringVar(&s.store, "store", "runs.json", "json file keeping the runs")
+	fs.StringVar(&s.logDir, "logs", "runs", "dir of the outputs of the runs")
+	fs.IntVar(&s.maxRuns, "max-runs", 1, "runs at a time")
+	fs.IntVar(&s.maxProc, "max-proc", 0,
+		"workers of the runs at a time (0 for no limit)")
+	fs.IntVar(&cfg.Proc, "p", cfg.Proc, "workers of runs not giving theirs")
+	keys := fs.String("keys", "",
+		"json file of api keys with their quotas to require (\"\" for none)")
+	setTLSFlags(fs, cfg)
+	fs.StringVar(&cfg.Audit, "audit", cfg.Audit,
+		"json lines file to append submissions and cancels to with who "+
+			"made them (\"\" for none)")
+	fs.Parse(args)
+	if s.maxRuns < 1 {
+		return errors.New("max-runs must be 1 or more")
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSClientCA != "" {
+		var err error
+		if cfg.tls, err = tlsConfig(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.Audit != "" {
+		var err error
+		if cfg.audit, err = openAudit(cfg); err != nil {
+			return err
+		}
+		defer cfg.audit.Close()
+	}
+	if *keys != "" {
+		var err error
+		if s.keys, err = loadKeys(*keys); err != nil {
+			return err
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s.exe = exe
+	if err := os.MkdirAll(s.logDir, 0755); err != nil {
+		return err
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	onSignal(s.stopAll)
+	s.mu.Lock()
+	s.schedule()
+	s.mu.Unlock()
+
+	errc := make(chan error, 2)
+	if *grpcAddr != "" {
+		cfg.Log.Write([]byte(fmt.Sprintf("info: grpc job api on %s\n",
+			*grpcAddr)))
+		go func() {
+			errc <- listenAndServeGRPC(cfg, *grpcAddr, s.grpcHandler())
+		}()
+	}
+	if s.keys == nil && !loopback(*addr) {
+		cfg.Log.Write([]byte(fmt.Sprintf("warning: queue server on %s "+
+			"without -keys, anyone reaching it runs conversions\n", *addr)))
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("info: queue server on %s\n", *addr)))
+	go func() {
+		errc <- listenAndServe(cfg, *addr, s.guard(*addr, s.handler()))
+	}()
+	return <-errc
+}
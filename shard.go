@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// shard is the part i of n of the sources a process converts.
+type shard struct {
+	i, n int
+}
+
+// environment variables of the index and the count of a task in an array
+// of jobs, in order of precedence.
+var (
+	shardIndexEnv = []string{"JOB_COMPLETION_INDEX", "CLOUD_RUN_TASK_INDEX",
+		"AWS_BATCH_JOB_ARRAY_INDEX", "SHARD_INDEX"}
+	shardCountEnv = []string{"JOB_COMPLETIONS", "CLOUD_RUN_TASK_COUNT",
+		"SHARD_COUNT"}
+)
+
+// parseShard parses "I/N" of -shard, I counted from 0.
+func parseShard(s string) (*shard, error) {
+	kv := strings.SplitN(s, "/", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("shard must be I/N: %s", s)
+	}
+	i, err := strconv.Atoi(kv[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard index: %s", s)
+	}
+	n, err := strconv.Atoi(kv[1])
+	if err != nil || n < 1 || i < 0 || i >= n {
+		return nil, fmt.Errorf("invalid shard: %s", s)
+	}
+	return &shard{i, n}, nil
+}
+
+// shardFromEnv returns "I/N" of -shard by the first of shardIndexEnv and of
+// shardCountEnv set, e.g. JOB_COMPLETION_INDEX of an indexed Kubernetes Job
+// with JOB_COMPLETIONS set to its completions.
+func shardFromEnv() (string, error) {
+	lookup := func(names []string) (string, bool) {
+		for _, n := range names {
+			if v := os.Getenv(n); v != "" {
+				return v, true
+			}
+		}
+		return "", false
+	}
+	i, ok := lookup(shardIndexEnv)
+	if !ok {
+		return "", fmt.Errorf("none of %s is set",
+			strings.Join(shardIndexEnv, ", "))
+	}
+	n, ok := lookup(shardCountEnv)
+	if !ok {
+		return "", fmt.Errorf("none of %s is set",
+			strings.Join(shardCountEnv, ", "))
+	}
+	return i + "/" + n, nil
+}
+
+// has reports whether src belongs to the shard, by a hash of its path
+// relative to the source dir so that every process of the same sources
+// agrees whatever order they are walked in.
+func (s *shard) has(cfg *config, src string) bool {
+	rel, err := filepath.Rel(cfg.SrcDir, src)
+	if err != nil {
+		rel = src
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filepath.ToSlash(rel)))
+	return int(h.Sum32()%uint32(s.n)) == s.i
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// copyFile copies src to dest.
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copySidecars copies metadata files next to src sharing its base name,
+// e.g. page001.xml for page001.tif, into the directory of dest renamed by
+// cfg.SidecarFmt.
+func copySidecars(cfg *config, src, dest string) error {
+	for _, ext := range strings.Split(cfg.Sidecars, ",") {
+		if ext = strings.TrimSpace(ext); ext == "" {
+			continue
+		}
+		sc := trimExt(src) + ext
+		if _, err := os.Stat(sc); os.IsNotExist(err) {
+			continue
+		}
+		to := fmt.Sprintf(cfg.SidecarFmt, trimExt(dest), ext)
+		if cfg.Verbose {
+			cfg.Log.Write([]byte(fmt.Sprintf("sidecar: %s -> %s\n", sc, to)))
+		}
+		if err := copyFile(sc, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
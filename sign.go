@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// planKeygen writes an ed25519 key pair for signing plans as NAME.key and
+// NAME.pub.
+func planKeygen(args []string) error {
+	fs := flag.NewFlagSet("plan keygen", flag.ExitOnError)
+	name := fs.String("o", "plan", "key file name without extension")
+	fs.Parse(args)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(*name+".key",
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), 0600)
+	if err != nil {
+		return err
+	}
+	if b, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+		return err
+	}
+	return os.WriteFile(*name+".pub",
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644)
+}
+
+// readPEM returns the DER of the first PEM block of typ in path.
+func readPEM(path, typ string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil || blk.Type != typ {
+		return nil, fmt.Errorf("%s: no %s", path, typ)
+	}
+	return blk.Bytes, nil
+}
+
+// planSign writes the signature of a plan file to PLAN.sig.
+func planSign(args []string) error {
+	fs := flag.NewFlagSet("plan sign", flag.ExitOnError)
+	keyFile := fs.String("key", "plan.key", "private key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: plan sign [-key FILE] PLAN")
+	}
+
+	der, err := readPEM(*keyFile, "PRIVATE KEY")
+	if err != nil {
+		return err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return err
+	}
+	priv, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an ed25519 key", *keyFile)
+	}
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, b))
+	if err := os.WriteFile(fs.Arg(0)+".sig", []byte(sig+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("signed: %s (sha256 %s)\n", fs.Arg(0), sha256Hex(b))
+	return nil
+}
+
+// verifyPlan checks that b, the content of the plan file path, is signed
+// in path.sig with the public key in keyFile.
+func verifyPlan(path string, b []byte, keyFile string) error {
+	der, err := readPEM(keyFile, "PUBLIC KEY")
+	if err != nil {
+		return err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return err
+	}
+	pub, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s: not an ed25519 key", keyFile)
+	}
+	s, err := os.ReadFile(path + ".sig")
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(s)))
+	if err != nil {
+		return fmt.Errorf("%s.sig: %s", path, err)
+	}
+	if !ed25519.Verify(pub, b, sig) {
+		return fmt.Errorf("%s: signature does not match, changed after signing",
+			path)
+	}
+	return nil
+}
+
+// planVerify checks the signature of a plan file.
+func planVerify(args []string) error {
+	fs := flag.NewFlagSet("plan verify", flag.ExitOnError)
+	keyFile := fs.String("key", "plan.pub", "public key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: plan verify [-key FILE] PLAN")
+	}
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := verifyPlan(fs.Arg(0), b, *keyFile); err != nil {
+		return err
+	}
+	fmt.Printf("ok: %s (sha256 %s)\n", fs.Arg(0), sha256Hex(b))
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	cleanupMu sync.Mutex
+	cleanups  []func()
+)
+
+// onSignal registers f to be called when the process is interrupted or
+// terminated, before exiting.
+func onSignal(f func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	if cleanups == nil {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-c
+			fmt.Fprintf(os.Stderr, "%s: cleaning up\n", sig)
+			cleanupMu.Lock()
+			for i := len(cleanups) - 1; i >= 0; i-- {
+				cleanups[i]()
+			}
+			os.Exit(1)
+		}()
+	}
+	cleanups = append(cleanups, f)
+}
+
+// onHangup calls f on every SIGHUP instead of exiting.
+func onHangup(f func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			f()
+		}
+	}()
+}
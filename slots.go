@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// slots shares the cfg.Proc workers and cfg.MemBudget among the files
+// being converted by the weights of their profiles, so that heavy ones,
+// e.g. jp2 encoding, run fewer at a time than light ones like thumbnails.
+// files take them in the order they ask not to starve heavy ones.
+type slots struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	cpu     int   // free slots of cpuMax
+	mem     int64 // free bytes of memMax, if budgeted
+	cpuMax  int
+	memMax  int64
+	next    int64 // ticket of the next to ask
+	serving int64 // ticket taking them next
+}
+
+// newSlots returns the slots of cfg, or nil if no profile has weights.
+func newSlots(cfg *config) (*slots, error) {
+	weighted := false
+	for name, p := range cfg.Profiles {
+		if p.Weight < 0 {
+			return nil, fmt.Errorf("profile %s: negative weight", name)
+		}
+		if _, err := parseSize(p.Mem); err != nil {
+			return nil, fmt.Errorf("profile %s: %s", name, err)
+		}
+		weighted = weighted || p.Weight > 0 || p.Mem != ""
+	}
+	if !weighted {
+		return nil, nil
+	}
+	budget, _ := parseSize(cfg.MemBudget)
+	s := &slots{cpu: cfg.Proc, cpuMax: cfg.Proc, mem: budget,
+		memMax: budget}
+	s.cond = sync.NewCond(&s.mu)
+	return s, nil
+}
+
+// weights returns the slots and memory a file of the profile name takes,
+// 1 and none by default, and as much as there is at most.
+func (s *slots) weights(cfg *config, name string) (int, int64) {
+	if name == "" {
+		name = cfg.Profile
+	}
+	cpu, mem := 1, int64(0)
+	if p := cfg.Profiles[name]; p != nil {
+		if p.Weight > 0 {
+			cpu = p.Weight
+		}
+		mem, _ = parseSize(p.Mem)
+	}
+	if cpu > s.cpuMax {
+		cpu = s.cpuMax
+	}
+	if mem > s.memMax {
+		mem = s.memMax // 0 without -mem-budget
+	}
+	return cpu, mem
+}
+
+// take blocks until the slots and memory for a file of the profile name
+// are free, and takes them. it returns the function giving them back.
+func (s *slots) take(cfg *config, name string) func() {
+	if s == nil {
+		return func() {}
+	}
+	cpu, mem := s.weights(cfg, name)
+	s.mu.Lock()
+	t := s.next
+	s.next++
+	for t != s.serving || s.cpu < cpu || s.mem < mem {
+		s.cond.Wait()
+	}
+	s.serving++
+	s.cpu -= cpu
+	s.mem -= mem
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		s.cpu += cpu
+		s.mem += mem
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// snapshotEntry is the state of a source file at a snapshot.
+type snapshotEntry struct {
+	Path   string    `json:"path"` // relative to the source dir, slash separated
+	Size   int64     `json:"size"`
+	Mtime  time.Time `json:"mtime"`
+	SHA256 string    `json:"sha256,omitempty"`
+}
+
+// snapshot records the source files of a tree at a time, for converting
+// only what changed since.
+type snapshot struct {
+	SrcDir string           `json:"src_dir"`
+	Time   time.Time        `json:"time"`
+	Hashed bool             `json:"hashed"`
+	Files  []*snapshotEntry `json:"files"`
+}
+
+// stateOf returns the state of src, hashed if hash is true.
+func stateOf(cfg *config, src string, hash bool) (*snapshotEntry, error) {
+	rel, err := filepath.Rel(cfg.SrcDir, src)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(longPath(src))
+	if err != nil {
+		return nil, err
+	}
+	e := &snapshotEntry{Path: filepath.ToSlash(rel), Size: fi.Size(),
+		Mtime: fi.ModTime().UTC()}
+	if hash {
+		if e.SHA256, err = hashFile(longPath(src)); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// statesOf returns the states of srcs in cfg.Proc goroutines.
+func statesOf(cfg *config, srcs []string, hash bool) ([]*snapshotEntry,
+	error) {
+	es := make([]*snapshotEntry, len(srcs))
+	errs := make([]error, len(srcs))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Proc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				es[i], errs[i] = stateOf(cfg, srcs[i], hash)
+			}
+		}()
+	}
+	for i := range srcs {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return es, nil
+}
+
+// loadSnapshot reads the snapshot at path, which must be of cfg.SrcDir.
+func loadSnapshot(cfg *config, path string) (*snapshot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if snap.SrcDir != cfg.SrcDir {
+		return nil, fmt.Errorf("%s is of another source dir (%s)", path,
+			snap.SrcDir)
+	}
+	return &snap, nil
+}
+
+// walk queues the source files new or changed since snap. files of the
+// same size are compared by their hashes if snap has them, not trusting
+// mtimes, or else by their mtimes.
+func (snap *snapshot) walk(cfg *config, q chan string) error {
+	srcs, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+	es, err := statesOf(cfg, srcs, snap.Hashed)
+	if err != nil {
+		return err
+	}
+	old := map[string]*snapshotEntry{}
+	for _, e := range snap.Files {
+		old[e.Path] = e
+	}
+	var changed []string
+	for i, e := range es {
+		o := old[e.Path]
+		delete(old, e.Path)
+		switch {
+		case o == nil, o.Size != e.Size:
+		case snap.Hashed && o.SHA256 != e.SHA256:
+		case !snap.Hashed && !o.Mtime.Equal(e.Mtime):
+		default:
+			continue
+		}
+		changed = append(changed, srcs[i])
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf(
+		"info: %d of %d files new or changed, %d gone since the snapshot "+
+			"at %s\n", len(changed), len(srcs), len(old),
+		snap.Time.Format(time.RFC3339))))
+	for _, src := range changed {
+		q <- src
+	}
+	return nil
+}
+
+// snapshotMain records the state of the source files.
+func snapshotMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	setFlags(fs, cfg)
+	out := fs.String("o", "snapshot.json", "output file")
+	hash := fs.Bool("hash", false,
+		"record sha256 of the files too, to tell changes without mtimes")
+	fs.Parse(args)
+
+	cfg.Save = false
+	cfg.DryRun = true
+	closeLogs, err := setup(cfg)
+	defer closeLogs()
+	if err != nil {
+		return err
+	}
+	snap := &snapshot{SrcDir: cfg.SrcDir, Time: time.Now(), Hashed: *hash}
+	srcs, err := collect(cfg)
+	if err != nil {
+		return err
+	}
+	if snap.Files, err = statesOf(cfg, srcs, *hash); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(snap, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*out, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("%s: %d files\n", *out, len(srcs))))
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxFailures = 20  // recent failures kept for the dashboard
+	maxHistory  = 120 // throughput samples kept for the dashboard
+)
+
+// state holds counters shared among workers during a run.
+type state struct {
+	queued    int64
+	converted int64
+	failed    int64
+	skipped   int64
+	cached    int64
+	passed    int64
+	missingN  int64
+	// files done for -iiif and -mapping after the run.
+	outputs    []*result
+	iiifFailed int64
+	// files taken from the walk, and to be skipped when resuming.
+	walked   int64
+	resumeAt int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	aborted  string
+	tags     tags
+
+	mu       sync.Mutex
+	resume   *sync.Cond
+	paused   bool
+	started  time.Time
+	current  map[int]*progress
+	failures []failure
+	classes  map[string]int64 // failed files by class
+	history  []int64
+
+	results    *json.Encoder
+	casMap     *json.Encoder
+	missingOut io.Writer
+	scriptOut  io.Writer
+	planned    map[string]*planEntry
+	prev       map[string]*result // by -results for -generations
+	hashes     *hasher
+	journal    *journal
+	tracer     *tracer
+	reloaded   *config           // by SIGHUP
+	dests      map[string]string // found by precheck
+
+	flatNames map[string]int
+	translit  *translit
+	seq       map[string]int
+	packs     map[string][]string
+
+	prio      []string
+	prioSeen  map[string]bool
+	prioReady chan struct{}
+}
+
+// progress is the file a worker is converting.
+type progress struct {
+	Src     string    `json:"src"`
+	Dest    string    `json:"dest"`
+	Since   time.Time `json:"since"`
+	Stalled bool      `json:"stalled,omitempty"` // longer than -stall-after
+
+	partials []string // of newPartials, removed if killed
+}
+
+type failure struct {
+	Src   string    `json:"src"`
+	Err   string    `json:"error"`
+	Class string    `json:"class"`
+	Time  time.Time `json:"time"`
+}
+
+func newState() *state {
+	st := &state{
+		stop:    make(chan struct{}),
+		started: time.Now(),
+		current: map[int]*progress{},
+
+		prioSeen:  map[string]bool{},
+		prioReady: make(chan struct{}, 1),
+	}
+	st.resume = sync.NewCond(&st.mu)
+	return st
+}
+
+// abort stops dispatching further files. the first reason wins.
+func (st *state) abort(reason string) {
+	st.stopOnce.Do(func() {
+		st.aborted = reason
+		close(st.stop)
+	})
+	// wake up a paused dispatcher.
+	st.setPaused(false)
+}
+
+// stopAt stops dispatching further files as abort does, but for a run
+// ending as asked, e.g. at -limit, which is not aborted.
+func (st *state) stopAt(cfg *config, reason string) {
+	st.stopOnce.Do(func() {
+		cfg.Log.Write([]byte(fmt.Sprintf("info: stopped at %s\n", reason)))
+		close(st.stop)
+	})
+	st.setPaused(false)
+}
+
+func (st *state) stopped() bool {
+	select {
+	case <-st.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail counts a failed file and aborts the run if errors accumulate. it
+// returns the class of err.
+func (st *state) fail(cfg *config, src string, err error) string {
+	class := classify(err)
+	st.mu.Lock()
+	st.failures = append(st.failures,
+		failure{src, err.Error(), class, time.Now()})
+	if len(st.failures) > maxFailures {
+		st.failures = st.failures[1:]
+	}
+	if st.classes == nil {
+		st.classes = map[string]int64{}
+	}
+	st.classes[class]++
+	st.mu.Unlock()
+
+	n := atomic.AddInt64(&st.failed, 1)
+	if cfg.notify != nil && n == int64(cfg.NotifyFailures) {
+		cfg.notify.send(cfg, st, "failures",
+			fmt.Sprintf("%d files failed in %s, the last one %s:\n%s",
+				n, cfg.SrcDir, src, err))
+	}
+	if cfg.StopAfterErrors > 0 && n >= int64(cfg.StopAfterErrors) {
+		st.abort(fmt.Sprintf("%d errors", n))
+	}
+	return class
+}
+
+// record writes r to the results file if any.
+func (st *state) record(r *result) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.results != nil {
+		st.results.Encode(r)
+	}
+	if st.scriptOut != nil && r.Cmd != "" {
+		writeScript(st.scriptOut, r)
+	}
+}
+
+// begin and end track the file worker id is converting.
+func (st *state) begin(id int, src, dest string, partials []string) {
+	st.mu.Lock()
+	st.current[id] = &progress{Src: src, Dest: dest, Since: time.Now(),
+		partials: partials}
+	st.mu.Unlock()
+}
+
+func (st *state) end(id int) {
+	st.mu.Lock()
+	delete(st.current, id)
+	st.mu.Unlock()
+}
+
+// setPaused pauses or resumes dispatching. files being converted are not
+// affected.
+func (st *state) setPaused(paused bool) {
+	st.mu.Lock()
+	st.paused = paused
+	st.mu.Unlock()
+	st.resume.Broadcast()
+}
+
+// waitResume blocks while the run is paused.
+func (st *state) waitResume() {
+	st.mu.Lock()
+	for st.paused {
+		st.resume.Wait()
+	}
+	st.mu.Unlock()
+}
+
+// sample records the converted count for the throughput graph every d.
+func (st *state) sample(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-st.stop:
+			return
+		}
+		st.mu.Lock()
+		st.history = append(st.history, atomic.LoadInt64(&st.converted))
+		if len(st.history) > maxHistory {
+			st.history = st.history[1:]
+		}
+		st.mu.Unlock()
+	}
+}
+
+// prioritize queues src ahead of the files from the walk.
+func (st *state) prioritize(src string) {
+	st.mu.Lock()
+	if !st.prioSeen[src] {
+		st.prioSeen[src] = true
+		st.prio = append(st.prio, src)
+	}
+	st.mu.Unlock()
+	st.notifyPriority()
+}
+
+func (st *state) notifyPriority() {
+	select {
+	case st.prioReady <- struct{}{}:
+	default:
+	}
+}
+
+func (st *state) popPriority() (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.prio) == 0 || st.stopped() {
+		return "", false
+	}
+	src := st.prio[0]
+	st.prio = st.prio[1:]
+	if len(st.prio) > 0 {
+		// let another worker take the rest.
+		st.notifyPriority()
+	}
+	return src, true
+}
+
+// prioritized reports whether src has been queued as a priority file.
+func (st *state) prioritized(src string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.prioSeen[src]
+}
+
+// next returns the next file for a worker, priority files first.
+func (st *state) next(q <-chan string) (string, bool) {
+	for {
+		if src, ok := st.popPriority(); ok {
+			return src, true
+		}
+		select {
+		case src, ok := <-q:
+			if !ok {
+				return st.popPriority()
+			}
+			return src, true
+		case <-st.prioReady:
+		}
+	}
+}
+
+// dispatch forwards files from in to q until the run is stopped.
+// files left in after stopping are drained and dropped.
+func dispatch(cfg *config, st *state, in <-chan string, q chan<- string) {
+	n, size := 0, int64(0)
+	for src := range in {
+		// the extensions may be reloaded.
+		c := st.config(cfg)
+		st.waitResume()
+		if st.stopped() {
+			continue
+		}
+		if st.walked < st.resumeAt || st.prioritized(src) {
+			atomic.AddInt64(&st.walked, 1)
+			continue
+		}
+		if cfg.shard != nil && !cfg.shard.has(cfg, src) {
+			// for another process.
+			atomic.AddInt64(&st.walked, 1)
+			continue
+		}
+		if matchExt(c, src) {
+			if cfg.Limit > 0 && n >= cfg.Limit {
+				st.stopAt(cfg, fmt.Sprintf("limit of %d files", cfg.Limit))
+				continue
+			}
+			if cfg.MaxFiles > 0 && n >= cfg.MaxFiles {
+				st.abort(fmt.Sprintf("quota of %d files", cfg.MaxFiles))
+				continue
+			}
+			if cfg.maxBytes > 0 {
+				// let a file beyond the quota go alone not to stop forever.
+				fi, err := os.Stat(longPath(src))
+				if err == nil && n > 0 && size+fi.Size() > cfg.maxBytes {
+					st.abort(fmt.Sprintf("quota of %s", cfg.MaxBytes))
+					continue
+				}
+				if err == nil {
+					size += fi.Size()
+				}
+			}
+			n++
+			atomic.AddInt64(&st.queued, 1)
+		}
+		if st.tracer != nil && matchExt(c, src) {
+			st.tracer.enqueue(src)
+		}
+		if st.hashes != nil && matchExt(c, src) && !cfg.SkipExisting {
+			// start hashing while waiting for a worker.
+			st.hashes.submit(src)
+		}
+		select {
+		case q <- src:
+			atomic.AddInt64(&st.walked, 1)
+		case <-st.stop:
+		}
+	}
+}
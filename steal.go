@@ -0,0 +1,98 @@
+package main
+
+import "fmt"
+
+// chunk is files of a filelist left to queue, with their line numbers.
+type chunk struct {
+	list  string
+	srcs  []string
+	lines []int
+}
+
+func (c *chunk) len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.srcs)
+}
+
+// queue queues the first file of c.
+func (c *chunk) queue(cfg *config, q chan string) {
+	src, line := c.srcs[0], c.lines[0]
+	c.srcs, c.lines = c.srcs[1:], c.lines[1:]
+	if cfg.lists != nil {
+		cfg.lists.add(src, c.list, line)
+	}
+	q <- src
+}
+
+// stealQueue queues the files of chunks, each a whole filelist, side by
+// side in cfg.Proc lanes taking turns, so that the workers convert files of
+// as many lists at a time and short lists are done early instead of waiting
+// for long ones before them. a lane whose list has run out takes the next
+// list, or when none is left the later half of the longest one in the other
+// lanes, so that long lists still get all the workers at the end.
+// the order depends on -p but not on timing, for checkpoints.
+func stealQueue(cfg *config, chunks []*chunk, q chan string) {
+	left := map[string]int{}
+	var lists []*chunk
+	for _, c := range chunks {
+		if c.len() == 0 {
+			if cfg.lists != nil {
+				cfg.lists.walked(cfg, c.list)
+			}
+			continue
+		}
+		left[c.list] = c.len()
+		lists = append(lists, c)
+	}
+
+	lanes := make([]*chunk, cfg.Proc)
+	for {
+		busy := false
+		for i := range lanes {
+			if lanes[i].len() == 0 {
+				if len(lists) > 0 {
+					lanes[i], lists = lists[0], lists[1:]
+				} else {
+					lanes[i] = steal(lanes)
+					if cfg.Verbose && lanes[i] != nil {
+						cfg.Log.Write([]byte(fmt.Sprintf(
+							"filelist steal: %d files of %s\n",
+							lanes[i].len(), lanes[i].list)))
+					}
+				}
+			}
+			c := lanes[i]
+			if c.len() == 0 {
+				continue
+			}
+			busy = true
+			c.queue(cfg, q)
+			if left[c.list]--; left[c.list] == 0 && cfg.lists != nil {
+				cfg.lists.walked(cfg, c.list)
+			}
+		}
+		if !busy {
+			return
+		}
+	}
+}
+
+// steal splits off the later half of the longest chunk of lanes, if any
+// has two files or more.
+func steal(lanes []*chunk) *chunk {
+	var v *chunk
+	for _, c := range lanes {
+		if c.len() >= 2 && c.len() > v.len() {
+			v = c
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	h := (v.len() + 1) / 2
+	c := &chunk{list: v.list, srcs: v.srcs[h:], lines: v.lines[h:]}
+	v.srcs, v.lines = v.srcs[:h], v.lines[:h]
+	return c
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// streamArgs returns the src and dest arguments of a vips command with
+// -vips-stream: "stdin" for the source piped in, and the extension of dest,
+// e.g. ".tif", for the output written to stdout.
+func streamArgs(stream, src, dest string) (string, string) {
+	if stream == "in" || stream == "both" {
+		src = "stdin"
+	}
+	if stream == "out" || stream == "both" {
+		dest = filepath.Ext(dest)
+	}
+	return src, dest
+}
+
+// openSource opens src to pipe into a converter.
+func openSource(src string) (io.ReadCloser, error) {
+	return os.Open(longPath(src))
+}
+
+// createDest creates dest for the output a converter writes to stdout.
+func createDest(dest string) (io.WriteCloser, error) {
+	return os.Create(longPath(dest))
+}
+
+// runStream runs the command s of a streaming converter, piping src in
+// and the output to dest as cfg.VipsStream tells, and retrying like runCmd.
+func runStream(cfg *config, w *worker, s, src, dest string) error {
+	return retry(cfg, func() error {
+		var in io.Reader
+		if cfg.VipsStream == "in" || cfg.VipsStream == "both" {
+			f, err := openSource(src)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		if cfg.VipsStream != "out" && cfg.VipsStream != "both" {
+			return runCmdOnce(cfg, w, s, in, cfg.Stdout)
+		}
+		f, err := createDest(dest)
+		if err != nil {
+			return err
+		}
+		err = runCmdOnce(cfg, w, s, in, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
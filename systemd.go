@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify sends state, e.g. "READY=1", to systemd if the process is run
+// by it as a notify service.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// abstract socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdStatus returns the counts of st for STATUS= of sdNotify.
+func sdStatus(st *state) string {
+	return fmt.Sprintf("STATUS=converted %d, failed %d, skipped %d",
+		atomic.LoadInt64(&st.converted), atomic.LoadInt64(&st.failed),
+		atomic.LoadInt64(&st.skipped))
+}
+
+// sdWatchdog pings the watchdog of systemd with the status at half of its
+// interval, if it is enabled for the process.
+func sdWatchdog(cfg *config, st *state) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" &&
+		pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	t := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer t.Stop()
+	for range t.C {
+		if err := sdNotify("WATCHDOG=1\n" + sdStatus(st)); err != nil {
+			cfg.Log.Write([]byte(fmt.Sprintf("error: systemd: %s\n", err)))
+		}
+	}
+}
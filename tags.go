@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// tags is a flag.Value collecting repeated -tag key=value options.
+type tags map[string]string
+
+func (t *tags) String() string {
+	var kvs []string
+	for k, v := range *t {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (t *tags) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("tag must be key=value: %q", s)
+	}
+	if *t == nil {
+		*t = tags{}
+	}
+	(*t)[kv[0]] = kv[1]
+	return nil
+}
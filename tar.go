@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// tarStream streams outputs as a tar for -d -, e.g.
+//
+//	imconvvips -s src -d - | ssh host 'tar x -C /data'
+//
+// outputs are converted into the scratch dir and removed once written.
+type tarStream struct {
+	dir string
+
+	mu sync.Mutex
+	tw *tar.Writer
+}
+
+func newTarStream(w io.Writer, dir string) *tarStream {
+	return &tarStream{dir: dir, tw: tar.NewWriter(w)}
+}
+
+// add writes the files of an output, e.g. by companions, to the tar and
+// removes them.
+func (t *tarStream) add(ps []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range ps {
+		if _, err := os.Stat(longPath(p)); os.IsNotExist(err) {
+			continue
+		}
+		err := filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(t.dir, p)
+			if err != nil {
+				return err
+			}
+			h, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			h.Name = filepath.ToSlash(rel)
+			if err := t.tw.WriteHeader(h); err != nil || fi.IsDir() {
+				return err
+			}
+			f, err := os.Open(longPath(p))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(t.tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(longPath(p)); err != nil {
+			return err
+		}
+	}
+	return t.tw.Flush()
+}
+
+func (t *tarStream) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tw.Close()
+}
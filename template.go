@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// destVars are the variables of -dest-template, e.g.
+//
+//	{{.Year}}/{{.Identifier}}/{{.Seq}}.tif
+//
+// Width, Height and Meta are looked up only when the template uses them.
+// Vars are the named groups of -id-regex, a group "identifier" of which is
+// also the Identifier.
+type destVars struct {
+	Rel        string    // slash separated source path relative to -s
+	Dir        string    // directory of Rel, "." at the top
+	Name       string    // base name of Rel without the extension
+	Ext        string    // extension of Rel, e.g. ".tif"
+	Identifier string    // last directory of Rel, or Name at the top
+	Seq        string    // number in the directory, -renumber-width digits
+	Run        time.Time // start of the run
+	Year       string
+	Month      string
+	Day        string
+	MTime      time.Time // modification time of the source
+	Vars       map[string]string
+
+	cfg   *config
+	src   string
+	props map[string]string
+	meta  map[string]string
+}
+
+func newDestVars(cfg *config, st *state, src, rel string) (*destVars, error) {
+	fi, err := os.Stat(longPath(src))
+	if err != nil {
+		return nil, err
+	}
+	v := &destVars{
+		Rel:   rel,
+		Dir:   path.Dir(rel),
+		Ext:   path.Ext(rel),
+		Name:  strings.TrimSuffix(path.Base(rel), path.Ext(rel)),
+		Run:   st.started,
+		Year:  st.started.Format("2006"),
+		Month: st.started.Format("01"),
+		Day:   st.started.Format("02"),
+		MTime: fi.ModTime(),
+		cfg:   cfg,
+		src:   src,
+	}
+	if v.Identifier, v.Vars, err = identifier(cfg, src, rel); err != nil {
+		return nil, err
+	}
+	if n, ok := st.seq[src]; ok {
+		v.Seq = fmt.Sprintf("%0*d", cfg.RenumberWidth, n)
+	}
+	return v, nil
+}
+
+// identifier returns the identifier of src at slash separated rel, which
+// is the group "identifier" of -id-regex if any, or else the last directory
+// of rel, or its name at the top, along with the groups.
+func identifier(cfg *config, src, rel string) (string, map[string]string,
+	error) {
+	vars := identify(cfg, src)
+	if vars == nil {
+		if cfg.idRe != nil {
+			return "", nil, fmt.Errorf("id regex does not match %s", rel)
+		}
+		vars = map[string]string{}
+	}
+	if id, ok := vars["identifier"]; ok {
+		return id, vars, nil
+	}
+	if d := path.Dir(rel); d != "." {
+		return path.Base(d), vars, nil
+	}
+	return strings.TrimSuffix(path.Base(rel), path.Ext(rel)), vars, nil
+}
+
+func (v *destVars) header(key string) (string, error) {
+	if v.props == nil {
+		props, err := probe(v.cfg, v.src)
+		if err != nil {
+			return "", err
+		}
+		v.props = props
+	}
+	return v.props[key], nil
+}
+
+// Width is the image width reported by vipsheader.
+func (v *destVars) Width() (string, error) {
+	return v.header("width")
+}
+
+// Height is the image height reported by vipsheader.
+func (v *destVars) Height() (string, error) {
+	return v.header("height")
+}
+
+// Meta returns the fields of the .json or .xml sidecar of the source, e.g.
+// {{.Meta.shelfmark}}. Top level values of a json object and leaf elements
+// of xml by their local names are read; the first one wins.
+func (v *destVars) Meta() (map[string]string, error) {
+	if v.meta != nil {
+		return v.meta, nil
+	}
+	v.meta = map[string]string{}
+	exts := ".json,.xml"
+	if v.cfg.Sidecars != "" {
+		exts = v.cfg.Sidecars
+	}
+	for _, ext := range strings.Split(exts, ",") {
+		ext = strings.TrimSpace(ext)
+		f, err := os.Open(longPath(trimExt(v.src) + ext))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(ext) {
+		case ".json":
+			err = readJSONMeta(f, v.meta)
+		case ".xml":
+			err = readXMLMeta(f, v.meta)
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s%s: %s", trimExt(v.src), ext, err)
+		}
+	}
+	return v.meta, nil
+}
+
+func readJSONMeta(r io.Reader, meta map[string]string) error {
+	var m map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return err
+	}
+	for k, val := range m {
+		switch val.(type) {
+		case map[string]interface{}, []interface{}, nil:
+			continue
+		}
+		if _, ok := meta[k]; !ok {
+			meta[k] = fmt.Sprint(val)
+		}
+	}
+	return nil
+}
+
+func readXMLMeta(r io.Reader, meta map[string]string) error {
+	d := xml.NewDecoder(r)
+	var name, text string
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name, text = t.Name.Local, ""
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			// only leaves, whose start is the last one seen.
+			if name == t.Name.Local {
+				if _, ok := meta[name]; !ok {
+					meta[name] = strings.TrimSpace(text)
+				}
+			}
+			name = ""
+		}
+	}
+}
+
+func parseDestTemplate(s string) (*template.Template, error) {
+	return template.New("dest").Option("missingkey=error").Parse(s)
+}
+
+// templateName returns the slash separated destination of src by
+// cfg.destTmpl.
+func templateName(cfg *config, st *state, src, rel string) (string, error) {
+	v, err := newDestVars(cfg, st, src, rel)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := cfg.destTmpl.Execute(&b, v); err != nil {
+		return "", err
+	}
+	name := path.Clean(filepath.ToSlash(strings.TrimSpace(b.String())))
+	if name == "." || name == ".." || path.IsAbs(name) ||
+		strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("dest template gave %q for %s", b.String(), rel)
+	}
+	return name, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// setTLSFlags registers the options of serving http over tls on fs.
+func setTLSFlags(fs *flag.FlagSet, cfg *config) {
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert,
+		"pem certificate (chain) to serve http endpoints over tls with "+
+			"(\"\" for plain http)")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey,
+		"pem private key of -tls-cert")
+	fs.StringVar(&cfg.TLSClientCA, "tls-client-ca", cfg.TLSClientCA,
+		"pem ca certificates to require and verify client certificates "+
+			"by (\"\" not to)")
+}
+
+// keyPair is a certificate loaded again when its file changes, e.g.
+// renewed by certbot, without restarting.
+type keyPair struct {
+	cert, key string
+
+	mu   sync.Mutex
+	mod  time.Time
+	pair *tls.Certificate
+}
+
+func (p *keyPair) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	fi, err := os.Stat(p.cert)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil && (p.pair == nil || !fi.ModTime().Equal(p.mod)) {
+		pair, lerr := tls.LoadX509KeyPair(p.cert, p.key)
+		if lerr == nil {
+			p.pair, p.mod = &pair, fi.ModTime()
+		}
+		// keep the last one while the files are being replaced.
+		err = lerr
+	}
+	if p.pair != nil {
+		return p.pair, nil
+	}
+	return nil, err
+}
+
+// tlsConfig returns the tls settings of the options.
+func tlsConfig(cfg *config) (*tls.Config, error) {
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, errors.New("tls needs both -tls-cert and -tls-key")
+	}
+	p := &keyPair{cert: cfg.TLSCert, key: cfg.TLSKey}
+	if _, err := p.get(nil); err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	c := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: p.get}
+	if cfg.TLSClientCA != "" {
+		b, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		c.ClientCAs = x509.NewCertPool()
+		if !c.ClientCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%s: no certificates", cfg.TLSClientCA)
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// listenAndServe serves h on addr, over tls if set up.
+func listenAndServe(cfg *config, addr string, h http.Handler) error {
+	if cfg.tls == nil {
+		return http.ListenAndServe(addr, h)
+	}
+	srv := &http.Server{Addr: addr, Handler: h, TLSConfig: cfg.tls}
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceFlushInterval = 5 * time.Second
+
+// tracer exports spans of the walk and of sampled files to an OpenTelemetry
+// collector by OTLP/HTTP json.
+type tracer struct {
+	url    string
+	sample float64
+	client *http.Client
+	attrs  []otlpAttr // of the resource
+
+	mu       sync.Mutex
+	enqueued map[string]time.Time // sampled files by dispatch
+	spans    []*otlpSpan
+	done     chan struct{}
+	flushed  chan struct{}
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID    string     `json:"traceId"`
+	SpanID     string     `json:"spanId"`
+	ParentID   string     `json:"parentSpanId,omitempty"`
+	Name       string     `json:"name"`
+	Kind       int        `json:"kind"` // internal
+	Start      string     `json:"startTimeUnixNano"`
+	End        string     `json:"endTimeUnixNano"`
+	Attributes []otlpAttr `json:"attributes,omitempty"`
+	Status     struct {
+		Code    int    `json:"code,omitempty"` // 2 for errors
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func attr(k, v string) otlpAttr {
+	return otlpAttr{k, map[string]string{"stringValue": v}}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func newSpan(traceID, parent, name string, start, end time.Time,
+	err error, attrs ...otlpAttr) *otlpSpan {
+	s := &otlpSpan{TraceID: traceID, SpanID: randomID(8), ParentID: parent,
+		Name: name, Kind: 1, Start: unixNano(start), End: unixNano(end),
+		Attributes: attrs}
+	if err != nil {
+		s.Status.Code = 2
+		s.Status.Message = err.Error()
+	}
+	return s
+}
+
+// newTracer exports spans to the OTLP/HTTP endpoint of cfg.OTLP, e.g.
+// http://localhost:4318, in the background until close.
+func newTracer(cfg *config) *tracer {
+	host, _ := os.Hostname()
+	t := &tracer{
+		url:    strings.TrimSuffix(cfg.OTLP, "/") + "/v1/traces",
+		sample: cfg.TraceSample,
+		client: &http.Client{Timeout: 30 * time.Second},
+		attrs: []otlpAttr{attr("service.name", "imconvvips"),
+			attr("host.name", host)},
+		enqueued: map[string]time.Time{},
+		done:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+	}
+	if cfg.RunID != "" {
+		t.attrs = append(t.attrs, attr("imconvvips.run_id", cfg.RunID))
+	}
+	go func() {
+		defer close(t.flushed)
+		tick := time.NewTicker(traceFlushInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+			case <-t.done:
+				t.flush(cfg)
+				return
+			}
+			t.flush(cfg)
+		}
+	}()
+	return t
+}
+
+func (t *tracer) add(spans ...*otlpSpan) {
+	t.mu.Lock()
+	t.spans = append(t.spans, spans...)
+	t.mu.Unlock()
+}
+
+// flush exports the spans so far.
+func (t *tracer) flush(cfg *config) {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": t.attrs},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "imconvvips"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err == nil {
+		var resp *http.Response
+		resp, err = t.client.Post(t.url, "application/json", bytes.NewReader(b))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("%s: %s", t.url, resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		cfg.Log.Write([]byte(fmt.Sprintf("error: trace: %s\n", err)))
+	}
+}
+
+// close exports the spans left.
+func (t *tracer) close() {
+	close(t.done)
+	<-t.flushed
+}
+
+// walk records a span of walking the sources.
+func (t *tracer) walk(start time.Time, err error) {
+	t.add(newSpan(randomID(16), "", "walk", start, time.Now(), err))
+}
+
+// enqueue samples src as it is dispatched to the workers.
+func (t *tracer) enqueue(src string) {
+	if t.sample < 1 && mrand.Float64() >= t.sample {
+		return
+	}
+	t.mu.Lock()
+	t.enqueued[src] = time.Now()
+	t.mu.Unlock()
+}
+
+// fileTrace collects the spans of a sampled file.
+type fileTrace struct {
+	id       string
+	queued   time.Time
+	children []*otlpSpan
+}
+
+// file returns the trace of src if it is sampled, or else nil.
+func (t *tracer) file(src string) *fileTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	queued, ok := t.enqueued[src]
+	if !ok {
+		return nil
+	}
+	delete(t.enqueued, src)
+	return &fileTrace{id: randomID(16), queued: queued}
+}
+
+// span records a step of the file from start until now. it does nothing
+// for files not sampled.
+func (ft *fileTrace) span(name string, start time.Time, err error) {
+	if ft == nil {
+		return
+	}
+	ft.children = append(ft.children,
+		newSpan(ft.id, "", name, start, time.Now(), err))
+}
+
+// finish records the trace of r, the file span with the queue wait and the
+// steps under it.
+func (t *tracer) finish(r *result) {
+	ft := r.trace
+	if ft == nil {
+		return
+	}
+	var err error
+	if !r.ok() {
+		err = fmt.Errorf("%s", r.Error)
+	}
+	root := newSpan(ft.id, "", "file", ft.queued, time.Now(), err,
+		attr("imconvvips.src", r.Src), attr("imconvvips.dest", r.Dest),
+		attr("imconvvips.status", r.Status),
+		attr("imconvvips.engine", r.Engine))
+	if r.Class != "" {
+		root.Attributes = append(root.Attributes,
+			attr("imconvvips.class", r.Class))
+	}
+	spans := []*otlpSpan{root,
+		newSpan(ft.id, root.SpanID, "queue", ft.queued, r.Start, nil)}
+	for _, s := range ft.children {
+		s.ParentID = root.SpanID
+		spans = append(spans, s)
+	}
+	t.add(spans...)
+}
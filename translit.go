@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// translitLangs are the languages of -transliterate, mapping letters
+// before the common rules of latinLetters and the decompositions of
+// nfcPairs.
+var translitLangs = map[string]map[rune]string{
+	"latin": {},
+	"de": {
+		'ä': "ae", 'ö': "oe", 'ü': "ue", 'Ä': "Ae", 'Ö': "Oe", 'Ü': "Ue",
+	},
+	"da": {
+		'æ': "ae", 'ø': "oe", 'å': "aa", 'Æ': "Ae", 'Ø': "Oe", 'Å': "Aa",
+	},
+	"ja": {},
+}
+
+// latinLetters are latin letters which are not a letter with marks.
+var latinLetters = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o",
+	'Ø': "O", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'ł': "l", 'Ł': "L",
+	'þ': "th", 'Þ': "Th", 'ı': "i", 'ħ': "h", 'Ħ': "H",
+}
+
+// kana are the modified Hepburn romanizations of hiragana, katakana being
+// 0x60 after them.
+var kana = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n", 'ゔ': "vu",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o",
+	'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo", 'ゎ': "wa",
+}
+
+// jaMarks are the punctuation of Japanese names.
+var jaMarks = map[rune]string{
+	'　': "_", '、': "_", '。': "_", '・': "_", '「': "_", '」': "_",
+	'『': "_", '』': "_", '（': "(", '）': ")", '〜': "-",
+}
+
+// kanaOf returns the romanization of a kana, hiragana or katakana.
+func kanaOf(r rune) (string, bool) {
+	if r >= 0x30A1 && r <= 0x30F4 {
+		r -= 0x60
+	}
+	s, ok := kana[r]
+	return s, ok
+}
+
+// smallKana reports whether r is a small kana making a syllable with the
+// kana before, ゃゅょ or ぁぃぅぇぉ of hiragana or katakana.
+func smallKana(r rune) bool {
+	if r >= 0x30A1 && r <= 0x30F4 {
+		r -= 0x60
+	}
+	return strings.ContainsRune("ゃゅょぁぃぅぇぉ", r)
+}
+
+// isVowel reports whether c is a romanized vowel.
+func isVowel(c byte) bool {
+	return strings.IndexByte("aeiou", c) >= 0
+}
+
+// nfcBases maps the precomposed characters of nfcPairs to their bases.
+var nfcBases = func() map[rune]rune {
+	m := map[rune]rune{}
+	for p, c := range nfcPairs {
+		m[c] = p[0]
+	}
+	return m
+}()
+
+// transliterate returns the name s in ascii by the rules of lang. what
+// the rules do not know, e.g. kanji, is written as its code point like
+// "u5199".
+func transliterate(lang, s string) string {
+	rules := translitLangs[lang]
+	rs := []rune(nfc(s))
+	var b strings.Builder
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		if r < 0x80 {
+			b.WriteRune(r)
+			continue
+		}
+		if t, ok := rules[r]; ok {
+			b.WriteString(t)
+			continue
+		}
+		if lang == "ja" {
+			if r >= 0xFF01 && r <= 0xFF5E { // fullwidth ascii
+				b.WriteRune(r - 0xFEE0)
+				continue
+			}
+			if t, ok := jaMarks[r]; ok {
+				b.WriteString(t)
+				continue
+			}
+			if t, ok := kanaOf(r); ok {
+				// きゃ kya, しゃ sha, ふぁ fa etc.
+				if i+1 < len(rs) && smallKana(rs[i+1]) && len(t) > 1 {
+					y, _ := kanaOf(rs[i+1])
+					t = t[:len(t)-1]
+					if y[0] == 'y' && (strings.HasSuffix(t, "sh") ||
+						strings.HasSuffix(t, "ch") || t == "j") {
+						y = y[1:]
+					}
+					t += y
+					i++
+				}
+				b.WriteString(t)
+				continue
+			}
+			switch r {
+			case 'っ', 'ッ': // doubles the next consonant
+				if i+1 < len(rs) {
+					if t, ok := kanaOf(rs[i+1]); ok && !isVowel(t[0]) {
+						if t[0] == 'c' {
+							b.WriteByte('t')
+						} else {
+							b.WriteByte(t[0])
+						}
+						continue
+					}
+				}
+				b.WriteString("tsu")
+				continue
+			case 'ー': // lengthens the vowel before
+				if s := b.String(); s != "" && isVowel(s[len(s)-1]) {
+					b.WriteByte(s[len(s)-1])
+				}
+				continue
+			}
+		}
+		if t, ok := latinLetters[r]; ok {
+			b.WriteString(t)
+			continue
+		}
+		base := r
+		for base >= 0x80 && nfcBases[base] != 0 {
+			base = nfcBases[base]
+		}
+		if base < 0x80 {
+			b.WriteRune(base)
+			continue
+		}
+		fmt.Fprintf(&b, "u%04x", r)
+	}
+	return b.String()
+}
+
+// translit is the names transliterated, to keep them the same for a file
+// and different for different files over runs.
+type translit struct {
+	byName  map[string]string // transliterated by name
+	byASCII map[string]string // names by transliterated
+	plain   map[string]bool   // names in ascii already in the run
+}
+
+// translitPath returns the file of the mapping of transliterated names.
+func translitPath(cfg *config) string {
+	if cfg.TransliterateMap != "" {
+		return cfg.TransliterateMap
+	}
+	return filepath.Join(cfg.DestDir, "transliteration.json")
+}
+
+// loadTranslit reads the mapping of the names transliterated in the former
+// runs, if any.
+func loadTranslit(cfg *config) (*translit, error) {
+	t := &translit{byName: map[string]string{}, byASCII: map[string]string{},
+		plain: map[string]bool{}}
+	b, err := os.ReadFile(translitPath(cfg))
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &t.byASCII); err != nil {
+		return nil, fmt.Errorf("%s: %s", translitPath(cfg), err)
+	}
+	for a, n := range t.byASCII {
+		t.byName[n] = a
+	}
+	return t, nil
+}
+
+// transliterateDest returns rel, a slash separated path relative to the
+// destination dir, transliterated by cfg.Transliterate. a name taken by
+// another file, transliterated or in ascii already, is given a sequence
+// number like flatName.
+func transliterateDest(cfg *config, st *state, rel string) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.translit == nil {
+		var err error
+		if st.translit, err = loadTranslit(cfg); err != nil {
+			return "", err
+		}
+	}
+	t := st.translit
+	if a, ok := t.byName[rel]; ok {
+		return a, nil
+	}
+	a := transliterate(cfg.Transliterate, rel)
+	taken := func(a string) bool {
+		if n := t.byASCII[a]; n != "" || t.plain[a] {
+			return n != rel
+		}
+		// by an output of a former run in ascii.
+		_, err := os.Stat(longPath(filepath.Join(cfg.DestDir,
+			filepath.FromSlash(a))))
+		return a != rel && err == nil
+	}
+	if a == rel && !taken(a) {
+		t.plain[a] = true
+		return a, nil
+	}
+	base, ext := strings.TrimSuffix(a, path.Ext(a)), path.Ext(a)
+	for n := 2; taken(a); n++ {
+		a = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	t.byName[rel], t.byASCII[a] = a, rel
+	return a, nil
+}
+
+// writeTranslit writes the mapping of transliterated names to the names,
+// of the run and the former ones.
+func writeTranslit(cfg *config, st *state) error {
+	st.mu.Lock()
+	b, err := json.MarshalIndent(st.translit.byASCII, "", " ")
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	p := translitPath(cfg)
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawTerminal makes stdin deliver keys without enter or echo. the returned
+// function restores the terminal.
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(saved) }, nil
+}
+
+// terminalWidth returns the columns of the terminal, 80 if unknown.
+func terminalWidth() int {
+	out, err := stty("size")
+	if err != nil {
+		return 80
+	}
+	fs := strings.Fields(out)
+	if len(fs) != 2 {
+		return 80
+	}
+	n, err := strconv.Atoi(fs[1])
+	if err != nil || n <= 0 {
+		return 80
+	}
+	return n
+}
@@ -0,0 +1,13 @@
+package main
+
+import "errors"
+
+// rawTerminal is not supported on windows; keys are read with enter.
+func rawTerminal() (func(), error) {
+	return nil, errors.New("raw terminal not supported")
+}
+
+// terminalWidth returns the columns of the terminal, 80 if unknown.
+func terminalWidth() int {
+	return 80
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tuiLogLines = 10
+
+// logTail keeps the last lines written to it.
+type logTail struct {
+	mu    sync.Mutex
+	lines []string
+	part  string
+}
+
+func (t *logTail) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ls := strings.Split(t.part+string(b), "\n")
+	t.part = ls[len(ls)-1]
+	t.lines = append(t.lines, ls[:len(ls)-1]...)
+	if len(t.lines) > tuiLogLines {
+		t.lines = t.lines[len(t.lines)-tuiLogLines:]
+	}
+	return len(b), nil
+}
+
+func (t *logTail) last() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+// cut shortens s to w columns.
+func cut(s string, w int) string {
+	s = strings.SplitN(s, "\n", 2)[0]
+	if r := []rune(s); len(r) > w {
+		return string(r[:w-1]) + "~"
+	}
+	return s
+}
+
+// drawTUI writes a screen of s to out.
+func drawTUI(out io.Writer, s *status, logs []string, width int) {
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		b.WriteString(cut(fmt.Sprintf(format, a...), width) + "\x1b[K\n")
+	}
+
+	b.WriteString("\x1b[H")
+	state := "running"
+	if s.Aborted != "" {
+		state = "stopping (" + s.Aborted + ")"
+	} else if s.Paused {
+		state = "paused"
+	}
+	line("imconvvips  %s %s", state,
+		time.Since(s.Started).Round(time.Second))
+	rate := 0.0
+	if n := len(s.History); n >= 2 {
+		rate = float64(s.History[n-1]-s.History[n-2]) / sampleInterval.Seconds()
+	}
+	line("converted %d  failed %d  skipped %d  %.2f files/s",
+		s.Converted, s.Failed, s.Skipped, rate)
+	if len(s.Tags) > 0 {
+		line("tags: %s", s.Tags.String())
+	}
+	line("")
+	line("%3s %8s  %s", "#", "elapsed", "file")
+	for _, w := range s.Workers {
+		line("%3d %8s  %s", w.ID, time.Since(w.Since).Round(time.Second), w.Src)
+	}
+	if len(s.Workers) == 0 {
+		line("    idle")
+	}
+	line("")
+	line("recent failures")
+	for _, f := range s.Failures {
+		line("%s  %s  %s", f.Time.Format("15:04:05"), f.Src, f.Err)
+	}
+	line("")
+	line("log")
+	for _, l := range logs {
+		line("%s", l)
+	}
+	line("")
+	line("keys: p pause/resume  d drain")
+	b.WriteString("\x1b[J")
+	io.WriteString(out, b.String())
+}
+
+// startTUI shows the status of the run on the terminal instead of logs
+// until the returned function is called.
+func startTUI(cfg *config, st *state) func() {
+	tail := &logTail{}
+	log, stdout, stderr := cfg.Log, cfg.Stdout, cfg.Stderr
+	if cfg.LogName != "" {
+		cfg.Log = io.MultiWriter(log, tail)
+	} else {
+		cfg.Log = tail
+	}
+	// converter output would break the screen.
+	if cfg.StdoutLog == "" {
+		cfg.Stdout = io.Discard
+	}
+	if cfg.StderrLog == "" {
+		cfg.Stderr = tail
+	}
+	if cfg.HTTPAddr == "" {
+		go st.sample(sampleInterval)
+	}
+
+	restore, err := rawTerminal()
+	if err != nil {
+		// keys work with enter then.
+		restore = func() {}
+	}
+	onSignal(restore)
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			cmd := ""
+			switch c {
+			case 'p':
+				cmd = "pause"
+				if st.status().Paused {
+					cmd = "resume"
+				}
+			case 'd':
+				cmd = "drain"
+			}
+			if cmd != "" {
+				control(cfg, st, cmd, "tui")
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.WriteString(os.Stdout, "\x1b[2J")
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			drawTUI(os.Stdout, st.status(), tail.last(), terminalWidth())
+			select {
+			case <-t.C:
+			case <-done:
+				drawTUI(os.Stdout, st.status(), tail.last(), terminalWidth())
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		restore()
+		cfg.Log, cfg.Stdout, cfg.Stderr = log, stdout, stderr
+	}
+}
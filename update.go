@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// versionMain prints the version and build info.
+func versionMain(args []string) error {
+	fmt.Printf("imconvvips %s (%s %s/%s)\n",
+		version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if strings.HasPrefix(s.Key, "vcs.") || s.Key == "-tags" {
+				fmt.Printf("  %s: %s\n", s.Key, s.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// release is a GitHub release.
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// assetName is the release asset of this platform.
+func assetName() string {
+	name := fmt.Sprintf("imconvvips_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func httpGet(url string) (io.ReadCloser, error) {
+	c := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// checksum returns the sha256 of name listed in a checksums file, i.e.
+// lines of "HASH  NAME".
+func checksum(url, name string) (string, error) {
+	body, err := httpGet(url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fs := strings.Fields(scanner.Text())
+		if len(fs) == 2 && strings.TrimPrefix(fs[1], "*") == name {
+			return fs[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no checksum of %s", name)
+}
+
+// selfUpdateMain replaces the running executable with the latest release.
+func selfUpdateMain(cfg *config, args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	api := fs.String("api", "https://api.github.com/repos/mkunten/imconvvips",
+		"releases API of the repository or its mirror")
+	check := fs.Bool("check", false, "only report whether an update exists")
+	force := fs.Bool("force", false, "install even if the version is the same")
+	fs.Parse(args)
+
+	body, err := httpGet(strings.TrimSuffix(*api, "/") + "/releases/latest")
+	if err != nil {
+		return err
+	}
+	var rel release
+	err = json.NewDecoder(body).Decode(&rel)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	if rel.Tag == version && !*force {
+		fmt.Printf("up to date: %s\n", version)
+		return nil
+	}
+	if *check {
+		fmt.Printf("update available: %s -> %s\n", version, rel.Tag)
+		return nil
+	}
+
+	var url, sums string
+	name := assetName()
+	for _, a := range rel.Assets {
+		switch a.Name {
+		case name:
+			url = a.URL
+		case "checksums.txt":
+			sums = a.URL
+		}
+	}
+	if url == "" {
+		return fmt.Errorf("release %s has no %s", rel.Tag, name)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	tmp := exe + ".new"
+	if err := download(url, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if sums != "" {
+		want, err := checksum(sums, name)
+		if err == nil {
+			var got string
+			got, err = hashFile(tmp)
+			if err == nil && got != want {
+				err = fmt.Errorf("checksum mismatch of %s", name)
+			}
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	} else {
+		cfg.Log.Write([]byte("warning: release has no checksums.txt\n"))
+	}
+
+	// a running executable cannot be overwritten on windows, but renamed.
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	if runtime.GOOS != "windows" {
+		os.Remove(old)
+	}
+	fmt.Printf("updated: %s -> %s\n", version, rel.Tag)
+	return nil
+}
+
+func download(url, path string) error {
+	body, err := httpGet(url)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// store is where outputs are uploaded: a plain http endpoint, or an object
+// store by the scheme of -upload.
+type store interface {
+	// newRequest returns the request uploading o.
+	newRequest(o *object) (*http.Request, error)
+}
+
+// object is an output to upload with its checksum and metadata recorded
+// along with it, so that fixity checks need no separate manifests.
+type object struct {
+	rel    string // slash separated path relative to the destination dir
+	body   io.Reader
+	size   int64
+	ctype  string
+	sha256 string // hex
+	meta   map[string]string
+}
+
+// uploader sends outputs to -upload, e.g. an ingest api of a repository,
+// each to the url followed by its path relative to the destination dir.
+type uploader struct {
+	store  store
+	client *http.Client
+	sem    chan struct{}
+}
+
+func newUploader(cfg *config) (*uploader, error) {
+	u, err := url.Parse(cfg.Upload)
+	if err != nil {
+		return nil, err
+	}
+	var s store
+	switch u.Scheme {
+	case "http", "https":
+		s, err = newHTTPStore(cfg)
+	case "az":
+		s, err = newAzureStore(u)
+	case "gs":
+		s, err = newGCSStore(u)
+	default:
+		err = fmt.Errorf("upload must be http(s)://, az:// or gs://: %s",
+			cfg.Upload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := cfg.UploadProc
+	if n <= 0 {
+		n = cfg.Proc
+	}
+	return &uploader{
+		store:  s,
+		client: &http.Client{Timeout: 10 * time.Minute},
+		sem:    make(chan struct{}, n),
+	}, nil
+}
+
+// httpStore puts outputs under a url with given headers.
+type httpStore struct {
+	url     string
+	method  string
+	headers http.Header
+}
+
+func newHTTPStore(cfg *config) (*httpStore, error) {
+	m := strings.ToUpper(cfg.UploadMethod)
+	if m != http.MethodPut && m != http.MethodPost {
+		return nil, fmt.Errorf("upload method must be PUT or POST: %s",
+			cfg.UploadMethod)
+	}
+	h := http.Header{}
+	for _, s := range cfg.UploadHeaders {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("upload header must be \"Name: value\": %q", s)
+		}
+		// keep secrets out of config.json, e.g. "Authorization: Bearer $TOKEN".
+		h.Add(strings.TrimSpace(kv[0]), os.ExpandEnv(strings.TrimSpace(kv[1])))
+	}
+	return &httpStore{
+		url:     strings.TrimSuffix(cfg.Upload, "/") + "/",
+		method:  m,
+		headers: h,
+	}, nil
+}
+
+func (s *httpStore) newRequest(o *object) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(cmdCtx, s.method,
+		s.url+escapePath(o.rel), o.body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = o.size
+	req.Header.Set("Content-Type", o.ctype)
+	// rfc 3230 instance digest, checked by e.g. fedora.
+	if sum, err := hex.DecodeString(o.sha256); err == nil {
+		req.Header.Set("Digest",
+			"sha-256="+base64.StdEncoding.EncodeToString(sum))
+	}
+	for k, vs := range s.headers {
+		req.Header[k] = vs
+	}
+	return req, nil
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// upload sends the outputs of r, retrying up to cfg.Retries times.
+func (u *uploader) upload(cfg *config, r *result) error {
+	meta := map[string]string{}
+	if rel, err := filepath.Rel(cfg.SrcDir, r.Src); err == nil {
+		meta["source"] = filepath.ToSlash(rel)
+	}
+	if r.SrcHash != "" {
+		meta["source_sha256"] = r.SrcHash
+	}
+	for _, p := range partials(r.Dest) {
+		if _, err := os.Stat(longPath(p)); os.IsNotExist(err) {
+			continue
+		}
+		err := filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(cfg.DestDir, p)
+			if err != nil {
+				return err
+			}
+			for i := 0; i <= cfg.Retries; i++ {
+				if i > 0 {
+					cfg.Log.Write([]byte(fmt.Sprintf(
+						"warning: %s\n  retry %d/%d\n", err, i, cfg.Retries)))
+					time.Sleep(time.Duration(i) * time.Second)
+				}
+				if err = u.put(p, filepath.ToSlash(rel), meta); err == nil {
+					break
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *uploader) put(path, rel string, meta map[string]string) error {
+	u.sem <- struct{}{}
+	defer func() { <-u.sem }()
+
+	sum, err := hashFile(longPath(path))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := u.store.newRequest(&object{
+		rel:    rel,
+		body:   f,
+		size:   fi.Size(),
+		ctype:  contentType(rel),
+		sha256: sum,
+		meta:   meta,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		// without the query, which may hold a signature.
+		return fmt.Errorf("upload %s://%s%s: %s", req.URL.Scheme, req.URL.Host,
+			req.URL.Path, resp.Status)
+	}
+	return nil
+}
+
+func contentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".tif", ".tiff":
+		return "image/tiff"
+	case ".png":
+		return "image/png"
+	case ".jp2":
+		return "image/jp2"
+	case ".webp":
+		return "image/webp"
+	case ".json":
+		return "application/json"
+	case ".xml", ".dzi":
+		return "application/xml"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// pixelHash returns the sha256 of the decoded pixels of path along with
+// their shape, e.g. "4000x3000x3 uchar".
+func pixelHash(cfg *config, path string) (string, string, error) {
+	props, err := probe(cfg, path)
+	if err != nil {
+		return "", "", err
+	}
+	shape := fmt.Sprintf("%sx%sx%s %s", props["width"], props["height"],
+		props["bands"], props["format"])
+
+	raw := cfg.tmp.path("pixels.raw")
+	defer os.Remove(raw)
+	if _, err := cmdOutput(cfg, formatCmd("vips rawsave %s %s", path,
+		raw)); err != nil {
+		return "", "", err
+	}
+	h, err := hashFile(raw)
+	return h, shape, err
+}
+
+// verifyLossless decodes src and dest and fails unless their pixels are
+// the same, proving a lossless migration. r gets the hash of the pixels.
+func verifyLossless(cfg *config, r *result) error {
+	hs, ss, err := pixelHash(cfg, r.Src)
+	if err != nil {
+		return err
+	}
+	hd, sd, err := pixelHash(cfg, r.Dest)
+	if err != nil {
+		return err
+	}
+	if ss != sd {
+		return fmt.Errorf("lossless: %s is %s but %s is %s", r.Src, ss,
+			r.Dest, sd)
+	}
+	if hs != hd {
+		return fmt.Errorf("lossless: pixels of %s differ from %s", r.Dest,
+			r.Src)
+	}
+	r.PixelHash = hd
+	return nil
+}
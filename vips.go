@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// vipsVersion returns the version of the installed vips, e.g. "8.14.1".
+func vipsVersion() (string, error) {
+	out, err := exec.Command("vips", "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	m := regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`).FindString(string(out))
+	if m == "" {
+		return "", fmt.Errorf("unknown vips version: %q",
+			strings.TrimSpace(string(out)))
+	}
+	return m, nil
+}
+
+// vipsMajor returns the major version number of v.
+func vipsMajor(v string) int {
+	n, _ := strconv.Atoi(strings.SplitN(v, ".", 2)[0])
+	return n
+}
+
+// vipsOps returns the set of operations listed by "vips -l".
+func vipsOps() (map[string]bool, error) {
+	out, err := exec.Command("vips", "-l").Output()
+	if err != nil {
+		return nil, err
+	}
+	ops := map[string]bool{}
+	for _, m := range regexp.MustCompile(`\((\w+)\)|\b(im_\w+)`).
+		FindAllStringSubmatch(string(out), -1) {
+		ops[m[1]+m[2]] = true
+	}
+	return ops, nil
+}
+
+// vipsOp returns the operation name used in a vips command format.
+func vipsOp(format string) string {
+	fs := strings.Fields(format)
+	for i, f := range fs {
+		if f == "vips" && i+1 < len(fs) {
+			return fs[i+1]
+		}
+	}
+	return ""
+}
+
+// checkVips detects the installed vips and verifies that cfg.VipsFmt uses an
+// operation it supports, translating between the old im_* syntax and the new
+// one if allowed. Failures only warn unless -vips-check is "fail".
+func checkVips(cfg *config) error {
+	v, verr := vipsVersion()
+	if verr == nil {
+		cfg.VipsVersion = v
+		if cfg.Verbose {
+			cfg.Log.Write([]byte(fmt.Sprintf("vips version: %s\n", v)))
+		}
+	}
+
+	op := vipsOp(cfg.VipsFmt)
+	if op == "" {
+		// not a vips command, nothing to check.
+		return nil
+	}
+	if verr != nil {
+		err := fmt.Errorf("vips not available: %s", verr)
+		if cfg.VipsCheck == "fail" {
+			return err
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("warning: %s\n", err)))
+		return nil
+	}
+	ops, err := vipsOps()
+	if err != nil {
+		err = fmt.Errorf("vips operations not listed: %s", err)
+		if cfg.VipsCheck == "fail" {
+			return err
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("warning: %s\n", err)))
+		return nil
+	}
+	if ops[op] {
+		return nil
+	}
+
+	if cfg.VipsTranslate {
+		var s string
+		if strings.HasPrefix(op, "im_") {
+			s, err = translateToNew(cfg.VipsFmt)
+		} else {
+			s, err = translateToOld(cfg.VipsFmt)
+		}
+		if err == nil && ops[vipsOp(s)] {
+			cfg.Log.Write([]byte(fmt.Sprintf(
+				"warning: vips %s has no %s, translated:\n  %s\n", v, op, s)))
+			cfg.vipsFmt, cfg.VipsFmt = cfg.VipsFmt, s
+			return nil
+		}
+	}
+
+	err = fmt.Errorf("vips %s does not support %s", v, op)
+	if cfg.VipsCheck == "fail" {
+		return err
+	}
+	cfg.Log.Write([]byte(fmt.Sprintf("warning: %s\n", err)))
+	return nil
+}
+
+// old and new operation names.
+var vipsOpNames = map[string]string{
+	"im_vips2tiff": "tiffsave",
+	"im_vips2jpeg": "jpegsave",
+	"im_vips2png":  "pngsave",
+	"im_copy":      "copy",
+}
+
+// translateToNew rewrites e.g.
+//
+//	vips im_vips2tiff %s %s:jpeg:60,tile:256x256,pyramid
+//
+// as
+//
+//	vips tiffsave %s %s --compression jpeg --Q 60 --tile --tile-width 256 --tile-height 256 --pyramid
+func translateToNew(format string) (string, error) {
+	fs := strings.Fields(format)
+	i := indexOf(fs, "vips")
+	if i < 0 || i+3 >= len(fs) {
+		return "", errors.New("not a vips command")
+	}
+	op, ok := vipsOpNames[fs[i+1]]
+	if !ok {
+		return "", fmt.Errorf("unknown operation: %s", fs[i+1])
+	}
+
+	out, opts := fs[i+3], ""
+	if j := strings.Index(out, ":"); j >= 0 {
+		out, opts = out[:j], out[j+1:]
+	}
+	args := []string{"vips", op, fs[i+2], out}
+
+	switch op {
+	case "tiffsave":
+		for _, o := range strings.Split(opts, ",") {
+			kv := strings.Split(o, ":")
+			switch kv[0] {
+			case "":
+			case "none", "jpeg", "deflate", "packbits", "lzw":
+				args = append(args, "--compression", kv[0])
+				if kv[0] == "jpeg" && len(kv) > 1 {
+					args = append(args, "--Q", kv[1])
+				}
+			case "tile":
+				args = append(args, "--tile")
+				if len(kv) > 1 {
+					wh := strings.SplitN(kv[1], "x", 2)
+					args = append(args, "--tile-width", wh[0])
+					if len(wh) > 1 {
+						args = append(args, "--tile-height", wh[1])
+					}
+				}
+			case "pyramid":
+				args = append(args, "--pyramid")
+			case "strip", "flat":
+			default:
+				return "", fmt.Errorf("unknown tiff option: %s", o)
+			}
+		}
+	case "jpegsave":
+		if opts != "" {
+			args = append(args, "--Q", strings.Split(opts, ",")[0])
+		}
+	case "pngsave":
+		if opts != "" {
+			args = append(args, "--compression", strings.Split(opts, ",")[0])
+		}
+	}
+
+	fs = append(fs[:i], append(args, fs[i+4:]...)...)
+	return strings.Join(fs, " "), nil
+}
+
+// translateToOld is the reverse of translateToNew.
+func translateToOld(format string) (string, error) {
+	fs := strings.Fields(format)
+	i := indexOf(fs, "vips")
+	if i < 0 || i+3 >= len(fs) {
+		return "", errors.New("not a vips command")
+	}
+	op := ""
+	for o, n := range vipsOpNames {
+		if n == fs[i+1] {
+			op = o
+		}
+	}
+	if op == "" {
+		return "", fmt.Errorf("unknown operation: %s", fs[i+1])
+	}
+
+	// collect "--name value" and "--flag" options.
+	vals := map[string]string{}
+	j := i + 4
+	for ; j < len(fs) && strings.HasPrefix(fs[j], "--"); j++ {
+		name := strings.TrimPrefix(fs[j], "--")
+		if j+1 < len(fs) && !strings.HasPrefix(fs[j+1], "--") &&
+			name != "tile" && name != "pyramid" {
+			vals[name] = fs[j+1]
+			j++
+		} else {
+			vals[name] = ""
+		}
+	}
+
+	var opts []string
+	switch op {
+	case "im_vips2tiff":
+		if c, ok := vals["compression"]; ok {
+			if q := vals["Q"]; c == "jpeg" && q != "" {
+				c += ":" + q
+			}
+			opts = append(opts, c)
+		}
+		if _, ok := vals["tile"]; ok {
+			t := "tile"
+			if w := vals["tile-width"]; w != "" {
+				h := vals["tile-height"]
+				if h == "" {
+					h = w
+				}
+				t += ":" + w + "x" + h
+			}
+			opts = append(opts, t)
+		}
+		if _, ok := vals["pyramid"]; ok {
+			opts = append(opts, "pyramid")
+		}
+	case "im_vips2jpeg":
+		if q := vals["Q"]; q != "" {
+			opts = append(opts, q)
+		}
+	case "im_vips2png":
+		if c := vals["compression"]; c != "" {
+			opts = append(opts, c)
+		}
+	}
+
+	out := fs[i+3]
+	if len(opts) > 0 {
+		out += ":" + strings.Join(opts, ",")
+	}
+	args := []string{"vips", op, fs[i+2], out}
+	fs = append(fs[:i], append(args, fs[j:]...)...)
+	return strings.Join(fs, " "), nil
+}
+
+func indexOf(ss []string, s string) int {
+	for i := range ss {
+		if ss[i] == s {
+			return i
+		}
+	}
+	return -1
+}
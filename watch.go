@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchEntry is the last seen state of a file in the source dir.
+type watchEntry struct {
+	size   int64
+	mtime  time.Time
+	since  time.Time // when size and mtime were last changed
+	queued bool
+}
+
+// pollWalk watches cfg.SrcDir by polling, which works on NFS/SMB mounts where
+// inotify does not, and queues files once their size and mtime have been
+// unchanged for cfg.WatchStable so that files being copied are not picked up.
+// it returns when the run is stopped.
+func pollWalk(base *config, st *state, q chan string) error {
+	seen := map[string]*watchEntry{}
+	for {
+		// filters may be reloaded.
+		cfg := st.config(base)
+		now := time.Now()
+		// latest change per directory for -watch-quiet.
+		changed := map[string]time.Time{}
+		err := filepath.Walk(cfg.SrcDir,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					// files may vanish while walking.
+					return nil
+				}
+				if info.IsDir() || !matchExt(cfg, path) {
+					return nil
+				}
+				e, ok := seen[path]
+				if !ok || e.size != info.Size() || !e.mtime.Equal(info.ModTime()) {
+					e = &watchEntry{info.Size(), info.ModTime(), now, false}
+					seen[path] = e
+				}
+				if d := filepath.Dir(path); e.since.After(changed[d]) {
+					changed[d] = e.since
+				}
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+
+		var paths []string
+		for path, e := range seen {
+			if e.queued || now.Sub(e.since) < cfg.WatchStable {
+				continue
+			}
+			d := filepath.Dir(path)
+			if cfg.WatchQuiet > 0 && now.Sub(changed[d]) < cfg.WatchQuiet {
+				continue
+			}
+			if cfg.WatchMarker != "" && !hasMarker(cfg, d) {
+				continue
+			}
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			seen[path].queued = true
+			q <- path
+		}
+
+		select {
+		case <-time.After(cfg.WatchInterval):
+		case <-st.stop:
+			return nil
+		}
+	}
+}
+
+// hasMarker reports whether the delivery complete marker exists in dir or
+// one of its parents up to the source dir.
+func hasMarker(cfg *config, dir string) bool {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, cfg.WatchMarker)); err == nil {
+			return true
+		}
+		rel, err := filepath.Rel(cfg.SrcDir, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+}
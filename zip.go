@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// pack remembers dest converted from src for -zip.
+func (st *state) pack(src, dest string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.packs == nil {
+		st.packs = map[string][]string{}
+	}
+	d := filepath.Dir(src)
+	st.packs[d] = append(st.packs[d], dest)
+}
+
+// packZips packages the outputs of each source directory into a zip in the
+// destination dir named after the directory, e.g. out/vol001.zip for
+// src/vol001, and removes the packaged outputs.
+func packZips(cfg *config, st *state) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	dirs := make([]string, 0, len(st.packs))
+	for d := range st.packs {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+	for _, d := range dirs {
+		rel, err := filepath.Rel(cfg.SrcDir, d)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			abs, _ := filepath.Abs(cfg.SrcDir)
+			rel = filepath.Base(abs)
+		}
+		name := filepath.Join(cfg.DestDir, rel) + ".zip"
+		dests := st.packs[d]
+		sort.Slice(dests, func(i, j int) bool {
+			return naturalLess(dests[i], dests[j])
+		})
+		if err := writeZip(cfg, name, dests); err != nil {
+			return err
+		}
+		cfg.Log.Write([]byte(fmt.Sprintf("info: packed %d files into %s\n",
+			len(dests), name)))
+		for _, dest := range dests {
+			for _, p := range partials(dest) {
+				os.RemoveAll(longPath(p))
+			}
+			// fails unless emptied.
+			os.Remove(longPath(filepath.Dir(dest)))
+		}
+	}
+	return nil
+}
+
+// writeZip writes the outputs of dests into name with paths relative to
+// their common directory.
+func writeZip(cfg *config, name string, dests []string) error {
+	base := filepath.Dir(dests[0])
+	for _, dest := range dests[1:] {
+		for !strings.HasPrefix(dest, base+string(filepath.Separator)) &&
+			base != filepath.Dir(base) {
+			base = filepath.Dir(base)
+		}
+	}
+	method := zip.Deflate
+	if cfg.Zip == "store" {
+		// images are compressed already.
+		method = zip.Store
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(longPath(name + ".part"))
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	add := func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		h, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		h.Name, h.Method = filepath.ToSlash(rel), method
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(longPath(p))
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(w, in)
+		return err
+	}
+	for _, dest := range dests {
+		for _, p := range partials(dest) {
+			if _, serr := os.Stat(longPath(p)); os.IsNotExist(serr) {
+				continue
+			}
+			if err = filepath.Walk(p, add); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(longPath(name + ".part"))
+		return err
+	}
+	return os.Rename(longPath(name+".part"), longPath(name))
+}